@@ -0,0 +1,47 @@
+package main
+
+import (
+	"gochatv1/config"
+	"gochatv1/internal/importer"
+	"gochatv1/internal/room"
+
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// gochat import --slack export.zip
+// gochat import --discord channel.json [more.json | dir ...]
+func runImport(cfg *config.Config, db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	slack := flags.String("slack", "", "Slack export ZIP")
+	discord := flags.Bool("discord", false, "import the DiscordChatExporter JSON files (or directories) given as arguments")
+	flags.Parse(args)
+
+	var src importer.Source
+	var err error
+	switch {
+	case *slack != "":
+		src, err = importer.OpenSlack(*slack)
+	case *discord && flags.NArg() > 0:
+		src, err = importer.OpenDiscord(flags.Args()...)
+	default:
+		flags.Usage()
+		return errors.New("Nothing to import")
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	imp := importer.New(importer.NewRepository(db), room.NewRepository(room.NewHub(), db), cfg)
+	stats, err := imp.Import(context.Background(), src)
+	if stats != nil {
+		fmt.Fprintf(os.Stdout, "Imported %d rooms, %d users, %d messages, %d reactions\n",
+			stats.Rooms, stats.Users, stats.Messages, stats.Reactions)
+	}
+	return err
+}
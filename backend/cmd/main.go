@@ -3,11 +3,13 @@ package main
 import (
 	"gochatv1/config"
 	"gochatv1/db"
+	"gochatv1/internal/notification"
 	"gochatv1/internal/room"
 	"gochatv1/internal/user"
 	"gochatv1/router"
 
 	"log"
+	"os"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -21,10 +23,22 @@ func main() {
 	}
 	defer dbConn.Close()
 
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(cfg, dbConn.GetDB(), os.Args[2:]); err != nil {
+			log.Fatalf("Import failed: %s", err)
+		}
+		return
+	}
+
 	val := validator.New()
 	userHdl := user.Init(cfg, val, dbConn.GetDB())
-	roomHdl := room.Init(cfg, val)
+	notificationHdl, notificationSvc := notification.Init(cfg, val, dbConn.GetDB())
+	blobs, err := room.NewDiskBlobStore(cfg.AttachmentDir)
+	if err != nil {
+		log.Fatalf("Could not open attachment storage: %s", err)
+	}
+	roomHdl := room.Init(cfg, val, dbConn.GetDB(), notificationSvc, blobs)
 
-	r := router.InitRouter(cfg, userHdl, roomHdl)
+	r := router.InitRouter(cfg, userHdl, roomHdl, notificationHdl)
 	router.Start(r, cfg.ServerHost)
 }
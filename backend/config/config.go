@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -11,7 +13,46 @@ type Config struct {
 	JWTKey     string
 	OriginHost string
 	ServerHost string
+	PublicURL  string // where clients reach the server, used for links leaving the app
 	DBTimeout  time.Duration
+	AdminIDs   []string
+
+	MaxGroupMembers int           // 0 allows groups of any size
+	EditWindow      time.Duration // 0 allows editing at any time
+	BroadcastReads  bool          // tell room members how far others have read
+	AwayTimeout     time.Duration // inactivity before a user is shown as away
+	LongPollTimeout time.Duration // pollers not polled for twice as long are dropped
+
+	RoomReloadInterval time.Duration // how often rooms saved elsewhere, e.g. by gochat import, are picked up, 0 never
+
+	WSReadBufferSize       int // bytes, 0 reuses the buffer of the HTTP server
+	WSWriteBufferSize      int // bytes, taken from a pool shared by all connections while writing
+	WSHandshakeTimeout     time.Duration
+	WSWriteTimeout         time.Duration
+	WSCompression          bool // permessage-deflate for clients offering it
+	WSCompressionLevel     int  // 1 (fastest) to 9 (smallest)
+	WSCompressionThreshold int  // bytes, smaller messages are sent uncompressed
+
+	NotifyBatchWindow time.Duration // notifications within the window are sent as one digest
+	NotifyTimeout     time.Duration
+	NotifyLocal       bool // enables the in-memory channel which only logs notifications
+	SMTPAddr          string
+	SMTPFrom          string
+	SMTPUser          string
+	SMTPPassword      string
+	VAPIDPublicKey    string // generated and stored in the DB if not set
+	VAPIDPrivateKey   string
+	VAPIDSubject      string // contact push services can reach us at
+
+	AttachmentDir     string
+	MaxAttachmentSize int      // bytes per file
+	AttachmentTypes   []string // allowed MIME types, "image/*" allows all images
+
+	RetentionMaxAgeDays int // default retention of rooms without a policy, 0 keeps messages forever
+	RetentionMaxCount   int // top-level messages kept per room, 0 for no limit
+	RetentionInterval   time.Duration
+	RetentionBatch      int
+	RetentionArchive    bool // move pruned messages to messages_archive instead of deleting them
 }
 
 func New() *Config {
@@ -21,7 +62,46 @@ func New() *Config {
 		JWTKey:     getEnv("JWT_KEY", "secret"),
 		OriginHost: getEnv("ORIGIN_HOST", "http://localhost:3000"),
 		ServerHost: getEnv("SERVER_HOST", "0.0.0.0:8080"),
+		PublicURL:  getEnv("PUBLIC_URL", "http://localhost:8080"),
 		DBTimeout:  time.Duration(2) * time.Second,
+		AdminIDs:   getEnvList("ADMIN_IDS", []string{}),
+
+		MaxGroupMembers: getEnvInt("MAX_GROUP_MEMBERS", 10),
+		EditWindow:      getEnvDuration("EDIT_WINDOW", 15*time.Minute),
+		BroadcastReads:  getEnvBool("BROADCAST_READS", true),
+		AwayTimeout:     getEnvDuration("AWAY_TIMEOUT", 5*time.Minute),
+		LongPollTimeout: getEnvDuration("LONG_POLL_TIMEOUT", 25*time.Second),
+
+		RoomReloadInterval: getEnvDuration("ROOM_RELOAD_INTERVAL", time.Minute),
+
+		WSReadBufferSize:       getEnvInt("WS_READ_BUFFER_SIZE", 0),
+		WSWriteBufferSize:      getEnvInt("WS_WRITE_BUFFER_SIZE", 4096),
+		WSHandshakeTimeout:     getEnvDuration("WS_HANDSHAKE_TIMEOUT", 10*time.Second),
+		WSWriteTimeout:         getEnvDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+		WSCompression:          getEnvBool("WS_COMPRESSION", true),
+		WSCompressionLevel:     getEnvInt("WS_COMPRESSION_LEVEL", 1),
+		WSCompressionThreshold: getEnvInt("WS_COMPRESSION_THRESHOLD", 512),
+
+		NotifyBatchWindow: getEnvDuration("NOTIFY_BATCH_WINDOW", time.Minute),
+		NotifyTimeout:     getEnvDuration("NOTIFY_TIMEOUT", 10*time.Second),
+		NotifyLocal:       getEnvBool("NOTIFY_LOCAL", false),
+		SMTPAddr:          getEnv("SMTP_ADDR", ""),
+		SMTPFrom:          getEnv("SMTP_FROM", "gochat@localhost"),
+		SMTPUser:          getEnv("SMTP_USER", ""),
+		SMTPPassword:      getEnv("SMTP_PASSWORD", ""),
+		VAPIDPublicKey:    getEnv("VAPID_PUBLIC_KEY", ""),
+		VAPIDPrivateKey:   getEnv("VAPID_PRIVATE_KEY", ""),
+		VAPIDSubject:      getEnv("VAPID_SUBJECT", "mailto:admin@localhost"),
+
+		AttachmentDir:     getEnv("ATTACHMENT_DIR", "data/attachments"),
+		MaxAttachmentSize: getEnvInt("MAX_ATTACHMENT_SIZE", 10<<20),
+		AttachmentTypes:   getEnvList("ATTACHMENT_TYPES", []string{"image/*", "application/pdf", "text/plain", "application/zip"}),
+
+		RetentionMaxAgeDays: getEnvInt("RETENTION_MAX_AGE_DAYS", 0),
+		RetentionMaxCount:   getEnvInt("RETENTION_MAX_COUNT", 0),
+		RetentionInterval:   getEnvDuration("RETENTION_INTERVAL", time.Hour),
+		RetentionBatch:      getEnvInt("RETENTION_BATCH", 1000),
+		RetentionArchive:    getEnvBool("RETENTION_ARCHIVE", false),
 	}
 }
 
@@ -32,3 +112,48 @@ func getEnv(key string, defaultVal string) string {
 
 	return defaultVal
 }
+
+func getEnvInt(key string, defaultVal int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+
+	return defaultVal
+}
+
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+
+	return defaultVal
+}
+
+// Comma separated values, blank entries are skipped.
+func getEnvList(key string, defaultVal []string) []string {
+	if value, exists := os.LookupEnv(key); exists {
+		list := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+
+	return defaultVal
+}
+
+func getEnvBool(key string, defaultVal bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+
+	return defaultVal
+}
@@ -0,0 +1,285 @@
+package importer
+
+import (
+	"gochatv1/internal/room"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type discordUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Nickname string `json:"nickname"`
+}
+
+type discordHeader struct {
+	Guild struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"guild"`
+	Channel struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"channel"`
+}
+
+type discordMessage struct {
+	ID              string      `json:"id"`
+	Type            string      `json:"type"`
+	Timestamp       time.Time   `json:"timestamp"`
+	TimestampEdited *time.Time  `json:"timestampEdited"`
+	Content         string      `json:"content"`
+	Author          discordUser `json:"author"`
+	Reactions       []struct {
+		Emoji struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"emoji"`
+		Users []discordUser `json:"users"`
+	} `json:"reactions"`
+	Reference *struct {
+		MessageID string `json:"messageId"`
+	} `json:"reference"`
+}
+
+// Channel types of private conversations
+var discordKinds = map[string]string{
+	"DirectTextChat":      room.KindDirect,
+	"DirectGroupTextChat": room.KindGroup,
+}
+
+// Discord IDs count milliseconds since the start of 2015 in their upper bits
+const discordEpoch = 1420070400000
+
+// Reads channels exported by DiscordChatExporter in JSON format, one file per channel.
+type discordSource struct {
+	files    map[string]string
+	channels []*Channel
+	users    map[string]*User
+}
+
+// Names are JSON files or directories containing them.
+func OpenDiscord(names ...string) (Source, error) {
+	s := &discordSource{
+		files: make(map[string]string),
+		users: make(map[string]*User),
+	}
+
+	for _, name := range names {
+		err := filepath.WalkDir(name, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || (p != name && filepath.Ext(p) != ".json") {
+				return err
+			}
+			if err := s.addFile(p); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(s.channels, func(i, j int) bool { return s.channels[i].CreatedAt.Before(s.channels[j].CreatedAt) })
+
+	return s, nil
+}
+
+func (s *discordSource) Name() string {
+	return "discord"
+}
+
+func (s *discordSource) Close() error {
+	return nil
+}
+
+func (s *discordSource) Channels() ([]*Channel, error) {
+	return s.channels, nil
+}
+
+func (s *discordSource) Messages(channel *Channel, fn func(*Message) error) error {
+	name, ok := s.files[channel.SourceID]
+	if !ok {
+		return errors.New("Channel is not in the export")
+	}
+
+	// Replies are flattened onto the message that started the thread
+	parents := make(map[string]string)
+	return s.readMessages(name, func(m *discordMessage) error {
+		msg := &Message{
+			SourceID:  m.ID,
+			Author:    s.user(m.Author),
+			Content:   m.Content,
+			CreatedAt: m.Timestamp,
+			EditedAt:  m.TimestampEdited,
+		}
+		if m.Reference != nil {
+			if parentID, ok := parents[m.Reference.MessageID]; ok {
+				msg.ParentID = parentID
+			}
+		}
+		parents[m.ID] = m.ID
+		if msg.ParentID != "" {
+			parents[m.ID] = msg.ParentID
+		}
+
+		for _, r := range m.Reactions {
+			// Custom emoji of the server, rooms only take Unicode emoji
+			if r.Emoji.ID != "" {
+				continue
+			}
+			reaction := Reaction{Emoji: r.Emoji.Name}
+			for _, u := range r.Users {
+				reaction.Users = append(reaction.Users, s.user(u))
+			}
+			msg.Reactions = append(msg.Reactions, reaction)
+		}
+
+		return fn(msg)
+	})
+}
+
+// Reads the channel of a file, private conversations are scanned for their members.
+func (s *discordSource) addFile(name string) error {
+	var header discordHeader
+	err := s.read(name, func(dec *json.Decoder, key string) (bool, error) {
+		switch key {
+		case "guild":
+			return true, dec.Decode(&header.Guild)
+		case "channel":
+			return true, dec.Decode(&header.Channel)
+		case "messages":
+			return true, errStopReading
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if header.Channel.ID == "" {
+		return errors.New("Not a DiscordChatExporter JSON export")
+	}
+
+	channel := &Channel{
+		SourceID:  header.Channel.ID,
+		Name:      header.Channel.Name,
+		Kind:      room.KindRoom,
+		CreatedAt: discordTime(header.Channel.ID),
+	}
+	if kind, ok := discordKinds[header.Channel.Type]; ok {
+		channel.Kind = kind
+		members := make(map[string]bool)
+		err := s.readMessages(name, func(m *discordMessage) error {
+			if !members[m.Author.ID] {
+				members[m.Author.ID] = true
+				channel.Members = append(channel.Members, s.user(m.Author))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.files[channel.SourceID] = name
+	s.channels = append(s.channels, channel)
+	return nil
+}
+
+// Streams the messages array, system messages (pins, joins, calls...) are skipped.
+func (s *discordSource) readMessages(name string, fn func(*discordMessage) error) error {
+	return s.read(name, func(dec *json.Decoder, key string) (bool, error) {
+		if key != "messages" {
+			return false, nil
+		}
+
+		if _, err := dec.Token(); err != nil {
+			return true, err
+		}
+		for dec.More() {
+			var m discordMessage
+			if err := dec.Decode(&m); err != nil {
+				return true, err
+			}
+			if (m.Type != "Default" && m.Type != "Reply") || m.Content == "" {
+				continue
+			}
+			if err := fn(&m); err != nil {
+				return true, err
+			}
+		}
+		_, err := dec.Token()
+		return true, err
+	})
+}
+
+var errStopReading = errors.New("Stop reading")
+
+// Calls fn with the decoder positioned at the value of each top-level key,
+// values fn doesn't consume are skipped. Returning errStopReading ends early.
+func (s *discordSource) read(name string, fn func(dec *json.Decoder, key string) (bool, error)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		key, _ := token.(string)
+		consumed, err := fn(dec, key)
+		if errors.Is(err, errStopReading) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *discordSource) user(u discordUser) *User {
+	if existing, ok := s.users[u.ID]; ok {
+		return existing
+	}
+
+	name := u.Nickname
+	if name == "" {
+		name = u.Name
+	}
+	user := &User{SourceID: u.ID, Name: name}
+	s.users[u.ID] = user
+	return user
+}
+
+func discordTime(id string) time.Time {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(int64(n>>22) + discordEpoch)
+}
@@ -0,0 +1,213 @@
+package importer
+
+import "strings"
+
+// Unicode emoji of the Slack shortcodes most used as reactions. Rooms only
+// take Unicode emoji as reactions, so shortcodes missing here and custom emoji
+// are left out of the import.
+var slackEmoji = map[string]string{
+	"+1":                            "👍",
+	"thumbsup":                      "👍",
+	"-1":                            "👎",
+	"thumbsdown":                    "👎",
+	"ok_hand":                       "👌",
+	"clap":                          "👏",
+	"pray":                          "🙏",
+	"raised_hands":                  "🙌",
+	"wave":                          "👋",
+	"muscle":                        "💪",
+	"point_up":                      "☝️",
+	"point_up_2":                    "👆",
+	"point_down":                    "👇",
+	"point_left":                    "👈",
+	"point_right":                   "👉",
+	"v":                             "✌️",
+	"crossed_fingers":               "🤞",
+	"handshake":                     "🤝",
+	"fist":                          "✊",
+	"facepunch":                     "👊",
+	"punch":                         "👊",
+	"eyes":                          "👀",
+	"brain":                         "🧠",
+	"smile":                         "😄",
+	"smiley":                        "😃",
+	"grinning":                      "😀",
+	"grin":                          "😁",
+	"laughing":                      "😆",
+	"satisfied":                     "😆",
+	"sweat_smile":                   "😅",
+	"joy":                           "😂",
+	"rolling_on_the_floor_laughing": "🤣",
+	"slightly_smiling_face":         "🙂",
+	"upside_down_face":              "🙃",
+	"wink":                          "😉",
+	"blush":                         "😊",
+	"innocent":                      "😇",
+	"heart_eyes":                    "😍",
+	"star-struck":                   "🤩",
+	"kissing_heart":                 "😘",
+	"yum":                           "😋",
+	"stuck_out_tongue":              "😛",
+	"stuck_out_tongue_winking_eye":  "😜",
+	"hugging_face":                  "🤗",
+	"thinking_face":                 "🤔",
+	"face_with_raised_eyebrow":      "🤨",
+	"neutral_face":                  "😐",
+	"expressionless":                "😑",
+	"no_mouth":                      "😶",
+	"smirk":                         "😏",
+	"unamused":                      "😒",
+	"face_with_rolling_eyes":        "🙄",
+	"grimacing":                     "😬",
+	"relieved":                      "😌",
+	"pensive":                       "😔",
+	"sleepy":                        "😪",
+	"sleeping":                      "😴",
+	"mask":                          "😷",
+	"exploding_head":                "🤯",
+	"sunglasses":                    "😎",
+	"nerd_face":                     "🤓",
+	"confused":                      "😕",
+	"worried":                       "😟",
+	"slightly_frowning_face":        "🙁",
+	"open_mouth":                    "😮",
+	"astonished":                    "😲",
+	"flushed":                       "😳",
+	"pleading_face":                 "🥺",
+	"cry":                           "😢",
+	"sob":                           "😭",
+	"scream":                        "😱",
+	"disappointed":                  "😞",
+	"sweat":                         "😓",
+	"weary":                         "😩",
+	"tired_face":                    "😫",
+	"triumph":                       "😤",
+	"rage":                          "😡",
+	"angry":                         "😠",
+	"skull":                         "💀",
+	"poop":                          "💩",
+	"hankey":                        "💩",
+	"clown_face":                    "🤡",
+	"ghost":                         "👻",
+	"robot_face":                    "🤖",
+	"see_no_evil":                   "🙈",
+	"heart":                         "❤️",
+	"orange_heart":                  "🧡",
+	"yellow_heart":                  "💛",
+	"green_heart":                   "💚",
+	"blue_heart":                    "💙",
+	"purple_heart":                  "💜",
+	"black_heart":                   "🖤",
+	"broken_heart":                  "💔",
+	"sparkling_heart":               "💖",
+	"two_hearts":                    "💕",
+	"100":                           "💯",
+	"boom":                          "💥",
+	"collision":                     "💥",
+	"fire":                          "🔥",
+	"sparkles":                      "✨",
+	"star":                          "⭐",
+	"star2":                         "🌟",
+	"zap":                           "⚡",
+	"tada":                          "🎉",
+	"confetti_ball":                 "🎊",
+	"balloon":                       "🎈",
+	"gift":                          "🎁",
+	"trophy":                        "🏆",
+	"medal":                         "🏅",
+	"rocket":                        "🚀",
+	"dart":                          "🎯",
+	"bulb":                          "💡",
+	"memo":                          "📝",
+	"pushpin":                       "📌",
+	"link":                          "🔗",
+	"lock":                          "🔒",
+	"key":                           "🔑",
+	"bell":                          "🔔",
+	"mag":                           "🔍",
+	"hourglass":                     "⌛",
+	"stopwatch":                     "⏱️",
+	"calendar":                      "📆",
+	"coffee":                        "☕",
+	"beer":                          "🍺",
+	"beers":                         "🍻",
+	"pizza":                         "🍕",
+	"cake":                          "🍰",
+	"birthday":                      "🎂",
+	"sunny":                         "☀️",
+	"rainbow":                       "🌈",
+	"snowflake":                     "❄️",
+	"white_check_mark":              "✅",
+	"heavy_check_mark":              "✔️",
+	"ballot_box_with_check":         "☑️",
+	"x":                             "❌",
+	"negative_squared_cross_mark":   "❎",
+	"heavy_plus_sign":               "➕",
+	"heavy_minus_sign":              "➖",
+	"question":                      "❓",
+	"grey_question":                 "❔",
+	"exclamation":                   "❗",
+	"heavy_exclamation_mark":        "❗",
+	"bangbang":                      "‼️",
+	"warning":                       "⚠️",
+	"no_entry":                      "⛔",
+	"no_entry_sign":                 "🚫",
+	"rotating_light":                "🚨",
+	"construction":                  "🚧",
+	"arrow_up":                      "⬆️",
+	"arrow_down":                    "⬇️",
+	"arrow_left":                    "⬅️",
+	"arrow_right":                   "➡️",
+	"arrows_counterclockwise":       "🔄",
+	"repeat":                        "🔁",
+	"red_circle":                    "🔴",
+	"large_green_circle":            "🟢",
+	"large_blue_circle":             "🔵",
+	"white_circle":                  "⚪",
+	"black_circle":                  "⚫",
+	"speech_balloon":                "💬",
+	"thought_balloon":               "💭",
+	"zzz":                           "💤",
+	"dog":                           "🐶",
+	"cat":                           "🐱",
+	"unicorn_face":                  "🦄",
+	"bug":                           "🐛",
+	"turtle":                        "🐢",
+	"snail":                         "🐌",
+	"octopus":                       "🐙",
+	"parrot":                        "🦜",
+	"ship":                          "🚢",
+	"checkered_flag":                "🏁",
+	"triangular_flag_on_post":       "🚩",
+	"moneybag":                      "💰",
+	"chart_with_upwards_trend":      "📈",
+	"chart_with_downwards_trend":    "📉",
+}
+
+// Slack appends the skin tone to the name, as in "+1::skin-tone-3"
+var slackSkinTones = map[string]string{
+	"skin-tone-2": "\U0001F3FB",
+	"skin-tone-3": "\U0001F3FC",
+	"skin-tone-4": "\U0001F3FD",
+	"skin-tone-5": "\U0001F3FE",
+	"skin-tone-6": "\U0001F3FF",
+}
+
+// Returns the Unicode emoji of a Slack reaction name, false when it has none.
+func slackReaction(name string) (string, bool) {
+	base, tone, _ := strings.Cut(name, "::")
+	emoji, ok := slackEmoji[base]
+	if !ok {
+		return "", false
+	}
+
+	if tone != "" {
+		modifier, ok := slackSkinTones[tone]
+		if !ok {
+			return "", false
+		}
+		emoji = strings.TrimSuffix(emoji, "\uFE0F") + modifier
+	}
+
+	return emoji, true
+}
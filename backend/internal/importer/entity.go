@@ -0,0 +1,73 @@
+package importer
+
+import (
+	"gochatv1/internal/room"
+	"gochatv1/internal/user"
+
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Someone as known by the exporting service, Email is empty when the export has none.
+type User struct {
+	SourceID string
+	Name     string
+	Email    string
+}
+
+// Kind is one of the room kinds, Members are only set for private conversations.
+type Channel struct {
+	SourceID  string
+	Name      string
+	Kind      string
+	Members   []*User
+	CreatedAt time.Time
+}
+
+type Reaction struct {
+	Emoji string
+	Users []*User
+}
+
+// ParentID is the SourceID of the thread the message replies to.
+type Message struct {
+	SourceID  string
+	Author    *User
+	Content   string
+	CreatedAt time.Time
+	EditedAt  *time.Time
+	ParentID  string
+	Reactions []Reaction
+}
+
+// An opened export. Messages are streamed one channel at a time, oldest first.
+type Source interface {
+	Name() string
+	Channels() ([]*Channel, error)
+	Messages(channel *Channel, fn func(*Message) error) error
+	Close() error
+}
+
+type Stats struct {
+	Users     int
+	Rooms     int
+	Messages  int
+	Reactions int
+}
+
+type Repository interface {
+	UpsertUser(ctx context.Context, user *user.User) (*user.User, error)
+	GetRoomIDByName(ctx context.Context, name string) (string, error)
+	GetDirectID(ctx context.Context, memberIDs []string) (string, error)
+	CreateMessages(ctx context.Context, msgs []*room.Message) (int, int, error)
+	UpdateThreads(ctx context.Context, roomID string) error
+}
+
+// Makes possible to inject DB connection (in prod) or Tx transaction (in tests)
+type DBTx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
@@ -0,0 +1,226 @@
+package importer
+
+import (
+	"gochatv1/config"
+	"gochatv1/internal/room"
+	"gochatv1/internal/user"
+
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Messages inserted per statement
+const importBatch = 500
+
+// Not a bcrypt hash, so nobody can sign in as an imported user until they get a real password
+const unusablePassword = "!"
+
+// Maps an export onto users, rooms and messages. Importing the same export again
+// only adds what is missing, as every record gets an ID derived from its source.
+type Importer struct {
+	repository Repository
+	rooms      room.Repository
+	config     *config.Config
+	users      map[string]*user.User
+}
+
+func New(repo Repository, rooms room.Repository, cfg *config.Config) *Importer {
+	return &Importer{
+		repository: repo,
+		rooms:      rooms,
+		config:     cfg,
+		users:      make(map[string]*user.User),
+	}
+}
+
+func (im *Importer) Import(ctx context.Context, src Source) (*Stats, error) {
+	channels, err := src.Channels()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	for _, channel := range channels {
+		if err := im.importChannel(ctx, src, channel, stats); err != nil {
+			return stats, fmt.Errorf("%s: %w", channel.Name, err)
+		}
+		stats.Rooms++
+		stats.Users = len(im.users)
+	}
+
+	return stats, nil
+}
+
+func (im *Importer) importChannel(ctx context.Context, src Source, channel *Channel, stats *Stats) error {
+	memberIDs := make([]string, 0, len(channel.Members))
+	for _, member := range channel.Members {
+		u, err := im.user(ctx, src, member)
+		if err != nil {
+			return err
+		}
+		memberIDs = append(memberIDs, strconv.FormatInt(u.ID, 10))
+	}
+	sort.Strings(memberIDs)
+
+	roomID, err := im.room(ctx, src, channel, memberIDs)
+	if err != nil {
+		return err
+	}
+
+	// Replies whose parent isn't in the export are imported as regular messages
+	parents := make(map[string]string)
+	batch := make([]*room.Message, 0, importBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		context, cancel := context.WithTimeout(ctx, im.config.DBTimeout)
+		defer cancel()
+
+		messages, reactions, err := im.repository.CreateMessages(context, batch)
+		if err != nil {
+			return err
+		}
+		stats.Messages += messages
+		stats.Reactions += reactions
+		batch = batch[:0]
+		return nil
+	}
+
+	err = src.Messages(channel, func(m *Message) error {
+		author, err := im.user(ctx, src, m.Author)
+		if err != nil {
+			return err
+		}
+
+		msg := &room.Message{
+			ID:        importID(m.CreatedAt, src.Name(), "message", channel.SourceID, m.SourceID),
+			RoomID:    roomID,
+			UserID:    strconv.FormatInt(author.ID, 10),
+			Username:  author.Username,
+			Content:   m.Content,
+			CreatedAt: m.CreatedAt,
+			EditedAt:  m.EditedAt,
+			ParentID:  parents[m.ParentID],
+		}
+		if msg.ParentID == "" {
+			parents[m.SourceID] = msg.ID
+		}
+
+		for _, r := range m.Reactions {
+			reaction := room.Reaction{Emoji: r.Emoji}
+			for _, reactor := range r.Users {
+				u, err := im.user(ctx, src, reactor)
+				if err != nil {
+					return err
+				}
+				reaction.UserIDs = append(reaction.UserIDs, strconv.FormatInt(u.ID, 10))
+			}
+			msg.Reactions = append(msg.Reactions, reaction)
+		}
+
+		batch = append(batch, msg)
+		if len(batch) == importBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	context, cancel := context.WithTimeout(ctx, im.config.DBTimeout)
+	defer cancel()
+
+	return im.repository.UpdateThreads(context, roomID)
+}
+
+// Public channels are merged into the room of the same name, DMs into the
+// pair's direct room. Other channels get rooms of their own.
+func (im *Importer) room(ctx context.Context, src Source, channel *Channel, memberIDs []string) (string, error) {
+	context, cancel := context.WithTimeout(ctx, im.config.DBTimeout)
+	defer cancel()
+
+	kind := channel.Kind
+	if kind == room.KindDirect && len(memberIDs) != 2 {
+		kind = room.KindGroup
+	}
+
+	var roomID string
+	var err error
+	switch kind {
+	case room.KindRoom:
+		roomID, err = im.repository.GetRoomIDByName(context, channel.Name)
+	case room.KindDirect:
+		roomID, err = im.repository.GetDirectID(context, memberIDs)
+	}
+	if err != nil || roomID != "" {
+		return roomID, err
+	}
+
+	roomID = importID(channel.CreatedAt, src.Name(), "channel", channel.SourceID)
+	newRoom := room.NewRoom(roomID, channel.Name)
+	if kind != room.KindRoom {
+		newRoom = room.NewGroupRoom(roomID, channel.Name, memberIDs)
+		newRoom.Kind = kind
+	}
+
+	return roomID, im.rooms.SaveRoom(context, newRoom)
+}
+
+// Users are matched by email, those without one get a placeholder address
+// unique to their source account.
+func (im *Importer) user(ctx context.Context, src Source, u *User) (*user.User, error) {
+	if existing, ok := im.users[u.SourceID]; ok {
+		return existing, nil
+	}
+
+	email := strings.ToLower(u.Email)
+	if email == "" {
+		email = fmt.Sprintf("%s-%s@import.invalid", src.Name(), strings.ToLower(u.SourceID))
+	}
+	username := u.Name
+	if username == "" {
+		username = u.SourceID
+	}
+
+	context, cancel := context.WithTimeout(ctx, im.config.DBTimeout)
+	defer cancel()
+
+	res, err := im.repository.UpsertUser(context, &user.User{
+		Username: username,
+		Email:    email,
+		Password: unusablePassword,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	im.users[u.SourceID] = res
+	return res, nil
+}
+
+// The same source record always gets the same ID. The time part keeps
+// imported messages ordered among the others.
+func importID(t time.Time, parts ...string) string {
+	if t.Before(time.Unix(0, 0)) {
+		t = time.Unix(0, 0)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+
+	var id ulid.ULID
+	_ = id.SetTime(ulid.Timestamp(t))
+	_ = id.SetEntropy(sum[:10])
+	return id.String()
+}
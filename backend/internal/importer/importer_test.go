@@ -0,0 +1,291 @@
+package importer_test
+
+import (
+	"gochatv1/config"
+	"gochatv1/internal/importer"
+	"gochatv1/internal/room"
+	"gochatv1/internal/user"
+
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeSlackExport(t *testing.T, files map[string]string) string {
+	name := filepath.Join(t.TempDir(), "export.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("Failed to create export: %s", err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for path, content := range files {
+		fw, err := w.Create(path)
+		if err != nil {
+			t.Fatalf("Failed to add %s: %s", path, err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write export: %s", err)
+	}
+
+	return name
+}
+
+var slackExport = map[string]string{
+	"users.json": `[
+		{"id": "U1", "name": "alice", "profile": {"display_name": "Alice", "email": "alice@example.com"}},
+		{"id": "U2", "name": "bob", "profile": {}}
+	]`,
+	"channels.json": `[{"id": "C1", "name": "general", "created": 1500000000, "members": ["U1", "U2"]}]`,
+	"dms.json":      `[{"id": "D1", "created": 1500000000, "members": ["U1", "U2"]}]`,
+	"general/2017-07-15.json": `[
+		{"type": "message", "user": "U2", "text": "thanks <@U1>", "ts": "1500100001.000200", "thread_ts": "1500100000.000100"},
+		{"type": "message", "user": "U1", "text": "hi &lt;3 <!here> see <https://example.com|docs>", "ts": "1500100000.000100",
+			"thread_ts": "1500100000.000100", "reactions": [{"name": "wave", "users": ["U2"], "count": 1},
+			{"name": "+1::skin-tone-2", "users": ["U1"], "count": 1}, {"name": "partyparrot", "users": ["U2"], "count": 1}]},
+		{"type": "message", "subtype": "channel_join", "user": "U2", "text": "<@U2> has joined the channel", "ts": "1500000001.000000"}
+	]`,
+	"general/2017-07-16.json": `[{"type": "message", "user": "U1", "text": "next day", "ts": "1500200000.000000", "edited": {"ts": "1500200001.000000"}}]`,
+	"D1/2017-07-15.json":      `[{"type": "message", "user": "U2", "text": "psst", "ts": "1500100002.000000"}]`,
+}
+
+func TestOpenSlack(t *testing.T) {
+	src, err := importer.OpenSlack(writeSlackExport(t, slackExport))
+	if err != nil {
+		t.Fatalf("Failed to open export: %s", err)
+	}
+	defer src.Close()
+
+	channels, err := src.Channels()
+	if err != nil {
+		t.Fatalf("Failed to read channels: %s", err)
+	}
+
+	alice := &importer.User{SourceID: "U1", Name: "Alice", Email: "alice@example.com"}
+	bob := &importer.User{SourceID: "U2", Name: "bob"}
+	want := []*importer.Channel{
+		{SourceID: "C1", Name: "general", Kind: room.KindRoom, CreatedAt: time.Unix(1500000000, 0)},
+		{SourceID: "D1", Kind: room.KindDirect, Members: []*importer.User{alice, bob}, CreatedAt: time.Unix(1500000000, 0)},
+	}
+	if diff := cmp.Diff(want, channels); diff != "" {
+		t.Errorf("Channels() mismatch (-want +got):\n%s", diff)
+	}
+
+	var msgs []*importer.Message
+	err = src.Messages(channels[0], func(msg *importer.Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read messages: %s", err)
+	}
+
+	editedAt := time.Unix(1500200001, 0)
+	wantMsgs := []*importer.Message{
+		{
+			SourceID:  "1500100000.000100",
+			Author:    alice,
+			Content:   "hi <3 @room see docs (https://example.com)",
+			CreatedAt: time.Unix(1500100000, 100000),
+			Reactions: []importer.Reaction{
+				{Emoji: "👋", Users: []*importer.User{bob}},
+				{Emoji: "👍🏻", Users: []*importer.User{alice}},
+			},
+		},
+		{
+			SourceID:  "1500100001.000200",
+			Author:    bob,
+			Content:   "thanks @Alice",
+			CreatedAt: time.Unix(1500100001, 200000),
+			ParentID:  "1500100000.000100",
+		},
+		{
+			SourceID:  "1500200000.000000",
+			Author:    alice,
+			Content:   "next day",
+			CreatedAt: time.Unix(1500200000, 0),
+			EditedAt:  &editedAt,
+		},
+	}
+	if diff := cmp.Diff(wantMsgs, msgs); diff != "" {
+		t.Errorf("Messages() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOpenDiscord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "dm.json")
+	export := `{
+		"guild": {"id": "0", "name": "Direct Messages"},
+		"channel": {"id": "700000000000000000", "type": "DirectTextChat", "name": "bob"},
+		"messages": [
+			{"id": "1", "type": "Default", "timestamp": "2020-05-01T10:00:00+00:00", "content": "hello",
+				"author": {"id": "10", "name": "alice", "nickname": "Alice"},
+				"reactions": [{"emoji": {"id": "", "name": "👍"}, "count": 1, "users": [{"id": "20", "name": "bob"}]},
+					{"emoji": {"id": "800000000000000000", "name": "pepe"}, "count": 1, "users": [{"id": "20", "name": "bob"}]}]},
+			{"id": "2", "type": "ChannelPinnedMessage", "timestamp": "2020-05-01T10:00:30+00:00", "content": "",
+				"author": {"id": "10", "name": "alice"}},
+			{"id": "3", "type": "Reply", "timestamp": "2020-05-01T10:01:00+00:00", "timestampEdited": "2020-05-01T10:02:00+00:00",
+				"content": "hey", "author": {"id": "20", "name": "bob"}, "reference": {"messageId": "1"}},
+			{"id": "4", "type": "Reply", "timestamp": "2020-05-01T10:03:00+00:00", "content": "nested",
+				"author": {"id": "10", "name": "alice"}, "reference": {"messageId": "3"}}
+		],
+		"messageCount": 4
+	}`
+	if err := os.WriteFile(name, []byte(export), 0o600); err != nil {
+		t.Fatalf("Failed to write export: %s", err)
+	}
+
+	src, err := importer.OpenDiscord(name)
+	if err != nil {
+		t.Fatalf("Failed to open export: %s", err)
+	}
+	defer src.Close()
+
+	channels, _ := src.Channels()
+	alice := &importer.User{SourceID: "10", Name: "Alice"}
+	bob := &importer.User{SourceID: "20", Name: "bob"}
+	want := []*importer.Channel{{
+		SourceID:  "700000000000000000",
+		Name:      "bob",
+		Kind:      room.KindDirect,
+		Members:   []*importer.User{alice, bob},
+		CreatedAt: time.UnixMilli(700000000000000000>>22 + 1420070400000),
+	}}
+	if diff := cmp.Diff(want, channels); diff != "" {
+		t.Errorf("Channels() mismatch (-want +got):\n%s", diff)
+	}
+
+	var msgs []*importer.Message
+	err = src.Messages(channels[0], func(msg *importer.Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read messages: %s", err)
+	}
+
+	at := func(s string) time.Time {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return ts
+	}
+	editedAt := at("2020-05-01T10:02:00Z")
+	wantMsgs := []*importer.Message{
+		{SourceID: "1", Author: alice, Content: "hello", CreatedAt: at("2020-05-01T10:00:00Z"),
+			Reactions: []importer.Reaction{{Emoji: "👍", Users: []*importer.User{bob}}}},
+		{SourceID: "3", Author: bob, Content: "hey", CreatedAt: at("2020-05-01T10:01:00Z"), EditedAt: &editedAt, ParentID: "1"},
+		{SourceID: "4", Author: alice, Content: "nested", CreatedAt: at("2020-05-01T10:03:00Z"), ParentID: "1"},
+	}
+	opt := cmp.Comparer(func(a, b time.Time) bool { return a.Equal(b) })
+	if diff := cmp.Diff(wantMsgs, msgs, opt); diff != "" {
+		t.Errorf("Messages() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// Keeps what was imported in memory, skipping existing IDs like the DB does
+type importRepository struct {
+	users    map[string]*user.User
+	messages map[string]*room.Message
+}
+
+func (r *importRepository) UpsertUser(ctx context.Context, u *user.User) (*user.User, error) {
+	if existing, ok := r.users[u.Email]; ok {
+		return existing, nil
+	}
+	u.ID = int64(len(r.users) + 1)
+	r.users[u.Email] = u
+	return u, nil
+}
+
+func (r *importRepository) GetRoomIDByName(ctx context.Context, name string) (string, error) {
+	return "", nil
+}
+
+func (r *importRepository) GetDirectID(ctx context.Context, memberIDs []string) (string, error) {
+	return "", nil
+}
+
+func (r *importRepository) CreateMessages(ctx context.Context, msgs []*room.Message) (int, int, error) {
+	inserted := 0
+	for _, msg := range msgs {
+		if _, ok := r.messages[msg.ID]; !ok {
+			r.messages[msg.ID] = msg
+			inserted++
+		}
+	}
+	return inserted, 0, nil
+}
+
+func (r *importRepository) UpdateThreads(ctx context.Context, roomID string) error {
+	return nil
+}
+
+type importRoomRepository struct {
+	room.Repository
+	saved map[string]*room.Room
+}
+
+func (r *importRoomRepository) SaveRoom(ctx context.Context, rm *room.Room) error {
+	r.saved[rm.ID] = rm
+	return nil
+}
+
+func TestImporterImport(t *testing.T) {
+	repo := &importRepository{users: make(map[string]*user.User), messages: make(map[string]*room.Message)}
+	rooms := &importRoomRepository{saved: make(map[string]*room.Room)}
+
+	name := writeSlackExport(t, slackExport)
+	for run := 1; run <= 2; run++ {
+		src, err := importer.OpenSlack(name)
+		if err != nil {
+			t.Fatalf("Failed to open export: %s", err)
+		}
+
+		stats, err := importer.New(repo, rooms, config.New()).Import(context.Background(), src)
+		src.Close()
+		if err != nil {
+			t.Fatalf("Import #%d failed: %s", run, err)
+		}
+
+		want := &importer.Stats{Users: 2, Rooms: 2, Messages: 4}
+		if run == 2 {
+			want.Messages = 0
+		}
+		if diff := cmp.Diff(want, stats); diff != "" {
+			t.Errorf("Import #%d stats mismatch (-want +got):\n%s", run, diff)
+		}
+	}
+
+	if len(repo.users) != 2 || repo.users["alice@example.com"] == nil || repo.users["slack-u2@import.invalid"] == nil {
+		t.Errorf("Expected alice by email and a placeholder for bob, got %v", repo.users)
+	}
+	if len(rooms.saved) != 2 {
+		t.Errorf("Expected 2 rooms, got %d", len(rooms.saved))
+	}
+
+	var parent, reply *room.Message
+	for _, msg := range repo.messages {
+		switch msg.Content {
+		case "hi <3 @room see docs (https://example.com)":
+			parent = msg
+		case "thanks @Alice":
+			reply = msg
+		}
+	}
+	if parent == nil || reply == nil || reply.ParentID != parent.ID {
+		t.Fatalf("Expected the reply to be in the parent's thread, got %v and %v", parent, reply)
+	}
+	if diff := cmp.Diff([]room.Reaction{{Emoji: "👋", UserIDs: []string{"2"}}, {Emoji: "👍🏻", UserIDs: []string{"1"}}}, parent.Reactions); diff != "" {
+		t.Errorf("Reactions mismatch (-want +got):\n%s", diff)
+	}
+	if !parent.CreatedAt.Equal(time.Unix(1500100000, 100000)) {
+		t.Errorf("Expected the original timestamp, got %s", parent.CreatedAt)
+	}
+}
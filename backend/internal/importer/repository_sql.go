@@ -0,0 +1,136 @@
+package importer
+
+import (
+	"gochatv1/internal/room"
+	"gochatv1/internal/user"
+
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type repository struct {
+	db DBTx
+}
+
+func NewRepository(db DBTx) Repository {
+	return &repository{db: db}
+}
+
+// Returns the existing user when the email is taken, so re-running an import maps to the same users.
+func (r *repository) UpsertUser(ctx context.Context, u *user.User) (*user.User, error) {
+	query := `INSERT INTO users(username, email, password) VALUES ($1, $2, $3)
+		ON CONFLICT (email) DO UPDATE SET email = EXCLUDED.email
+		RETURNING id, username, email`
+	res := &user.User{}
+	err := r.db.QueryRowContext(ctx, query, u.Username, u.Email, u.Password).Scan(&res.ID, &res.Username, &res.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Empty when no public room has the name.
+func (r *repository) GetRoomIDByName(ctx context.Context, name string) (string, error) {
+	return r.getRoomID(ctx, "SELECT id FROM rooms WHERE kind = 'room' AND name = $1 ORDER BY id LIMIT 1", name)
+}
+
+// Member IDs must be sorted, as they are when rooms are saved.
+func (r *repository) GetDirectID(ctx context.Context, memberIDs []string) (string, error) {
+	return r.getRoomID(ctx, "SELECT id FROM rooms WHERE kind = 'direct' AND member_ids = $1 ORDER BY id LIMIT 1", pq.Array(memberIDs))
+}
+
+func (r *repository) getRoomID(ctx context.Context, query string, arg interface{}) (string, error) {
+	var id string
+	err := r.db.QueryRowContext(ctx, query, arg).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// Inserts the messages and their reactions, skipping those already imported.
+// Returns how many of each were inserted.
+func (r *repository) CreateMessages(ctx context.Context, msgs []*room.Message) (int, int, error) {
+	var ids, roomIDs, userIDs, usernames, contents, createdAts, editedAts, parentIDs []string
+	var reactionMessageIDs, reactionUserIDs, reactionEmojis []string
+	for _, msg := range msgs {
+		editedAt := ""
+		if msg.EditedAt != nil {
+			editedAt = msg.EditedAt.Format(time.RFC3339Nano)
+		}
+		ids = append(ids, msg.ID)
+		roomIDs = append(roomIDs, msg.RoomID)
+		userIDs = append(userIDs, msg.UserID)
+		usernames = append(usernames, msg.Username)
+		contents = append(contents, msg.Content)
+		createdAts = append(createdAts, msg.CreatedAt.Format(time.RFC3339Nano))
+		editedAts = append(editedAts, editedAt)
+		parentIDs = append(parentIDs, msg.ParentID)
+
+		for _, reaction := range msg.Reactions {
+			for _, userID := range reaction.UserIDs {
+				reactionMessageIDs = append(reactionMessageIDs, msg.ID)
+				reactionUserIDs = append(reactionUserIDs, userID)
+				reactionEmojis = append(reactionEmojis, reaction.Emoji)
+			}
+		}
+	}
+
+	// Parents are inserted along with or before their replies, the FK is checked at the end of the statement
+	query := `INSERT INTO messages(id, room_id, user_id, username, content, created_at, edited_at, parent_id)
+		SELECT id, room_id, user_id, username, content, created_at::timestamptz, NULLIF(edited_at, '')::timestamptz, NULLIF(parent_id, '')
+		FROM unnest($1::varchar[], $2::varchar[], $3::varchar[], $4::varchar[], $5::text[], $6::varchar[], $7::varchar[], $8::varchar[])
+			AS m(id, room_id, user_id, username, content, created_at, edited_at, parent_id)
+		ON CONFLICT (id) DO NOTHING`
+	res, err := r.db.ExecContext(ctx, query, pq.Array(ids), pq.Array(roomIDs), pq.Array(userIDs), pq.Array(usernames),
+		pq.Array(contents), pq.Array(createdAts), pq.Array(editedAts), pq.Array(parentIDs))
+	if err != nil {
+		return 0, 0, err
+	}
+	messages, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	query = `INSERT INTO reactions(message_id, user_id, emoji)
+		SELECT * FROM unnest($1::varchar[], $2::varchar[], $3::varchar[])
+		ON CONFLICT DO NOTHING`
+	res, err = r.db.ExecContext(ctx, query, pq.Array(reactionMessageIDs), pq.Array(reactionUserIDs), pq.Array(reactionEmojis))
+	if err != nil {
+		return 0, 0, err
+	}
+	reactions, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(messages), int(reactions), nil
+}
+
+// Recomputes reply counts of the room's threads and subscribes their participants,
+// as posting the replies one by one would have.
+func (r *repository) UpdateThreads(ctx context.Context, roomID string) error {
+	query := `UPDATE messages p SET reply_count = t.reply_count, last_reply_at = t.last_reply_at
+		FROM (
+			SELECT parent_id, count(*) AS reply_count, max(created_at) AS last_reply_at FROM messages
+			WHERE room_id = $1 AND parent_id IS NOT NULL GROUP BY parent_id
+		) t
+		WHERE p.id = t.parent_id`
+	_, err := r.db.ExecContext(ctx, query, roomID)
+	if err != nil {
+		return err
+	}
+
+	query = `INSERT INTO thread_subscriptions(message_id, user_id)
+		SELECT parent_id, user_id FROM messages WHERE room_id = $1 AND parent_id IS NOT NULL
+		UNION SELECT id, user_id FROM messages WHERE room_id = $1 AND reply_count > 0
+		ON CONFLICT DO NOTHING`
+	_, err = r.db.ExecContext(ctx, query, roomID)
+	return err
+}
@@ -0,0 +1,317 @@
+package importer
+
+import (
+	"gochatv1/internal/room"
+
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type slackUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Profile struct {
+		DisplayName string `json:"display_name"`
+		Email       string `json:"email"`
+	} `json:"profile"`
+}
+
+type slackChannel struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Created int64    `json:"created"`
+	Members []string `json:"members"`
+}
+
+type slackMessage struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	Edited   *struct {
+		TS string `json:"ts"`
+	} `json:"edited"`
+	Reactions []struct {
+		Name  string   `json:"name"`
+		Users []string `json:"users"`
+	} `json:"reactions"`
+}
+
+// Regular messages, other subtypes are joins, topic changes and such
+var slackSubtypes = map[string]bool{
+	"":                 true,
+	"bot_message":      true,
+	"me_message":       true,
+	"file_share":       true,
+	"thread_broadcast": true,
+}
+
+// Links, mentions and special commands are written as <target|label>
+var slackLinkPattern = regexp.MustCompile(`<([^<>|]*)(?:\|([^<>]*))?>`)
+
+// Reads a workspace export as downloaded from Slack's admin pages.
+type slackSource struct {
+	zip     *zip.ReadCloser
+	users   map[string]*User
+	folders map[string]string
+	days    map[string][]*zip.File
+}
+
+func OpenSlack(name string) (Source, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &slackSource{
+		zip:     r,
+		users:   make(map[string]*User),
+		folders: make(map[string]string),
+		days:    make(map[string][]*zip.File),
+	}
+	for _, f := range r.File {
+		dir, file := path.Split(f.Name)
+		if dir != "" && path.Ext(file) == ".json" {
+			dir = strings.TrimSuffix(dir, "/")
+			s.days[dir] = append(s.days[dir], f)
+		}
+	}
+	for _, files := range s.days {
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	}
+
+	var users []slackUser
+	if err := s.readJSON("users.json", &users); err != nil {
+		r.Close()
+		return nil, err
+	}
+	for _, u := range users {
+		name := u.Profile.DisplayName
+		if name == "" {
+			name = u.Name
+		}
+		s.users[u.ID] = &User{SourceID: u.ID, Name: name, Email: u.Profile.Email}
+	}
+
+	return s, nil
+}
+
+func (s *slackSource) Name() string {
+	return "slack"
+}
+
+func (s *slackSource) Close() error {
+	return s.zip.Close()
+}
+
+// Public channels become rooms, private channels and multi-person DMs groups.
+func (s *slackSource) Channels() ([]*Channel, error) {
+	kinds := []struct {
+		file string
+		kind string
+	}{
+		{"channels.json", room.KindRoom},
+		{"groups.json", room.KindGroup},
+		{"mpims.json", room.KindGroup},
+		{"dms.json", room.KindDirect},
+	}
+
+	channels := make([]*Channel, 0)
+	for _, k := range kinds {
+		var list []slackChannel
+		err := s.readJSON(k.file, &list)
+		if errors.Is(err, errNotInExport) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range list {
+			channel := &Channel{
+				SourceID:  c.ID,
+				Name:      c.Name,
+				Kind:      k.kind,
+				CreatedAt: time.Unix(c.Created, 0),
+			}
+			if k.kind != room.KindRoom {
+				for _, id := range c.Members {
+					channel.Members = append(channel.Members, s.user(id))
+				}
+			}
+			// DMs have no name, their folder is named after the ID
+			s.folders[c.ID] = c.Name
+			if k.kind == room.KindDirect || c.Name == "" {
+				s.folders[c.ID] = c.ID
+			}
+			channels = append(channels, channel)
+		}
+	}
+
+	return channels, nil
+}
+
+// Day files are read in order, each one sorted by time.
+func (s *slackSource) Messages(channel *Channel, fn func(*Message) error) error {
+	for _, f := range s.days[s.folders[channel.SourceID]] {
+		var day []slackMessage
+		if err := readZipJSON(f, &day); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+
+		msgs := make([]*Message, 0, len(day))
+		for _, m := range day {
+			if m.Type != "message" || !slackSubtypes[m.Subtype] || m.Text == "" {
+				continue
+			}
+
+			msg, err := s.message(&m)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			msgs = append(msgs, msg)
+		}
+		sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].CreatedAt.Before(msgs[j].CreatedAt) })
+
+		for _, msg := range msgs {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *slackSource) message(m *slackMessage) (*Message, error) {
+	createdAt, err := parseSlackTS(m.TS)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		SourceID:  m.TS,
+		Author:    s.user(m.User),
+		Content:   s.text(m.Text),
+		CreatedAt: createdAt,
+	}
+	if m.User == "" {
+		name := m.Username
+		if name == "" {
+			name = "bot"
+		}
+		msg.Author = &User{SourceID: m.BotID, Name: name}
+	}
+	if m.ThreadTS != "" && m.ThreadTS != m.TS {
+		msg.ParentID = m.ThreadTS
+	}
+	if m.Edited != nil {
+		if editedAt, err := parseSlackTS(m.Edited.TS); err == nil {
+			msg.EditedAt = &editedAt
+		}
+	}
+	for _, r := range m.Reactions {
+		emoji, ok := slackReaction(r.Name)
+		if !ok {
+			continue
+		}
+		reaction := Reaction{Emoji: emoji}
+		for _, id := range r.Users {
+			reaction.Users = append(reaction.Users, s.user(id))
+		}
+		msg.Reactions = append(msg.Reactions, reaction)
+	}
+
+	return msg, nil
+}
+
+// Users missing from users.json (e.g. from other workspaces) are only known by ID.
+func (s *slackSource) user(id string) *User {
+	if u, ok := s.users[id]; ok {
+		return u
+	}
+
+	u := &User{SourceID: id, Name: id}
+	s.users[id] = u
+	return u
+}
+
+// Turns Slack markup into plain text, @here and @channel become @room mentions.
+func (s *slackSource) text(text string) string {
+	text = slackLinkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		parts := slackLinkPattern.FindStringSubmatch(link)
+		target, label := parts[1], parts[2]
+		switch {
+		case strings.HasPrefix(target, "@"):
+			return "@" + s.user(target[1:]).Name
+		case strings.HasPrefix(target, "#"):
+			return "#" + label
+		case target == "!here" || target == "!channel" || target == "!everyone":
+			return "@room"
+		case strings.HasPrefix(target, "!"):
+			return label
+		case label != "" && label != target:
+			return label + " (" + target + ")"
+		}
+		return target
+	})
+
+	return html.UnescapeString(text)
+}
+
+var errNotInExport = errors.New("File is not in the export")
+
+func (s *slackSource) readJSON(name string, v interface{}) error {
+	for _, f := range s.zip.File {
+		if f.Name == name {
+			if err := readZipJSON(f, v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", name, errNotInExport)
+}
+
+func readZipJSON(f *zip.File, v interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return json.NewDecoder(r).Decode(v)
+}
+
+// Timestamps are seconds with microseconds after the dot, e.g. "1500000000.000100"
+func parseSlackTS(ts string) (time.Time, error) {
+	sec, usec, _ := strings.Cut(ts, ".")
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid timestamp %q", ts)
+	}
+
+	var us int64
+	if usec != "" {
+		us, err = strconv.ParseInt((usec + "000000")[:6], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid timestamp %q", ts)
+		}
+	}
+
+	return time.Unix(s, us*int64(time.Microsecond)), nil
+}
@@ -0,0 +1,168 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// Sends plain text emails
+type Mailer interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// Folds a header value into a single line
+var headerBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// Authenticates only when user is set.
+func NewSMTPMailer(addr string, from string, user string, password string) Mailer {
+	m := &smtpMailer{addr: addr, from: from}
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	return m
+}
+
+// Line breaks would end the header early, names in the subject could add
+// headers of their own. The subject is encoded when it is not plain ASCII.
+func (m *smtpMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("email address must not contain line breaks")
+	}
+	subject = mime.QEncoding.Encode("utf-8", headerBreaks.Replace(subject))
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s", m.from, to, subject, body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+type emailChannel struct {
+	mailer Mailer
+}
+
+func NewEmailChannel(mailer Mailer) Channel {
+	return &emailChannel{mailer: mailer}
+}
+
+func (c *emailChannel) Name() string {
+	return ChannelEmail
+}
+
+func (c *emailChannel) Send(ctx context.Context, settings *Settings, notifications []*Notification) error {
+	if settings.Email == "" {
+		return nil
+	}
+
+	subject := notifications[0].Title
+	if len(notifications) > 1 {
+		subject = fmt.Sprintf("You have %d new notifications", len(notifications))
+	}
+
+	var body strings.Builder
+	for _, n := range notifications {
+		fmt.Fprintf(&body, "%s\n%s\n\n", n.Title, n.Body)
+	}
+
+	return c.mailer.Send(ctx, settings.Email, subject, body.String())
+}
+
+type webhookChannel struct {
+	client *http.Client
+}
+
+func NewWebhookChannel() Channel {
+	return &webhookChannel{client: newPublicClient()}
+}
+
+func (c *webhookChannel) Name() string {
+	return ChannelWebhook
+}
+
+type webhookPayload struct {
+	UserID        string          `json:"userId"`
+	Notifications []*Notification `json:"notifications"`
+}
+
+// Posts the batch as JSON to the URL configured by the user.
+func (c *webhookChannel) Send(ctx context.Context, settings *Settings, notifications []*Notification) error {
+	if settings.WebhookURL == "" {
+		return nil
+	}
+	// Settings saved before URLs were checked may still hold any URL
+	if err := checkPublicURL(settings.WebhookURL); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(webhookPayload{UserID: settings.UserID, Notifications: notifications})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, settings.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+// Keeps delivered notifications in memory and logs them, for development and tests.
+type LocalChannel struct {
+	mu   sync.Mutex
+	sent map[string][]*Notification
+}
+
+func NewLocalChannel() *LocalChannel {
+	return &LocalChannel{sent: make(map[string][]*Notification)}
+}
+
+func (c *LocalChannel) Name() string {
+	return ChannelLocal
+}
+
+func (c *LocalChannel) Send(ctx context.Context, settings *Settings, notifications []*Notification) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, n := range notifications {
+		log.Printf("notification for user %s: %s", settings.UserID, n.Title)
+	}
+	c.sent[settings.UserID] = append(c.sent[settings.UserID], notifications...)
+
+	return nil
+}
+
+// Returns what was delivered to the user so far.
+func (c *LocalChannel) Sent(userID string) []*Notification {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*Notification(nil), c.sent[userID]...)
+}
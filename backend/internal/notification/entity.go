@@ -0,0 +1,137 @@
+package notification
+
+import (
+	"gochatv1/config"
+
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// What the notification is about
+const (
+	KindMention = "mention" // the user was mentioned
+	KindDirect  = "direct"  // message in a direct room of the user
+	KindMessage = "message" // message in a group the user is a member of
+)
+
+// How much a user wants to be notified about
+const (
+	LevelAll      = "all"
+	LevelMentions = "mentions" // mentions and direct messages only
+	LevelNone     = "none"
+)
+
+// Names of the delivery channels users can choose from
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelPush    = "push"
+	ChannelLocal   = "local"
+)
+
+type Notification struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	UserID    string    `json:"userId"`
+	RoomID    string    `json:"roomId"`
+	MessageID string    `json:"messageId"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Notification preferences of a user. Users without stored settings get all
+// notifications by email and push.
+type Settings struct {
+	UserID     string            `json:"-"`
+	Email      string            `json:"-"`
+	Level      string            `json:"level"      validate:"required,oneof=all mentions none"`
+	Rooms      map[string]string `json:"rooms"      validate:"dive,oneof=all mentions none"` // levels overriding Level per room
+	QuietStart string            `json:"quietStart" validate:"required_with=QuietEnd,omitempty,datetime=15:04"`
+	QuietEnd   string            `json:"quietEnd"   validate:"required_with=QuietStart,omitempty,datetime=15:04"`
+	TimeZone   string            `json:"timeZone"   validate:"omitempty,timezone"` // quiet hours are in this zone, UTC if empty
+	Channels   []string          `json:"channels"   validate:"dive,oneof=email webhook push local"`
+	WebhookURL string            `json:"webhookUrl" validate:"omitempty,url"`
+}
+
+// Delivers a batch of notifications to a user, batches of more than one
+// notification are sent as a digest.
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, settings *Settings, notifications []*Notification) error
+}
+
+type Service interface {
+	Notify(ctx context.Context, notifications ...*Notification) error
+	GetSettings(ctx context.Context, req *GetSettingsReq) (*Settings, error)
+	UpdateSettings(ctx context.Context, req *UpdateSettingsReq) (*Settings, error)
+	GetVAPIDPublicKey(ctx context.Context) (string, error)
+	CreatePushSubscription(ctx context.Context, req *CreatePushSubscriptionReq) error
+	DeletePushSubscription(ctx context.Context, req *DeletePushSubscriptionReq) error
+}
+
+type Repository interface {
+	GetSettings(ctx context.Context, userID string) (*Settings, error)
+	GetSettingsByUsers(ctx context.Context, userIDs []string) (map[string]*Settings, error)
+	SaveSettings(ctx context.Context, settings *Settings) error
+	GetVAPIDKeys(ctx context.Context) (*VAPIDKeys, error)
+	CreateVAPIDKeys(ctx context.Context, keys *VAPIDKeys) (*VAPIDKeys, error)
+	CreatePushSubscription(ctx context.Context, sub *PushSubscription) error
+	DeletePushSubscription(ctx context.Context, userID string, endpoint string) error
+	GetPushSubscriptions(ctx context.Context, userID string) ([]*PushSubscription, error)
+}
+
+func Init(cfg *config.Config, val *validator.Validate, db DBTx) (*Handler, Service) {
+	channels := []Channel{NewWebhookChannel()}
+	if cfg.SMTPAddr != "" {
+		channels = append(channels, NewEmailChannel(NewSMTPMailer(cfg.SMTPAddr, cfg.SMTPFrom, cfg.SMTPUser, cfg.SMTPPassword)))
+	}
+	if cfg.NotifyLocal {
+		channels = append(channels, NewLocalChannel())
+	}
+
+	notificationRep := NewRepository(db)
+	keys, err := loadVAPIDKeys(cfg, notificationRep)
+	if err == nil {
+		var push Channel
+		push, err = NewPushChannel(notificationRep, keys, cfg.VAPIDSubject)
+		channels = append(channels, push)
+	}
+	if err != nil {
+		log.Printf("error: push notifications disabled: %v", err)
+	}
+
+	notificationSvc := newService(notificationRep, cfg, val, channels...)
+	if err == nil {
+		notificationSvc.vapidPublicKey = keys.PublicKey
+	}
+	go notificationSvc.run()
+	notificationHdl := NewHandler(notificationSvc)
+	return notificationHdl, notificationSvc
+}
+
+// Keys come from the config or, when not configured, from the DB where the
+// first instance to start stores a generated pair.
+func loadVAPIDKeys(cfg *config.Config, repo Repository) (*VAPIDKeys, error) {
+	if cfg.VAPIDPublicKey != "" && cfg.VAPIDPrivateKey != "" {
+		return &VAPIDKeys{PublicKey: cfg.VAPIDPublicKey, PrivateKey: cfg.VAPIDPrivateKey}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DBTimeout)
+	defer cancel()
+
+	keys, err := repo.GetVAPIDKeys(ctx)
+	if err != nil || keys != nil {
+		return keys, err
+	}
+
+	keys, err = GenerateVAPIDKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.CreateVAPIDKeys(ctx, keys)
+}
@@ -0,0 +1,9 @@
+package notification
+
+import "testing"
+
+// Lets the test reach servers on loopback over plain http.
+func AllowPrivateHosts(t testing.TB) {
+	allowPrivate.Store(true)
+	t.Cleanup(func() { allowPrivate.Store(false) })
+}
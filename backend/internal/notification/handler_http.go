@@ -0,0 +1,92 @@
+package notification
+
+import (
+	"gochatv1/internal/user"
+
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	service Service
+}
+
+func NewHandler(svc Service) *Handler {
+	return &Handler{
+		service: svc,
+	}
+}
+
+func (h *Handler) GetSettings(c *gin.Context) {
+	req := GetSettingsReq{UserID: c.GetString(user.ContextUserID)}
+
+	res, err := h.service.GetSettings(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) UpdateSettings(c *gin.Context) {
+	var req UpdateSettingsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserID = c.GetString(user.ContextUserID)
+
+	res, err := h.service.UpdateSettings(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetVAPIDPublicKey(c *gin.Context) {
+	key, err := h.service.GetVAPIDPublicKey(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": key})
+}
+
+func (h *Handler) CreatePushSubscription(c *gin.Context) {
+	var req CreatePushSubscriptionReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserID = c.GetString(user.ContextUserID)
+
+	err := h.service.CreatePushSubscription(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+func (h *Handler) DeletePushSubscription(c *gin.Context) {
+	var req DeletePushSubscriptionReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserID = c.GetString(user.ContextUserID)
+
+	err := h.service.DeletePushSubscription(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
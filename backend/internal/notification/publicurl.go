@@ -0,0 +1,111 @@
+package notification
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// URLs chosen by users, webhooks and push endpoints, are only reached over
+// https on public addresses, so they can't be aimed at the server's own network.
+var errNotPublic = errors.New("URL must use https and a public host")
+
+// Lifts the restriction for tests, which serve on loopback over http
+var allowPrivate atomic.Bool
+
+// Reserved ranges not covered by the net.IP checks
+var reservedNets = func() []*net.IPNet {
+	nets := make([]*net.IPNet, 0)
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// Loopback, private, link-local, multicast and reserved addresses are not public.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks a URL before it is stored or requested. Hostnames are checked again
+// once resolved, see newPublicClient.
+func checkPublicURL(raw string) error {
+	if allowPrivate.Load() {
+		return nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return errNotPublic
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errNotPublic
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return errNotPublic
+	}
+
+	return nil
+}
+
+// Client for URLs chosen by users. Addresses are checked when connecting,
+// after DNS resolution, so hostnames resolving to internal addresses and
+// redirects to them are refused as well.
+func newPublicClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkPublicAddress,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy's address would be checked instead of the destination
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkPublicURL(req.URL.String())
+		},
+	}
+}
+
+func checkPublicAddress(network string, address string, _ syscall.RawConn) error {
+	if allowPrivate.Load() {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Push services accept 4096 bytes, leaving room for the encryption header and padding
+	maxPushBody = 1000
+	pushTTL     = 24 * time.Hour
+	// Record size announced in the aes128gcm header, the payload always fits in one record
+	pushRecordSize = 4096
+)
+
+// Application server keys identifying us to push services (RFC 8292), both
+// base64url encoded: the uncompressed P-256 public key and the raw private scalar.
+type VAPIDKeys struct {
+	PublicKey  string
+	PrivateKey string
+}
+
+func GenerateVAPIDKeys() (*VAPIDKeys, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VAPIDKeys{
+		PublicKey:  base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		PrivateKey: base64.RawURLEncoding.EncodeToString(key.Bytes()),
+	}, nil
+}
+
+// Registration of a browser, as returned by PushSubscription.toJSON()
+type PushSubscription struct {
+	UserID   string `json:"-"        validate:"required"`
+	Endpoint string `json:"endpoint" validate:"required,url"`
+	Keys     struct {
+		P256dh string `json:"p256dh" validate:"required,base64rawurl"`
+		Auth   string `json:"auth"   validate:"required,base64rawurl"`
+	} `json:"keys"`
+}
+
+type pushChannel struct {
+	repository Repository
+	client     *http.Client
+	subject    string
+	publicKey  string
+	privateKey *ecdsa.PrivateKey
+}
+
+// Subject is a mailto: or https: contact for push services.
+func NewPushChannel(repo Repository, keys *VAPIDKeys, subject string) (Channel, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(keys.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Uncompressed point: 0x04 || X || Y
+	point := key.PublicKey().Bytes()
+	privateKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(point[1:33]),
+			Y:     new(big.Int).SetBytes(point[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+
+	return &pushChannel{
+		repository: repo,
+		client:     newPublicClient(),
+		subject:    subject,
+		publicKey:  base64.RawURLEncoding.EncodeToString(point),
+		privateKey: privateKey,
+	}, nil
+}
+
+func (c *pushChannel) Name() string {
+	return ChannelPush
+}
+
+type pushPayload struct {
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	RoomID    string `json:"roomId"`
+	MessageID string `json:"messageId"`
+	Count     int    `json:"count"`
+}
+
+// Pushes direct messages and mentions to every browser of the user, other
+// notifications are left to the rest of the channels.
+func (c *pushChannel) Send(ctx context.Context, settings *Settings, notifications []*Notification) error {
+	urgent := make([]*Notification, 0, len(notifications))
+	for _, n := range notifications {
+		if n.Kind == KindMention || n.Kind == KindDirect {
+			urgent = append(urgent, n)
+		}
+	}
+	if len(urgent) == 0 {
+		return nil
+	}
+
+	subscriptions, err := c.repository.GetPushSubscriptions(ctx, settings.UserID)
+	if err != nil {
+		return err
+	}
+
+	last := urgent[len(urgent)-1]
+	payload := pushPayload{
+		Title:     last.Title,
+		Body:      truncate(last.Body, maxPushBody),
+		RoomID:    last.RoomID,
+		MessageID: last.MessageID,
+		Count:     len(urgent),
+	}
+	if len(urgent) > 1 {
+		payload.Title = fmt.Sprintf("You have %d new notifications", len(urgent))
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, sub := range subscriptions {
+		if err := c.push(ctx, sub, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Sends one encrypted message, subscriptions the push service doesn't know
+// anymore are removed.
+func (c *pushChannel) push(ctx context.Context, sub *PushSubscription, data []byte) error {
+	// Subscriptions stored before endpoints were checked may point anywhere
+	if err := checkPublicURL(sub.Endpoint); err != nil {
+		return err
+	}
+
+	body, err := encryptPush(sub, data)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := c.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(pushTTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return c.repository.DeletePushSubscription(ctx, sub.UserID, sub.Endpoint)
+	case res.StatusCode < 200 || res.StatusCode >= 300:
+		return fmt.Errorf("push service responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+// VAPID header with a token for the origin of the push service (RFC 8292).
+func (c *pushChannel) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{u.Scheme + "://" + u.Host},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(12 * time.Hour)),
+		Subject:   c.subject,
+	})
+	signed, err := token.SignedString(c.privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("vapid t=%s, k=%s", signed, c.publicKey), nil
+}
+
+// Encrypts the payload for the subscription as a single aes128gcm record (RFC 8291).
+func encryptPush(sub *PushSubscription, plaintext []byte) ([]byte, error) {
+	uaPublicRaw, err := base64.RawURLEncoding.DecodeString(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicRaw)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublicRaw...), asPublic...)
+	ikm, err := hkdfExpand(hkdf.Extract(sha256.New, sharedSecret, authSecret), keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek, err := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt || record size || key id length || key id (our public key)
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, pushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// 0x02 marks the last record
+	record := append(append([]byte(nil), plaintext...), 0x02)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+func hkdfExpand(prk []byte, info []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+	_, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out)
+	return out, err
+}
+
+// Cuts the text to at most n bytes without splitting a character.
+func truncate(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+
+	text = text[:n]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text + "…"
+}
@@ -0,0 +1,196 @@
+package notification_test
+
+import (
+	"gochatv1/config"
+	"gochatv1/internal/notification"
+
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Browser side of a push subscription which can decrypt what it receives.
+type testBrowser struct {
+	key    *ecdh.PrivateKey
+	secret []byte
+}
+
+func newTestBrowser(t *testing.T) *testBrowser {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	secret := make([]byte, 16)
+	_, _ = rand.Read(secret)
+
+	return &testBrowser{key: key, secret: secret}
+}
+
+func (b *testBrowser) subscription(userID string, endpoint string) *notification.PushSubscription {
+	sub := &notification.PushSubscription{UserID: userID, Endpoint: endpoint}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(b.key.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(b.secret)
+	return sub
+}
+
+// Decrypts a single aes128gcm record as described in RFC 8291.
+func (b *testBrowser) decrypt(t *testing.T, body []byte) []byte {
+	salt, keyID := body[:16], body[21:21+int(body[20])]
+	ciphertext := body[21+len(keyID):]
+
+	asPublic, err := ecdh.P256().NewPublicKey(keyID)
+	if err != nil {
+		t.Fatalf("Invalid key id: %s", err)
+	}
+	shared, err := b.key.ECDH(asPublic)
+	if err != nil {
+		t.Fatalf("Failed to derive secret: %s", err)
+	}
+
+	expand := func(prk []byte, info string, n int) []byte {
+		out := make([]byte, n)
+		_, _ = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), out)
+		return out
+	}
+	keyInfo := "WebPush: info\x00" + string(b.key.PublicKey().Bytes()) + string(keyID)
+	ikm := expand(hkdf.Extract(sha256.New, shared, b.secret), keyInfo, 32)
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+
+	block, _ := aes.NewCipher(expand(prk, "Content-Encoding: aes128gcm\x00", 16))
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, expand(prk, "Content-Encoding: nonce\x00", 12), ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %s", err)
+	}
+
+	return bytes.TrimSuffix(plaintext, []byte{0x02})
+}
+
+func TestPushChannel(t *testing.T) {
+	keys, err := notification.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("Failed to generate VAPID keys: %s", err)
+	}
+
+	notification.AllowPrivateHosts(t)
+	received := make(chan []byte, 1)
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "vapid t=") || r.Header.Get("Content-Encoding") != "aes128gcm" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushService.Close()
+
+	browser := newTestBrowser(t)
+	repo := &testRepository{subscriptions: []*notification.PushSubscription{
+		browser.subscription("1", pushService.URL+"/active"),
+		browser.subscription("1", pushService.URL+"/gone"),
+	}}
+	push, err := notification.NewPushChannel(repo, keys, "mailto:admin@localhost")
+	if err != nil {
+		t.Fatalf("Failed to create push channel: %s", err)
+	}
+
+	err = push.Send(context.Background(), &notification.Settings{UserID: "1"}, []*notification.Notification{
+		{Kind: notification.KindMessage, Title: "bob in team", Body: "lunch?"},
+		{Kind: notification.KindMention, Title: "bob mentioned you in general", Body: "hi @alice", RoomID: "2"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to push: %s", err)
+	}
+
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(browser.decrypt(t, <-received), &payload); err != nil {
+		t.Fatalf("Failed to parse payload: %s", err)
+	}
+	// Group messages are not pushed
+	if payload["title"] != "bob mentioned you in general" || payload["body"] != "hi @alice" || payload["count"] != 1.0 {
+		t.Errorf("got %v, want the mention", payload)
+	}
+
+	if len(repo.subscriptions) != 1 || !strings.HasSuffix(repo.subscriptions[0].Endpoint, "/active") {
+		t.Errorf("got %d subscriptions, want only the active one", len(repo.subscriptions))
+	}
+}
+
+func TestPushChannelPrivateEndpoint(t *testing.T) {
+	keys, err := notification.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("Failed to generate VAPID keys: %s", err)
+	}
+
+	received := make(chan struct{}, 1)
+	pushService := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushService.Close()
+
+	browser := newTestBrowser(t)
+	repo := &testRepository{}
+	notificationSvc := notification.NewService(repo, config.New(), validator.New())
+
+	tests := []struct {
+		name     string
+		endpoint string
+		wantErr  bool
+	}{
+		{"Public push service", "https://fcm.googleapis.com/fcm/send/abc", false},
+		{"Without https", "http://fcm.googleapis.com/fcm/send/abc", true},
+		{"Loopback", pushService.URL + "/abc", true},
+		{"Private network", "https://192.168.1.10/abc", true},
+		{"Link-local", "https://[fe80::1]/abc", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &notification.CreatePushSubscriptionReq{PushSubscription: *browser.subscription("1", test.endpoint)}
+			err := notificationSvc.CreatePushSubscription(context.Background(), req)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+
+	t.Run("Stored private endpoints are not pushed to", func(t *testing.T) {
+		repo.subscriptions = []*notification.PushSubscription{browser.subscription("1", pushService.URL+"/abc")}
+		push, err := notification.NewPushChannel(repo, keys, "mailto:admin@localhost")
+		if err != nil {
+			t.Fatalf("Failed to create push channel: %s", err)
+		}
+
+		err = push.Send(context.Background(), &notification.Settings{UserID: "1"}, []*notification.Notification{
+			{Kind: notification.KindDirect, Title: "bob sent you a message", Body: "ping"},
+		})
+		if err == nil {
+			t.Error("got no error, want error")
+		}
+		select {
+		case <-received:
+			t.Error("got push request, want none")
+		default:
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package notification
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+)
+
+// Makes possible to inject DB connection (in prod) or Tx transaction (in tests)
+type DBTx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+type repository struct {
+	db DBTx
+}
+
+func NewRepository(db DBTx) Repository {
+	return &repository{db: db}
+}
+
+const settingsQuery = `SELECT u.id::text, u.email, ns.user_id IS NOT NULL, coalesce(ns.level, ''), coalesce(ns.rooms, '{}'),
+		coalesce(ns.quiet_start, ''), coalesce(ns.quiet_end, ''), coalesce(ns.time_zone, ''), ns.channels, coalesce(ns.webhook_url, '')
+	FROM users u LEFT JOIN notification_settings ns ON ns.user_id = u.id::text`
+
+// Returns the defaults for users who never saved their settings.
+func (r *repository) GetSettings(ctx context.Context, userID string) (*Settings, error) {
+	row := r.db.QueryRowContext(ctx, settingsQuery+" WHERE u.id::text = $1", userID)
+	return scanSettings(row)
+}
+
+// Settings of several users at once by user ID, unknown users are left out.
+func (r *repository) GetSettingsByUsers(ctx context.Context, userIDs []string) (map[string]*Settings, error) {
+	rows, err := r.db.QueryContext(ctx, settingsQuery+" WHERE u.id::text = ANY($1)", pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]*Settings, len(userIDs))
+	for rows.Next() {
+		s, err := scanSettings(rows)
+		if err != nil {
+			return nil, err
+		}
+		settings[s.UserID] = s
+	}
+
+	return settings, rows.Err()
+}
+
+// *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSettings(row scanner) (*Settings, error) {
+	settings := &Settings{}
+	var saved bool
+	var rooms []byte
+	err := row.Scan(&settings.UserID, &settings.Email, &saved, &settings.Level, &rooms,
+		&settings.QuietStart, &settings.QuietEnd, &settings.TimeZone, pq.Array(&settings.Channels), &settings.WebhookURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if !saved {
+		settings.Level = LevelAll
+		settings.Channels = []string{ChannelEmail, ChannelPush}
+	}
+	if err := json.Unmarshal(rooms, &settings.Rooms); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (r *repository) SaveSettings(ctx context.Context, settings *Settings) error {
+	rooms, err := json.Marshal(settings.Rooms)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO notification_settings(user_id, level, rooms, quiet_start, quiet_end, time_zone, channels, webhook_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id) DO UPDATE
+		SET level = EXCLUDED.level, rooms = EXCLUDED.rooms, quiet_start = EXCLUDED.quiet_start, quiet_end = EXCLUDED.quiet_end,
+			time_zone = EXCLUDED.time_zone, channels = EXCLUDED.channels, webhook_url = EXCLUDED.webhook_url`
+	_, err = r.db.ExecContext(ctx, query, settings.UserID, settings.Level, rooms, settings.QuietStart, settings.QuietEnd,
+		settings.TimeZone, pq.Array(settings.Channels), settings.WebhookURL)
+	return err
+}
+
+// Returns nil if no keys were stored yet.
+func (r *repository) GetVAPIDKeys(ctx context.Context) (*VAPIDKeys, error) {
+	keys := &VAPIDKeys{}
+	query := "SELECT public_key, private_key FROM vapid_keys WHERE id = 1"
+	err := r.db.QueryRowContext(ctx, query).Scan(&keys.PublicKey, &keys.PrivateKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Keeps the keys stored first when several instances start at once, those are returned.
+func (r *repository) CreateVAPIDKeys(ctx context.Context, keys *VAPIDKeys) (*VAPIDKeys, error) {
+	query := "INSERT INTO vapid_keys(id, public_key, private_key) VALUES (1, $1, $2) ON CONFLICT (id) DO NOTHING"
+	_, err := r.db.ExecContext(ctx, query, keys.PublicKey, keys.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetVAPIDKeys(ctx)
+}
+
+// A browser belongs to one user at a time, the endpoint moves to whoever registered it last.
+func (r *repository) CreatePushSubscription(ctx context.Context, sub *PushSubscription) error {
+	query := `INSERT INTO push_subscriptions(endpoint, user_id, p256dh, auth) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (endpoint) DO UPDATE
+		SET user_id = EXCLUDED.user_id, p256dh = EXCLUDED.p256dh, auth = EXCLUDED.auth, created_at = now()`
+	_, err := r.db.ExecContext(ctx, query, sub.Endpoint, sub.UserID, sub.Keys.P256dh, sub.Keys.Auth)
+	return err
+}
+
+func (r *repository) DeletePushSubscription(ctx context.Context, userID string, endpoint string) error {
+	query := "DELETE FROM push_subscriptions WHERE user_id = $1 AND endpoint = $2"
+	_, err := r.db.ExecContext(ctx, query, userID, endpoint)
+	return err
+}
+
+func (r *repository) GetPushSubscriptions(ctx context.Context, userID string) ([]*PushSubscription, error) {
+	query := "SELECT endpoint, user_id, p256dh, auth FROM push_subscriptions WHERE user_id = $1"
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := make([]*PushSubscription, 0)
+	for rows.Next() {
+		sub := &PushSubscription{}
+		if err := rows.Scan(&sub.Endpoint, &sub.UserID, &sub.Keys.P256dh, &sub.Keys.Auth); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	return subscriptions, rows.Err()
+}
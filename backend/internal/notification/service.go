@@ -0,0 +1,287 @@
+package notification
+
+import (
+	"gochatv1/config"
+
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// How often batches are checked for delivery
+const batchCheckInterval = 10 * time.Second
+
+// Notifications waiting for delivery to one user
+type batch struct {
+	settings      *Settings
+	notifications []*Notification
+	since         time.Time
+}
+
+type service struct {
+	repository Repository
+	config     *config.Config
+	validate   *validator.Validate
+	channels   map[string]Channel
+	mu         sync.Mutex
+	pending    map[string]*batch
+
+	vapidPublicKey string // empty when push is disabled
+}
+
+func NewService(repo Repository, cfg *config.Config, val *validator.Validate, channels ...Channel) Service {
+	return newService(repo, cfg, val, channels...)
+}
+
+func newService(repo Repository, cfg *config.Config, val *validator.Validate, channels ...Channel) *service {
+	byName := make(map[string]Channel, len(channels))
+	for _, ch := range channels {
+		byName[ch.Name()] = ch
+	}
+
+	return &service{
+		repository: repo,
+		config:     cfg,
+		validate:   val,
+		channels:   byName,
+		pending:    make(map[string]*batch),
+	}
+}
+
+// Queues the notifications users want, their settings are looked up at once.
+// Notifications are collected for NotifyBatchWindow and held back during quiet
+// hours, whatever piled up is then delivered as one digest.
+func (s *service) Notify(ctx context.Context, notifications ...*Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	userIDs := make([]string, 0, len(notifications))
+	seen := make(map[string]bool, len(notifications))
+	for _, n := range notifications {
+		if !seen[n.UserID] {
+			seen[n.UserID] = true
+			userIDs = append(userIDs, n.UserID)
+		}
+	}
+
+	settings, err := s.repository.GetSettingsByUsers(context, userIDs)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	for _, n := range notifications {
+		userSettings, ok := settings[n.UserID]
+		if !ok || !userSettings.wants(n) {
+			continue
+		}
+
+		b, ok := s.pending[n.UserID]
+		if !ok {
+			b = &batch{since: now}
+			s.pending[n.UserID] = b
+		}
+		b.settings = userSettings
+		b.notifications = append(b.notifications, n)
+	}
+	s.mu.Unlock()
+
+	if s.config.NotifyBatchWindow == 0 {
+		s.flush(now)
+	}
+
+	return nil
+}
+
+// Delivers batches which waited long enough and are outside of quiet hours.
+func (s *service) flush(now time.Time) {
+	s.mu.Lock()
+	ready := make([]*batch, 0)
+	for userID, b := range s.pending {
+		if now.Sub(b.since) >= s.config.NotifyBatchWindow && !b.settings.quiet(now) {
+			ready = append(ready, b)
+			delete(s.pending, userID)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, b := range ready {
+		go s.deliver(b)
+	}
+}
+
+// Sends the batch through every channel the user chose. A failing channel
+// doesn't keep the others from delivering.
+func (s *service) deliver(b *batch) {
+	for _, name := range b.settings.Channels {
+		ch, ok := s.channels[name]
+		if !ok {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.NotifyTimeout)
+		err := ch.Send(ctx, b.settings, b.notifications)
+		cancel()
+		if err != nil {
+			log.Printf("error: %s notifications for user %s: %v", name, b.settings.UserID, err)
+		}
+	}
+}
+
+func (s *service) run() {
+	ticker := time.NewTicker(batchCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.flush(now)
+	}
+}
+
+// Room level overrides the default level of the user.
+func (s *Settings) wants(n *Notification) bool {
+	level := s.Level
+	if roomLevel, ok := s.Rooms[n.RoomID]; ok {
+		level = roomLevel
+	}
+
+	switch level {
+	case LevelNone:
+		return false
+	case LevelMentions:
+		return n.Kind == KindMention || n.Kind == KindDirect
+	default:
+		return true
+	}
+}
+
+// Quiet hours may span midnight, e.g. 22:00 to 07:00.
+func (s *Settings) quiet(now time.Time) bool {
+	if s.QuietStart == "" || s.QuietEnd == "" {
+		return false
+	}
+
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	local := now.In(loc).Format("15:04")
+	if s.QuietStart <= s.QuietEnd {
+		return local >= s.QuietStart && local < s.QuietEnd
+	}
+	return local >= s.QuietStart || local < s.QuietEnd
+}
+
+type GetSettingsReq struct {
+	UserID string `json:"-" validate:"required"`
+}
+
+func (s *service) GetSettings(ctx context.Context, req *GetSettingsReq) (*Settings, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	return s.repository.GetSettings(context, req.UserID)
+}
+
+type UpdateSettingsReq struct {
+	UserID string `json:"-" validate:"required"`
+	Settings
+}
+
+func (s *service) UpdateSettings(ctx context.Context, req *UpdateSettingsReq) (*Settings, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	if req.WebhookURL != "" {
+		if err := checkPublicURL(req.WebhookURL); err != nil {
+			return nil, fmt.Errorf("Webhook %w", err)
+		}
+	}
+
+	settings := req.Settings
+	settings.UserID = req.UserID
+	// Quiet hours are compared as strings, "7:00" has to become "07:00"
+	for _, t := range []*string{&settings.QuietStart, &settings.QuietEnd} {
+		if parsed, err := time.Parse("15:04", *t); err == nil {
+			*t = parsed.Format("15:04")
+		}
+	}
+	if settings.Rooms == nil {
+		settings.Rooms = map[string]string{}
+	}
+	if settings.Channels == nil {
+		settings.Channels = []string{}
+	}
+
+	err = s.repository.SaveSettings(context, &settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+func (s *service) GetVAPIDPublicKey(ctx context.Context) (string, error) {
+	if s.vapidPublicKey == "" {
+		return "", errors.New("Push notifications are not configured")
+	}
+
+	return s.vapidPublicKey, nil
+}
+
+type CreatePushSubscriptionReq struct {
+	PushSubscription
+}
+
+// Registering the same browser again replaces its keys.
+func (s *service) CreatePushSubscription(ctx context.Context, req *CreatePushSubscriptionReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+	if err := checkPublicURL(req.Endpoint); err != nil {
+		return fmt.Errorf("Push endpoint %w", err)
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	return s.repository.CreatePushSubscription(context, &req.PushSubscription)
+}
+
+type DeletePushSubscriptionReq struct {
+	UserID   string `json:"-"        validate:"required"`
+	Endpoint string `json:"endpoint" validate:"required"`
+}
+
+func (s *service) DeletePushSubscription(ctx context.Context, req *DeletePushSubscriptionReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	return s.repository.DeletePushSubscription(context, req.UserID, req.Endpoint)
+}
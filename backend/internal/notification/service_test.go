@@ -0,0 +1,431 @@
+package notification_test
+
+import (
+	"gochatv1/config"
+	"gochatv1/internal/notification"
+
+	"bufio"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Keeps settings and push subscriptions in memory, users without settings get everything locally
+type testRepository struct {
+	notification.Repository
+	settings      map[string]*notification.Settings
+	subscriptions []*notification.PushSubscription
+	lookups       int
+}
+
+func (r *testRepository) GetSettings(ctx context.Context, userID string) (*notification.Settings, error) {
+	if settings, ok := r.settings[userID]; ok {
+		return settings, nil
+	}
+	return &notification.Settings{UserID: userID, Level: notification.LevelAll, Channels: []string{notification.ChannelLocal}}, nil
+}
+
+func (r *testRepository) GetSettingsByUsers(ctx context.Context, userIDs []string) (map[string]*notification.Settings, error) {
+	r.lookups++
+	settings := make(map[string]*notification.Settings, len(userIDs))
+	for _, userID := range userIDs {
+		settings[userID], _ = r.GetSettings(ctx, userID)
+	}
+	return settings, nil
+}
+
+func (r *testRepository) SaveSettings(ctx context.Context, settings *notification.Settings) error {
+	r.settings[settings.UserID] = settings
+	return nil
+}
+
+func (r *testRepository) CreatePushSubscription(ctx context.Context, sub *notification.PushSubscription) error {
+	r.subscriptions = append(r.subscriptions, sub)
+	return nil
+}
+
+func (r *testRepository) GetPushSubscriptions(ctx context.Context, userID string) ([]*notification.PushSubscription, error) {
+	subscriptions := make([]*notification.PushSubscription, 0)
+	for _, sub := range r.subscriptions {
+		if sub.UserID == userID {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	return subscriptions, nil
+}
+
+func (r *testRepository) DeletePushSubscription(ctx context.Context, userID string, endpoint string) error {
+	kept := make([]*notification.PushSubscription, 0, len(r.subscriptions))
+	for _, sub := range r.subscriptions {
+		if sub.UserID != userID || sub.Endpoint != endpoint {
+			kept = append(kept, sub)
+		}
+	}
+	r.subscriptions = kept
+	return nil
+}
+
+// Waits for asynchronous delivery to the user.
+func waitSent(local *notification.LocalChannel, userID string, want int) []*notification.Notification {
+	deadline := time.Now().Add(time.Second)
+	if want == 0 {
+		deadline = time.Now().Add(100 * time.Millisecond)
+	}
+
+	sent := local.Sent(userID)
+	for len(sent) < want || want == 0 {
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+		sent = local.Sent(userID)
+	}
+
+	return sent
+}
+
+func TestServiceNotify(t *testing.T) {
+	cfg := config.New()
+	cfg.NotifyBatchWindow = 0
+	local := notification.NewLocalChannel()
+	now := time.Now().UTC()
+	repo := &testRepository{settings: map[string]*notification.Settings{
+		"none": {UserID: "none", Level: notification.LevelNone, Channels: []string{notification.ChannelLocal}},
+		"mentions": {
+			UserID:   "mentions",
+			Level:    notification.LevelMentions,
+			Channels: []string{notification.ChannelLocal},
+		},
+		"muted-room": {
+			UserID:   "muted-room",
+			Level:    notification.LevelAll,
+			Rooms:    map[string]string{"1": notification.LevelNone},
+			Channels: []string{notification.ChannelLocal},
+		},
+		"quiet": {
+			UserID:     "quiet",
+			Level:      notification.LevelAll,
+			QuietStart: now.Add(-time.Hour).Format("15:04"),
+			QuietEnd:   now.Add(time.Hour).Format("15:04"),
+			Channels:   []string{notification.ChannelLocal},
+		},
+	}}
+	notificationSvc := notification.NewService(repo, cfg, validator.New(), local)
+
+	tests := []struct {
+		name   string
+		userID string
+		kind   string
+		want   int
+	}{
+		{"Should deliver everything by default", "all", notification.KindMessage, 1},
+		{"Level none", "none", notification.KindMention, 0},
+		{"Should deliver mentions on mentions level", "mentions", notification.KindMention, 1},
+		{"Should deliver direct messages on mentions level", "mentions", notification.KindDirect, 2},
+		{"Group message on mentions level", "mentions", notification.KindMessage, 2},
+		{"Room level overrides default", "muted-room", notification.KindMention, 0},
+		{"Held back during quiet hours", "quiet", notification.KindMention, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &notification.Notification{ID: test.name, Kind: test.kind, UserID: test.userID, RoomID: "1"}
+			if err := notificationSvc.Notify(context.Background(), n); err != nil {
+				t.Fatalf("Failed to notify: %s", err)
+			}
+
+			if sent := waitSent(local, test.userID, test.want); len(sent) != test.want {
+				t.Errorf("got %d notifications, want %d", len(sent), test.want)
+			}
+		})
+	}
+}
+
+func TestServiceNotifyMany(t *testing.T) {
+	cfg := config.New()
+	cfg.NotifyBatchWindow = 0
+	local := notification.NewLocalChannel()
+	repo := &testRepository{settings: map[string]*notification.Settings{
+		"none": {UserID: "none", Level: notification.LevelNone, Channels: []string{notification.ChannelLocal}},
+	}}
+	notificationSvc := notification.NewService(repo, cfg, validator.New(), local)
+
+	err := notificationSvc.Notify(context.Background(),
+		&notification.Notification{ID: "1", Kind: notification.KindMessage, UserID: "alice", RoomID: "1"},
+		&notification.Notification{ID: "2", Kind: notification.KindMessage, UserID: "bob", RoomID: "1"},
+		&notification.Notification{ID: "3", Kind: notification.KindMessage, UserID: "none", RoomID: "1"},
+	)
+	if err != nil {
+		t.Fatalf("Failed to notify: %s", err)
+	}
+
+	if repo.lookups != 1 {
+		t.Errorf("got %d settings lookups, want %d", repo.lookups, 1)
+	}
+	for userID, want := range map[string]int{"alice": 1, "bob": 1, "none": 0} {
+		if sent := waitSent(local, userID, want); len(sent) != want {
+			t.Errorf("got %d notifications for %s, want %d", len(sent), userID, want)
+		}
+	}
+}
+
+func TestServiceUpdateSettings(t *testing.T) {
+	repo := &testRepository{settings: map[string]*notification.Settings{}}
+	notificationSvc := notification.NewService(repo, config.New(), validator.New())
+
+	tests := []struct {
+		name    string
+		input   *notification.UpdateSettingsReq
+		want    *notification.Settings
+		wantErr bool
+	}{
+		{
+			"Should pad quiet hours",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{
+				Level: notification.LevelMentions, QuietStart: "22:00", QuietEnd: "7:00", TimeZone: "Europe/Warsaw",
+			}},
+			&notification.Settings{
+				UserID: "1", Level: notification.LevelMentions, Rooms: map[string]string{}, Channels: []string{},
+				QuietStart: "22:00", QuietEnd: "07:00", TimeZone: "Europe/Warsaw",
+			},
+			false,
+		},
+		{
+			"Unknown level",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: "some"}},
+			nil,
+			true,
+		},
+		{
+			"Quiet hours without end",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, QuietStart: "22:00"}},
+			nil,
+			true,
+		},
+		{
+			"Webhook on a public host",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{
+				Level: notification.LevelAll, WebhookURL: "https://hooks.example.com/gochat",
+			}},
+			&notification.Settings{
+				UserID: "1", Level: notification.LevelAll, Rooms: map[string]string{}, Channels: []string{},
+				WebhookURL: "https://hooks.example.com/gochat",
+			},
+			false,
+		},
+		{
+			"Webhook without https",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, WebhookURL: "http://hooks.example.com"}},
+			nil,
+			true,
+		},
+		{
+			"Webhook on loopback",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, WebhookURL: "https://127.0.0.1:8080/"}},
+			nil,
+			true,
+		},
+		{
+			"Webhook on localhost",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, WebhookURL: "https://localhost/"}},
+			nil,
+			true,
+		},
+		{
+			"Webhook on a private network",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, WebhookURL: "https://10.1.2.3/"}},
+			nil,
+			true,
+		},
+		{
+			"Webhook on a link-local address",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, WebhookURL: "https://169.254.169.254/latest"}},
+			nil,
+			true,
+		},
+		{
+			"Webhook on IPv6 loopback",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, WebhookURL: "https://[::1]/"}},
+			nil,
+			true,
+		},
+		{
+			"Unknown channel",
+			&notification.UpdateSettingsReq{UserID: "1", Settings: notification.Settings{Level: notification.LevelAll, Channels: []string{"fax"}}},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ans, err := notificationSvc.UpdateSettings(context.Background(), test.input)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+
+			if !cmp.Equal(ans, test.want) {
+				t.Errorf("got %#v, want %#v", ans, test.want)
+			}
+		})
+	}
+}
+
+type testMailer struct {
+	to, subject, body string
+}
+
+func (m *testMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.to, m.subject, m.body = to, subject, body
+	return nil
+}
+
+func TestEmailChannelDigest(t *testing.T) {
+	mailer := &testMailer{}
+	email := notification.NewEmailChannel(mailer)
+	settings := &notification.Settings{UserID: "1", Email: "alice@example.com"}
+
+	err := email.Send(context.Background(), settings, []*notification.Notification{
+		{Title: "bob mentioned you in general", Body: "hi @alice"},
+		{Title: "bob sent you a message", Body: "ping"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send email: %s", err)
+	}
+
+	want := testMailer{
+		to:      "alice@example.com",
+		subject: "You have 2 new notifications",
+		body:    "bob mentioned you in general\nhi @alice\n\nbob sent you a message\nping\n\n",
+	}
+	if *mailer != want {
+		t.Errorf("got %#v, want %#v", *mailer, want)
+	}
+}
+
+// Accepts one email over SMTP on loopback and hands over its data.
+func serveSMTP(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "DATA":
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				fmt.Fprint(conn, "250 ok\r\n")
+			case "QUIT":
+				fmt.Fprint(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestEmailChannelHeaderInjection(t *testing.T) {
+	addr, received := serveSMTP(t)
+	email := notification.NewEmailChannel(notification.NewSMTPMailer(addr, "chat@example.com", "", ""))
+	settings := &notification.Settings{UserID: "1", Email: "alice@example.com"}
+
+	// A room named to add a header of its own
+	err := email.Send(context.Background(), settings, []*notification.Notification{
+		{Title: "bob mentioned you in général\r\nBcc: eve@example.com", Body: "hi @alice"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send email: %s", err)
+	}
+
+	var data string
+	select {
+	case data = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("got no email, want one")
+	}
+
+	header, _, _ := strings.Cut(data, "\r\n\r\n")
+	for _, line := range strings.Split(header, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("got header %q, want none", line)
+		}
+		if subject, ok := strings.CutPrefix(line, "Subject: "); ok {
+			decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+			if err != nil {
+				t.Fatalf("Failed to decode subject: %s", err)
+			}
+			if want := "bob mentioned you in général Bcc: eve@example.com"; decoded != want {
+				t.Errorf("got subject %q, want %q", decoded, want)
+			}
+			if strings.ContainsRune(subject, 'é') {
+				t.Errorf("got raw subject %q, want it encoded", subject)
+			}
+		}
+	}
+
+	t.Run("Line breaks in the address", func(t *testing.T) {
+		settings := &notification.Settings{UserID: "1", Email: "alice@example.com\r\nBcc: eve@example.com"}
+		err := email.Send(context.Background(), settings, []*notification.Notification{{Title: "hi"}})
+		if err == nil {
+			t.Error("got no error, want error")
+		}
+	})
+}
+
+func TestWebhookChannelPrivateHost(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	// Settings stored before URLs were checked are refused when sending
+	webhook := notification.NewWebhookChannel()
+	settings := &notification.Settings{UserID: "1", WebhookURL: server.URL}
+	err := webhook.Send(context.Background(), settings, []*notification.Notification{{Title: "hi"}})
+	if err == nil {
+		t.Error("got no error, want error")
+	}
+	select {
+	case <-received:
+		t.Error("got webhook request, want none")
+	default:
+	}
+}
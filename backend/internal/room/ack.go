@@ -0,0 +1,79 @@
+package room
+
+import "sync"
+
+// Client IDs each room remembers to suppress commands resent after a lost ack
+const handledCacheSize = 1024
+
+// Commands recently run, by user and client ID. The oldest entries are
+// forgotten first.
+type handledCache struct {
+	mu    sync.Mutex
+	ids   map[string]*handledCommand
+	order []string
+	next  int
+}
+
+// Outcome of a command, known once done is closed. ID is the message it
+// created or changed.
+type handledCommand struct {
+	done chan struct{}
+	id   string
+	err  error
+}
+
+func newHandledCache(size int) *handledCache {
+	return &handledCache{
+		ids:   make(map[string]*handledCommand, size),
+		order: make([]string, size),
+	}
+}
+
+// Claims the client ID for a command about to run, so a copy of it arriving
+// meanwhile waits for its outcome instead of running again. Returns false with
+// the command holding the ID if there is one already, otherwise the caller
+// must finish the returned command.
+func (c *handledCache) reserve(userID string, clientID string) (*handledCommand, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := userID + ":" + clientID
+	if cmd, ok := c.ids[key]; ok {
+		return cmd, false
+	}
+	if oldest := c.order[c.next]; oldest != "" {
+		delete(c.ids, oldest)
+	}
+	cmd := &handledCommand{done: make(chan struct{})}
+	c.ids[key] = cmd
+	c.order[c.next] = key
+	c.next = (c.next + 1) % len(c.order)
+
+	return cmd, true
+}
+
+// Records the outcome of a reserved command. A failed command gives its
+// client ID back, so the client can try again.
+func (c *handledCache) finish(userID string, clientID string, cmd *handledCommand, id string, err error) {
+	if err != nil {
+		c.mu.Lock()
+		key := userID + ":" + clientID
+		if c.ids[key] == cmd {
+			delete(c.ids, key)
+		}
+		c.mu.Unlock()
+	}
+
+	cmd.id, cmd.err = id, err
+	close(cmd.done)
+}
+
+// Tells the client its command was stored and broadcast.
+func (c *Client) ack(clientID string, id string) {
+	c.Message <- &Message{
+		Type:     MessageAck,
+		ID:       id,
+		ClientID: clientID,
+		RoomID:   c.RoomID,
+	}
+}
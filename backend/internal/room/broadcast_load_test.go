@@ -0,0 +1,184 @@
+//go:build loadtest && unix
+
+package room_test
+
+import (
+	"gochatv1/internal/room"
+
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Fans messages out to a room with many connections, by default 10k:
+//
+//	go test -tags loadtest -run TestLoadBroadcast -timeout 30m ./internal/room/
+//
+// LOAD_CLIENTS, LOAD_MESSAGES and LOAD_NUMBERED=false change the defaults.
+func TestLoadBroadcast(t *testing.T) {
+	clients := getEnvInt(t, "LOAD_CLIENTS", 10000)
+	messages := getEnvInt(t, "LOAD_MESSAGES", 20)
+	numbered := os.Getenv("LOAD_NUMBERED") != "false"
+	raiseFileLimit(t, clients)
+
+	hub := room.NewHub()
+	_, generalID, url := newTestRoomServerWith(t, hub, &testRepository{room.NewRepository(hub, nil)}, &testNotifier{})
+
+	// Users with 100 connections each keep the joins, which go to everyone, in check
+	start := time.Now()
+	var done sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		joinCounting(t, url, strconv.Itoa(i/100+1), numbered, messages, &done)
+	}
+	t.Logf("%d connections joined in %s", clients, time.Since(start))
+
+	start = time.Now()
+	broadcast(t, hub, generalID, messages, &done)
+	elapsed := time.Since(start)
+	t.Logf("%d messages reached %d connections in %s, %s per message, %.0f frames/s",
+		messages, clients, elapsed, elapsed/time.Duration(messages), float64(messages*clients)/elapsed.Seconds())
+}
+
+// Broadcasts to a room in which some connections never read, by default 20
+// next to 200 reading ones:
+//
+//	go test -tags loadtest -run TestLoadSlowConsumers ./internal/room/
+//
+// LOAD_CLIENTS, LOAD_SLOW_CLIENTS and LOAD_MESSAGES change the defaults. Each
+// message is sent once the readers got the previous one, so only the others
+// fall behind. They are disconnected, the readers don't wait for them.
+func TestLoadSlowConsumers(t *testing.T) {
+	clients := getEnvInt(t, "LOAD_CLIENTS", 200)
+	slowClients := getEnvInt(t, "LOAD_SLOW_CLIENTS", 20)
+	// Enough to get past the socket buffers, which take a few MB
+	messages := getEnvInt(t, "LOAD_MESSAGES", 2000)
+	raiseFileLimit(t, clients+slowClients)
+
+	hub := room.NewHub()
+	_, generalID, url := newTestRoomServerWith(t, hub, &testRepository{room.NewRepository(hub, nil)}, &testNotifier{})
+
+	// Small receive buffers, set before connecting so the window starts small,
+	// make the server wait for these soon
+	netDialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			ctrlErr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		},
+	}
+	dialer := &websocket.Dialer{NetDial: netDialer.Dial}
+	slow := make([]*websocket.Conn, 0, slowClients)
+	for i := 0; i < slowClients; i++ {
+		conn, _, err := dialer.Dial(url, wsHeader("slow"))
+		if err != nil {
+			t.Fatalf("Failed to join room: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		slow = append(slow, conn)
+	}
+
+	// Marked messages received by each reader
+	received := make([]atomic.Int64, clients)
+	for i := 0; i < clients; i++ {
+		conn := dialRoom(t, url, strconv.Itoa(i/100+1))
+		go func(count *atomic.Int64) {
+			marker := []byte(broadcastMarker)
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if bytes.Contains(data, marker) {
+					count.Add(1)
+				}
+			}
+		}(&received[i])
+	}
+
+	start := time.Now()
+	r := hub.Rooms[generalID]
+	content := broadcastMarker + strings.Repeat(" ", 4<<10)
+	for i := 0; i < messages; i++ {
+		r.Broadcast <- &room.Message{
+			ID:       fmt.Sprintf("%026d", i),
+			Type:     room.MessageText,
+			Content:  content,
+			RoomID:   generalID,
+			UserID:   "0",
+			Username: "bench",
+		}
+
+		// Well within the write timeout, which would end a wait for the slow ones
+		deadline := time.Now().Add(2 * time.Second)
+		for c := range received {
+			for received[c].Load() <= int64(i) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Reader %d got %d of %d messages", c, received[c].Load(), i+1)
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}
+	elapsed := time.Since(start)
+	t.Logf("%d messages of %d KiB reached %d connections next to %d slow ones in %s, %s per message",
+		messages, len(content)>>10, clients, slowClients, elapsed, elapsed/time.Duration(messages))
+
+	// What made it into the buffers is still there, then the connection ends
+	for i, conn := range slow {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := conn.NextReader()
+			if err == nil {
+				continue
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatalf("Slow connection %d is still open", i)
+			}
+			break
+		}
+	}
+}
+
+// Both ends of every connection are in this process.
+func raiseFileLimit(t *testing.T, clients int) {
+	limit := &syscall.Rlimit{}
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, limit); err != nil {
+		t.Fatalf("Failed to get file limit: %s", err)
+	}
+	if need := uint64(2*clients + 100); limit.Cur < need {
+		limit.Cur = need
+		if limit.Max < need {
+			t.Skipf("Needs %d open files, the limit is %d", need, limit.Max)
+		}
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, limit); err != nil {
+			t.Fatalf("Failed to raise file limit: %s", err)
+		}
+	}
+}
+
+func getEnvInt(t *testing.T, key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		t.Fatalf("Invalid %s: %s", key, err)
+	}
+	return n
+}
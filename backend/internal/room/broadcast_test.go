@@ -0,0 +1,210 @@
+package room_test
+
+import (
+	"gochatv1/internal/room"
+
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Content of the messages counted by the receivers
+const broadcastMarker = "broadcast-marker"
+
+// Joins the room and counts the marked messages in the background, the wait
+// group is done once want of them arrived.
+func joinCounting(tb testing.TB, url string, userID string, numbered bool, want int, done *sync.WaitGroup) {
+	query := ""
+	if !numbered {
+		query = "?seq=false"
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url+query, wsHeader(userID))
+	if err != nil {
+		tb.Fatalf("Failed to join room: %s", err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	done.Add(1)
+	go func() {
+		defer done.Done()
+
+		// Reused so the receivers don't add to the allocations measured
+		buf := &bytes.Buffer{}
+		marker := []byte(broadcastMarker)
+		for got := 0; got < want; {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+			buf.Reset()
+			if _, err := buf.ReadFrom(r); err != nil {
+				return
+			}
+			if bytes.Contains(buf.Bytes(), marker) {
+				got++
+			}
+		}
+	}()
+}
+
+// Sends count marked messages to the room and waits for every receiver to get them.
+func broadcast(tb testing.TB, hub *room.Hub, roomID string, count int, done *sync.WaitGroup) {
+	r := hub.Rooms[roomID]
+	for i := 0; i < count; i++ {
+		r.Broadcast <- &room.Message{
+			ID:       fmt.Sprintf("%026d", i),
+			Type:     room.MessageText,
+			Content:  broadcastMarker,
+			RoomID:   roomID,
+			UserID:   "0",
+			Username: "bench",
+		}
+	}
+	waitReceived(tb, done)
+}
+
+// Waits for every receiver to get the messages they count.
+func waitReceived(tb testing.TB, done *sync.WaitGroup) {
+	received := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(received)
+	}()
+	select {
+	case <-received:
+	case <-time.After(time.Minute):
+		tb.Fatal("Receivers didn't get all messages")
+	}
+}
+
+func TestHandlerUnnumbered(t *testing.T) {
+	hub := room.NewHub()
+	_, generalID, url := newTestRoomServerWith(t, hub, &testRepository{room.NewRepository(hub, nil)}, &testNotifier{})
+
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		conn, _, err := websocket.DefaultDialer.Dial(url+"?seq=false", wsHeader(strconv.Itoa(i+1)))
+		if err != nil {
+			t.Fatalf("Failed to join room: %s", err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	readUntil(t, conns[1], room.MessageJoin)
+
+	var done sync.WaitGroup
+	broadcast(t, hub, generalID, 1, &done)
+	for i, conn := range conns {
+		msg := readUntil(t, conn, room.MessageText)
+		if msg.Content != broadcastMarker || msg.Seq != 0 {
+			t.Errorf("Connection %d got %q with seq %d, want %q without seq", i, msg.Content, msg.Seq, broadcastMarker)
+		}
+	}
+}
+
+func TestHandlerSlowClient(t *testing.T) {
+	hub := room.NewHub()
+	roomSvc, generalID, url := newTestRoomServerWith(t, hub, &testRepository{room.NewRepository(hub, nil)}, &testNotifier{})
+
+	// Not read until the room gave up on it
+	stream, err := roomSvc.OpenStream(context.Background(), &room.OpenStreamReq{CallerID: "2", Username: "user2", RoomID: generalID})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %s", err)
+	}
+	defer stream.Close()
+
+	var done sync.WaitGroup
+	joinCounting(t, url, "1", true, 200, &done)
+	broadcast(t, hub, generalID, 200, &done)
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-stream.Message:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Slow client is still in the room")
+		}
+	}
+}
+
+// Time and allocations for a message to reach every connection of a room.
+// Numbered connections each get a copy of the encoded message, unnumbered
+// ones share a prepared frame.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, clients := range []int{10, 100, 1000} {
+		for _, numbered := range []bool{true, false} {
+			b.Run(fmt.Sprintf("clients=%d/numbered=%t", clients, numbered), func(b *testing.B) {
+				hub := room.NewHub()
+				_, generalID, url := newTestRoomServerWith(b, hub, &testRepository{room.NewRepository(hub, nil)}, &testNotifier{})
+
+				// Connections of one user, so there is a single join
+				var done sync.WaitGroup
+				for i := 0; i < clients; i++ {
+					joinCounting(b, url, "1", numbered, b.N, &done)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				broadcast(b, hub, generalID, b.N, &done)
+			})
+		}
+	}
+}
+
+func TestHandlerCompression(t *testing.T) {
+	long := strings.Repeat("compressible ", 100)
+
+	tests := []struct {
+		name     string
+		enabled  string
+		offered  bool
+		numbered bool
+		want     bool
+	}{
+		{"Negotiated", "true", true, true, true},
+		{"Negotiated without seq", "true", true, false, true},
+		{"Not offered", "true", false, true, false},
+		{"Disabled", "false", true, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("WS_COMPRESSION", test.enabled)
+			hub := room.NewHub()
+			_, generalID, url := newTestRoomServerWith(t, hub, &testRepository{room.NewRepository(hub, nil)}, &testNotifier{})
+
+			query := ""
+			if !test.numbered {
+				query = "?seq=false"
+			}
+			dialer := websocket.Dialer{EnableCompression: test.offered}
+			conn, res, err := dialer.Dial(url+query, wsHeader("1"))
+			if err != nil {
+				t.Fatalf("Failed to join room: %s", err)
+			}
+			defer conn.Close()
+
+			got := strings.Contains(res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+			if got != test.want {
+				t.Errorf("got compression %t, want %t", got, test.want)
+			}
+
+			// Messages below and above the threshold arrive intact either way
+			for _, content := range []string{"short", long} {
+				hub.Rooms[generalID].Broadcast <- &room.Message{Type: room.MessageText, Content: content, RoomID: generalID}
+				if msg := readUntil(t, conn, room.MessageText); msg.Content != content {
+					t.Errorf("got %q, want %q", msg.Content, content)
+				}
+			}
+		})
+	}
+}
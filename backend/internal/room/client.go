@@ -1,39 +1,133 @@
 package room
 
 import (
+	"context"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Messages a client's channel holds, a client falling further behind its room is disconnected
+const clientBufferSize = 128
+
+// A user's connection to a room, a user can have several (e.g. tabs).
+// Clients of a Session share its connection, those of streams and polls
+// have no websocket.
 type Client struct {
 	Conn     *websocket.Conn
 	Message  chan *Message
+	ConnID   string `json:"connectionId"`
 	UserID   string `json:"id"`
 	RoomID   string `json:"roomId"`
 	Username string `json:"username"`
+
+	framing framing
+	// Last accepted typing_start, only used by readMessage
+	lastTyping time.Time
+	// Connection shared with the user's other rooms, nil if the client has its own
+	session *Session
+
+	// Where a reconnecting client left off, see Room.replay
+	resumeFrom string
+	backlog    []*Message
+	resync     bool
+	// Buffered events the client missed, handed over by run on registration
+	missed chan []*Message
+
+	// Set by run while the client is sent what it missed, live messages wait
+	// in pending meanwhile. Only used by run.
+	replaying bool
+	pending   []*Message
+	overflow  bool
+	// Set by run once the client couldn't keep up, see Room.send
+	slow bool
+}
+
+// Closes the connection, the reason is shown to the client in the close frame.
+func (c *Client) close(code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	_ = c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.Conn.Close()
 }
 
 // Sends messages from the room to the websocket connection.
 func (c *Client) writeMessage() {
-	defer func() {
-		c.Conn.Close()
-	}()
+	writeMessages(c.Conn, c.framing, c.Message, nil)
+}
 
-	for {
-		message, ok := <-c.Message
-		if !ok {
-			return
+// How messages are written to a connection, settled on upgrade.
+type framing struct {
+	codec       Codec
+	numbered    bool
+	compressMin int // bytes, smaller messages are sent uncompressed
+	// A connection taking longer to take a message is closed
+	writeTimeout time.Duration
+}
+
+func (s *service) framing(conn *websocket.Conn, numbered bool) framing {
+	return framing{
+		codec:        codecFor(conn.Subprotocol()),
+		numbered:     numbered,
+		compressMin:  s.config.WSCompressionThreshold,
+		writeTimeout: s.config.WSWriteTimeout,
+	}
+}
+
+// Writes messages to the connection until the channel is closed, numbering
+// them so clients can tell when they lost some. Messages skip returns true
+// for are dropped without a number.
+//
+// Messages are shared by all clients of the room, so they are encoded once
+// and numbered on the way out. Unnumbered connections get the same frame as
+// each other, which is prepared once, saving the copy for every connection
+// of a large room. The same goes for compressing it.
+func writeMessages(conn *websocket.Conn, f framing, messages chan *Message, skip func(*Message) bool) {
+	var seq uint64
+	for message := range messages {
+		if skip != nil && skip(message) {
+			continue
+		}
+
+		// Compression only takes effect if the client negotiated it
+		data, err := message.encode(f.codec)
+		if err == nil {
+			conn.EnableWriteCompression(len(data) >= f.compressMin)
+			err = conn.SetWriteDeadline(time.Now().Add(f.writeTimeout))
 		}
-		c.Conn.WriteJSON(message)
+
+		switch {
+		case err != nil:
+		case f.numbered:
+			seq++
+			err = conn.WriteMessage(f.codec.FrameType(), f.codec.Frame(data, seq))
+		default:
+			var prepared *websocket.PreparedMessage
+			prepared, err = message.prepare(f.codec)
+			if err == nil {
+				err = conn.WritePreparedMessage(prepared)
+			}
+		}
+		if err != nil {
+			log.Printf("error: %v", err)
+			break
+		}
+	}
+
+	// Closing the connection makes the reader unregister its clients,
+	// until then rooms may still send to the channel
+	conn.Close()
+	for range messages {
 	}
 }
 
 // Sends messages from the websocket connection to the room.
-func (c *Client) readMessage(room *Room) {
+func (c *Client) readMessage(room *Room, svc *service) {
 	defer func() {
-		room.Unregister <- c
+		room.leave(c)
 		c.Conn.Close()
+		svc.hub.Presence.Disconnect(c.UserID, room.ID)
 	}()
 
 	for {
@@ -44,13 +138,71 @@ func (c *Client) readMessage(room *Room) {
 			}
 			break
 		}
+		svc.hub.Presence.Touch(c.UserID)
+
+		cmd, err := c.framing.codec.Decode(data)
+		if err != nil {
+			c.fail("", err.Error())
+			continue
+		}
+		svc.dispatch(c, room, cmd)
+	}
+}
+
+// Handles a command of the client, replying with an ack or error when needed.
+func (s *service) dispatch(c *Client, room *Room, cmd *Command) {
+	id, err := s.execute(context.Background(), c, room, cmd)
+	if err != nil {
+		c.fail(cmd.ClientID, err.Error())
+		return
+	}
+
+	if cmd.ClientID != "" {
+		c.ack(cmd.ClientID, id)
+	}
+}
+
+// Commands which put something of the user in front of the room, refused while muted
+var postingCommands = map[string]bool{
+	MessageText:        true,
+	MessageEdit:        true,
+	MessageReact:       true,
+	MessageUnreact:     true,
+	MessageTypingStart: true,
+}
+
+// Runs the command unless it was already handled, see handleCommand.
+func (s *service) execute(ctx context.Context, c *Client, room *Room, cmd *Command) (string, error) {
+	if postingCommands[cmd.Type] && room.IsMuted(c.UserID) {
+		return "", errors.New("You are muted in this room")
+	}
 
-		msg := &Message{
-			Content:  string(data),
-			RoomID:   c.RoomID,
-			Username: c.Username,
+	if cmd.ClientID == "" {
+		return s.handleCommand(ctx, c, room, cmd)
+	}
+
+	// A resent command is or was already handled, only the ack got lost
+	handled, ok := room.handled.reserve(c.UserID, cmd.ClientID)
+	if !ok {
+		select {
+		case <-handled.done:
+			return handled.id, handled.err
+		case <-ctx.Done():
+			return "", ctx.Err()
 		}
+	}
+
+	id, err := s.handleCommand(ctx, c, room, cmd)
+	room.handled.finish(c.UserID, cmd.ClientID, handled, id, err)
+	return id, err
+}
 
-		room.Broadcast <- msg
+// Tells the client its command failed.
+func (c *Client) fail(clientID string, reason string) {
+	c.Message <- &Message{
+		Type:     MessageError,
+		ClientID: clientID,
+		Content:  reason,
+		RoomID:   c.RoomID,
 	}
 }
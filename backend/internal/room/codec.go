@@ -0,0 +1,367 @@
+package room
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// WebSocket subprotocols selecting the wire format, JSON if none is asked for
+const (
+	ProtocolJSON    = "gochat.json.v1"
+	ProtocolMsgpack = "gochat.msgpack.v1"
+	ProtocolProto   = "gochat.proto.v1"
+)
+
+// Encodes messages to and decodes commands from a connection's frames.
+// A message is encoded once for all connections using the same codec, the
+// per-connection sequence number is added to the encoded bytes by Frame.
+type Codec interface {
+	Protocol() string
+	// websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+	// Encodes the message without its sequence number.
+	Encode(msg *Message) ([]byte, error)
+	// Returns a copy of an encoded message numbered seq.
+	Frame(encoded []byte, seq uint64) []byte
+	Decode(data []byte) (*Command, error)
+}
+
+var codecs = map[string]Codec{
+	ProtocolJSON:    jsonCodec{},
+	ProtocolMsgpack: newMsgpackCodec(),
+	ProtocolProto:   protoCodec{},
+}
+
+// Returns the first of the subprotocols requested by a client which has a
+// codec, or an empty string if none does.
+func NegotiateProtocol(requested []string) string {
+	for _, protocol := range requested {
+		if _, ok := codecs[protocol]; ok {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// Clients which didn't negotiate a protocol get JSON.
+func codecFor(protocol string) Codec {
+	if c, ok := codecs[protocol]; ok {
+		return c
+	}
+	return codecs[ProtocolJSON]
+}
+
+// Encodings of a message by protocol, shared by the connections it is sent to.
+type wireCache struct {
+	mu       sync.Mutex
+	encoded  map[string][]byte
+	prepared map[string]*websocket.PreparedMessage
+}
+
+func newWireCache() *wireCache {
+	return &wireCache{
+		encoded:  make(map[string][]byte),
+		prepared: make(map[string]*websocket.PreparedMessage),
+	}
+}
+
+// Encodes the message, or returns its earlier encoding if it has one.
+func (m *Message) encode(c Codec) ([]byte, error) {
+	if m.wire == nil {
+		return c.Encode(m)
+	}
+
+	m.wire.mu.Lock()
+	defer m.wire.mu.Unlock()
+
+	if data, ok := m.wire.encoded[c.Protocol()]; ok {
+		return data, nil
+	}
+	data, err := c.Encode(m)
+	if err != nil {
+		return nil, err
+	}
+	m.wire.encoded[c.Protocol()] = data
+	return data, nil
+}
+
+// Returns the message's frame without a sequence number, prepared once per protocol.
+func (m *Message) prepare(c Codec) (*websocket.PreparedMessage, error) {
+	if m.wire != nil {
+		m.wire.mu.Lock()
+		prepared, ok := m.wire.prepared[c.Protocol()]
+		m.wire.mu.Unlock()
+		if ok {
+			return prepared, nil
+		}
+	}
+
+	data, err := m.encode(c)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := websocket.NewPreparedMessage(c.FrameType(), data)
+	if err != nil || m.wire == nil {
+		return prepared, err
+	}
+
+	// Connections racing to prepare it end up sharing the first one
+	m.wire.mu.Lock()
+	defer m.wire.mu.Unlock()
+	if existing, ok := m.wire.prepared[c.Protocol()]; ok {
+		return existing, nil
+	}
+	m.wire.prepared[c.Protocol()] = prepared
+	return prepared, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Protocol() string { return ProtocolJSON }
+func (jsonCodec) FrameType() int   { return websocket.TextMessage }
+
+func (jsonCodec) Encode(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// Puts the sequence number first, the encoded object is never empty.
+func (jsonCodec) Frame(encoded []byte, seq uint64) []byte {
+	data := make([]byte, 0, len(encoded)+32)
+	data = append(data, `{"seq":`...)
+	data = strconv.AppendUint(data, seq, 10)
+	data = append(data, ',')
+	return append(data, encoded[1:]...)
+}
+
+// Frames which are not a JSON command are treated as plain chat messages.
+func (jsonCodec) Decode(data []byte) (*Command, error) {
+	return parseCommand(data), nil
+}
+
+// MessagePack maps keyed like the JSON objects.
+type msgpackCodec struct {
+	handle *codec.MsgpackHandle
+}
+
+func newMsgpackCodec() msgpackCodec {
+	h := &codec.MsgpackHandle{}
+	// Times as the timestamp extension
+	h.WriteExt = true
+	return msgpackCodec{handle: h}
+}
+
+func (msgpackCodec) Protocol() string { return ProtocolMsgpack }
+func (msgpackCodec) FrameType() int   { return websocket.BinaryMessage }
+
+func (c msgpackCodec) Encode(msg *Message) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, c.handle).Encode(msg)
+	return data, err
+}
+
+// Adds a seq entry to the map, rewriting its header for the extra entry.
+func (msgpackCodec) Frame(encoded []byte, seq uint64) []byte {
+	var size, header int
+	switch b := encoded[0]; {
+	case b&0xf0 == 0x80:
+		size, header = int(b&0x0f), 1
+	case b == 0xde:
+		size, header = int(binary.BigEndian.Uint16(encoded[1:])), 3
+	default:
+		size, header = int(binary.BigEndian.Uint32(encoded[1:])), 5
+	}
+
+	data := make([]byte, 0, len(encoded)+16)
+	size++
+	switch {
+	case size < 16:
+		data = append(data, 0x80|byte(size))
+	case size <= 0xffff:
+		data = append(data, 0xde)
+		data = binary.BigEndian.AppendUint16(data, uint16(size))
+	default:
+		data = append(data, 0xdf)
+		data = binary.BigEndian.AppendUint32(data, uint32(size))
+	}
+
+	data = append(data, 0xa3, 's', 'e', 'q')
+	switch {
+	case seq < 0x80:
+		data = append(data, byte(seq))
+	case seq <= 0xffffffff:
+		data = append(data, 0xce)
+		data = binary.BigEndian.AppendUint32(data, uint32(seq))
+	default:
+		data = append(data, 0xcf)
+		data = binary.BigEndian.AppendUint64(data, seq)
+	}
+
+	return append(data, encoded[header:]...)
+}
+
+// Commands without a type are chat messages.
+func (c msgpackCodec) Decode(data []byte) (*Command, error) {
+	cmd := &Command{}
+	if err := codec.NewDecoderBytes(data, c.handle).Decode(cmd); err != nil {
+		return nil, fmt.Errorf("Malformed command: %w", err)
+	}
+	if cmd.Type == "" {
+		cmd.Type = MessageText
+	}
+	return cmd, nil
+}
+
+// Protocol Buffers as described in gochat.proto.
+type protoCodec struct{}
+
+func (protoCodec) Protocol() string { return ProtocolProto }
+func (protoCodec) FrameType() int   { return websocket.BinaryMessage }
+
+func (protoCodec) Encode(msg *Message) ([]byte, error) {
+	var b []byte
+	b = appendProtoString(b, 1, msg.ID)
+	b = appendProtoString(b, 2, msg.Type)
+	b = appendProtoString(b, 4, msg.ClientID)
+	b = appendProtoString(b, 5, msg.Content)
+	b = appendProtoString(b, 6, msg.RoomID)
+	b = appendProtoString(b, 7, msg.UserID)
+	b = appendProtoString(b, 8, msg.Username)
+	b = appendProtoTime(b, 9, msg.CreatedAt)
+	if msg.EditedAt != nil {
+		b = appendProtoTime(b, 10, *msg.EditedAt)
+	}
+	if msg.Deleted {
+		b = appendProtoInt(b, 11, 1)
+	}
+	b = appendProtoString(b, 12, msg.ParentID)
+	b = appendProtoInt(b, 13, int64(msg.ReplyCount))
+	if msg.LastReplyAt != nil {
+		b = appendProtoTime(b, 14, *msg.LastReplyAt)
+	}
+	for _, a := range msg.Attachments {
+		var ab []byte
+		ab = appendProtoString(ab, 1, a.ID)
+		ab = appendProtoString(ab, 2, a.RoomID)
+		ab = appendProtoString(ab, 3, a.UserID)
+		ab = appendProtoString(ab, 4, a.MessageID)
+		ab = appendProtoString(ab, 5, a.Name)
+		ab = appendProtoString(ab, 6, a.ContentType)
+		ab = appendProtoInt(ab, 7, a.Size)
+		ab = appendProtoInt(ab, 8, int64(a.Width))
+		ab = appendProtoInt(ab, 9, int64(a.Height))
+		ab = appendProtoString(ab, 10, a.URL)
+		ab = appendProtoString(ab, 11, a.ThumbnailURL)
+		ab = appendProtoTime(ab, 12, a.CreatedAt)
+		b = appendProtoBytes(b, 15, ab)
+	}
+	for _, r := range msg.Reactions {
+		var rb []byte
+		rb = appendProtoString(rb, 1, r.Emoji)
+		rb = appendProtoInt(rb, 2, int64(r.Count))
+		for _, userID := range r.UserIDs {
+			rb = appendProtoString(rb, 3, userID)
+		}
+		b = appendProtoBytes(b, 16, rb)
+	}
+	b = appendProtoString(b, 17, msg.Emoji)
+	if msg.Count != nil {
+		// Explicit presence, a count of 0 is sent as well
+		b = protowire.AppendTag(b, 18, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*msg.Count))
+	}
+	b = appendProtoString(b, 19, msg.Status)
+	b = appendProtoString(b, 20, msg.ActorID)
+	b = appendProtoString(b, 21, msg.ActorName)
+	return b, nil
+}
+
+// Fields may come in any order, so seq is simply appended.
+func (protoCodec) Frame(encoded []byte, seq uint64) []byte {
+	data := make([]byte, 0, len(encoded)+11)
+	data = append(data, encoded...)
+	data = protowire.AppendTag(data, 3, protowire.VarintType)
+	return protowire.AppendVarint(data, seq)
+}
+
+// Commands without a type are chat messages. Unknown fields are skipped.
+func (protoCodec) Decode(data []byte) (*Command, error) {
+	cmd := &Command{}
+	fields := map[protowire.Number]*string{
+		1: &cmd.Type, 2: &cmd.ClientID, 3: &cmd.RoomID, 4: &cmd.LastMessageID,
+		5: &cmd.ID, 6: &cmd.ParentID, 7: &cmd.Content, 9: &cmd.Emoji,
+		10: &cmd.Status, 11: &cmd.UserID, 12: &cmd.Reason,
+	}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, fmt.Errorf("Malformed command: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch field := fields[num]; {
+		case field != nil && typ == protowire.BytesType:
+			*field, n = protowire.ConsumeString(data)
+		case num == 8 && typ == protowire.BytesType:
+			var id string
+			id, n = protowire.ConsumeString(data)
+			cmd.Attachments = append(cmd.Attachments, id)
+		case num == 13 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			cmd.Duration = int(int64(v))
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("Malformed command: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+
+	if cmd.Type == "" {
+		cmd.Type = MessageText
+	}
+	return cmd, nil
+}
+
+// Default values are left out like proto3 does.
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendProtoInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// As a google.protobuf.Timestamp.
+func appendProtoTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var ts []byte
+	ts = appendProtoInt(ts, 1, t.Unix())
+	ts = appendProtoInt(ts, 2, int64(t.Nanosecond()))
+	return appendProtoBytes(b, num, ts)
+}
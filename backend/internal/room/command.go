@@ -0,0 +1,101 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Typing indicator is cleared if the client doesn't repeat typing_start in time
+var typingTimeout = 5 * time.Second
+
+// Minimum interval between typing_start commands of a client
+const typingThrottle = time.Second
+
+// Sent by clients over the websocket. Frames which are not a JSON command
+// are treated as plain chat messages.
+type Command struct {
+	Type          string   `json:"type"`
+	ClientID      string   `json:"clientId"` // Chosen by the client to match acks and suppress resends
+	RoomID        string   `json:"roomId"`   // Only on shared connections, see Session
+	LastMessageID string   `json:"lastMessageId"`
+	ID            string   `json:"id"`
+	ParentID      string   `json:"parentId"`
+	Content       string   `json:"content"`
+	Attachments   []string `json:"attachments"` // IDs of uploads to attach to the message
+	Emoji         string   `json:"emoji"`
+	Status        string   `json:"status"`
+	UserID        string   `json:"userId"`
+	Reason        string   `json:"reason"`
+	Duration      int      `json:"duration"`
+}
+
+func parseCommand(data []byte) *Command {
+	cmd := &Command{}
+	if err := json.Unmarshal(data, cmd); err != nil || cmd.Type == "" {
+		return &Command{Type: MessageText, Content: string(data)}
+	}
+
+	return cmd
+}
+
+// Executes a command sent by the client in the given room. Returns the ID
+// of the message the command created or changed, if any.
+func (s *service) handleCommand(ctx context.Context, client *Client, room *Room, cmd *Command) (string, error) {
+	switch cmd.Type {
+	case MessageKick, MessageBan, MessageUnban, MessageMute, MessageUnmute, MessageModeratorAdd:
+		return "", s.moderate(ctx, &ModerateReq{
+			CallerID: client.UserID,
+			Username: client.Username,
+			RoomID:   room.ID,
+			UserID:   cmd.UserID,
+			Reason:   cmd.Reason,
+			Duration: cmd.Duration,
+		}, cmd.Type)
+
+	case MessageText:
+		return s.sendMessage(ctx, client, room, cmd.Content, cmd.ParentID, cmd.Attachments)
+
+	case MessageEdit:
+		return cmd.ID, s.editMessage(ctx, client, room, cmd.ID, cmd.Content)
+
+	case MessageDelete:
+		return cmd.ID, s.deleteMessage(ctx, client, room, cmd.ID)
+
+	case MessageReact, MessageUnreact:
+		return cmd.ID, s.react(ctx, client, room, cmd.ID, cmd.Emoji, cmd.Type == MessageReact)
+
+	case MessageSubscribe, MessageUnsubscribe:
+		return cmd.ID, s.subscribe(ctx, client, room, cmd.ID, cmd.Type == MessageSubscribe)
+
+	case MessageRead:
+		return cmd.ID, s.markRead(ctx, client, room, cmd.ID)
+
+	case MessagePresence:
+		if cmd.Status != StatusOnline && cmd.Status != StatusAway {
+			return "", fmt.Errorf("Status must be %s or %s", StatusOnline, StatusAway)
+		}
+		s.hub.Presence.SetStatus(client.UserID, cmd.Status)
+		return "", nil
+
+	case MessageTypingStart, MessageTypingStop:
+		if cmd.Type == MessageTypingStart {
+			if time.Since(client.lastTyping) < typingThrottle {
+				return "", nil
+			}
+			client.lastTyping = time.Now()
+		}
+
+		room.broadcast(&Message{
+			Type:     cmd.Type,
+			RoomID:   room.ID,
+			UserID:   client.UserID,
+			Username: client.Username,
+		})
+		return "", nil
+
+	default:
+		return "", fmt.Errorf("Unknown command %q", cmd.Type)
+	}
+}
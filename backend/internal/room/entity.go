@@ -2,61 +2,502 @@ package room
 
 import (
 	"gochatv1/config"
+	"gochatv1/internal/notification"
 
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 )
 
+// Kinds of conversations kept in the hub
+const (
+	KindRoom   = "room"
+	KindDirect = "direct"
+	KindGroup  = "group"
+)
+
+// Clients and connections are only changed by run, other goroutines must read them with the lock held.
 type Room struct {
-	ID         string
-	Name       string
-	Clients    map[string]*Client
-	Register   chan *Client
-	Unregister chan *Client
-	Broadcast  chan *Message
+	ID          string
+	Name        string
+	Kind        string
+	OwnerID     string
+	Moderators  map[string]bool
+	Members     map[string]bool
+	Muted       map[string]time.Time
+	LastMessage *Message
+	Clients     map[string]*Client
+	Register    chan *Client
+	Unregister  chan *Client
+	Broadcast   chan *Message
+	Disconnect  chan *Disconnect
+	mu          sync.RWMutex
+
+	// Clients done replaying what they missed, see Room.replay
+	replayed chan *Client
+
+	// Connections of each user by connection ID, Clients holds the same by connection ID
+	connections map[string]map[string]*Client
+	// Users currently typing by ID, owned by run
+	typing map[string]typist
+	// Recent stored message events, replayed to resuming clients
+	history *ringBuffer
+	// Commands recently handled for each user, by client ID
+	handled *handledCache
+	// Closed once the room is deleted, which stops run
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// A user typing in a room and when their indicator expires.
+type typist struct {
+	username  string
+	expiresAt time.Time
+}
+
+// Asks the room to close all connections of a user.
+type Disconnect struct {
+	UserID string
+	Reason string
+}
+
+// Keeps a user out of a room until it expires, nil ExpiresAt means forever.
+type Ban struct {
+	RoomID    string
+	UserID    string
+	Reason    string
+	CreatedBy string
+	ExpiresAt *time.Time
+}
+
+// Keeps a user from posting in a room until it expires, nil ExpiresAt means forever.
+type Mute struct {
+	RoomID    string
+	UserID    string
+	CreatedBy string
+	ExpiresAt *time.Time
+}
+
+// Record of a moderation action, Action is one of the moderation message types.
+type AuditEntry struct {
+	ID        int64
+	RoomID    string
+	ActorID   string
+	Action    string
+	TargetID  string
+	Reason    string
+	ExpiresAt *time.Time
+	CreatedAt time.Time
 }
 
 type Hub struct {
-	Rooms map[string]*Room
+	Rooms    map[string]*Room
+	Directs  map[string]*Room
+	Presence *Presence
+	mu       sync.RWMutex
+
+	// Long-polling receivers by ID, see service_stream.go
+	polls map[string]*poller
+}
+
+// Delivers notifications to users who are not connected
+type Notifier interface {
+	Notify(ctx context.Context, notifications ...*notification.Notification) error
 }
 
 type Service interface {
 	CreateRoom(ctx context.Context, req *CreateRoomReq) (*CreateRoomRes, error)
 	DeleteRoom(ctx context.Context, req *DeleteRoomReq) error
-	GetRooms(ctx context.Context) ([]GetRoomsRes, error)
+	GetRooms(ctx context.Context, req *GetRoomsReq) ([]GetRoomsRes, error)
+	CreateDirect(ctx context.Context, req *CreateDirectReq) (*CreateDirectRes, error)
+	GetDirects(ctx context.Context, req *GetDirectsReq) ([]GetDirectsRes, error)
+	CreateGroup(ctx context.Context, req *CreateGroupReq) (*CreateGroupRes, error)
+	AddGroupMember(ctx context.Context, req *AddGroupMemberReq) error
+	LeaveGroup(ctx context.Context, req *LeaveGroupReq) error
+	RenameGroup(ctx context.Context, req *RenameGroupReq) error
+	Kick(ctx context.Context, req *ModerateReq) error
+	Ban(ctx context.Context, req *ModerateReq) error
+	Unban(ctx context.Context, req *ModerateReq) error
+	Mute(ctx context.Context, req *ModerateReq) error
+	Unmute(ctx context.Context, req *ModerateReq) error
+	AddModerator(ctx context.Context, req *ModerateReq) error
+	GetAuditLog(ctx context.Context, req *GetAuditLogReq) ([]GetAuditLogRes, error)
+	GetMessages(ctx context.Context, req *GetMessagesReq) ([]*Message, error)
+	GetMessageEdits(ctx context.Context, req *GetMessageEditsReq) ([]*MessageRevision, error)
+	GetThread(ctx context.Context, req *GetThreadReq) (*GetThreadRes, error)
+	GetReadPositions(ctx context.Context, req *GetReadPositionsReq) ([]*ReadPosition, error)
+	GetPresence(ctx context.Context, req *GetPresenceReq) ([]GetPresenceRes, error)
+	GetMentions(ctx context.Context, req *GetMentionsReq) ([]*Message, error)
+	UploadAttachments(ctx context.Context, req *UploadAttachmentsReq) ([]*Attachment, error)
+	GetAttachment(ctx context.Context, req *GetAttachmentReq) (*Attachment, io.ReadCloser, error)
+	Search(ctx context.Context, req *SearchReq) ([]*SearchResult, error)
+	GetRetentionPolicies(ctx context.Context) (*RetentionPoliciesRes, error)
+	SetRetentionPolicy(ctx context.Context, req *SetRetentionPolicyReq) (*RetentionPolicy, error)
+	DeleteRetentionPolicy(ctx context.Context, req *DeleteRetentionPolicyReq) error
+	GetRetentionRuns(ctx context.Context, req *GetRetentionRunsReq) ([]*RetentionRun, error)
+	PruneExpired(ctx context.Context) ([]*RetentionRun, error)
+	ExportRoom(ctx context.Context, req *ExportRoomReq) (*ExportRoomRes, error)
 	JoinRoom(ctx context.Context, req *JoinRoomReq) error
+	Connect(ctx context.Context, req *ConnectReq) error
+	OpenStream(ctx context.Context, req *OpenStreamReq) (*Stream, error)
+	Poll(ctx context.Context, req *PollReq) (*PollRes, error)
+	PostCommand(ctx context.Context, req *PostCommandReq) (*PostCommandRes, error)
 	GetClients(ctx context.Context, req *GetClientsReq) ([]GetClientsRes, error)
 }
 
 type Repository interface {
 	CreateRoom(ctx context.Context, room *Room) (*Room, error)
+	SaveRoom(ctx context.Context, room *Room) error
+	DeleteSavedRoom(ctx context.Context, id string) error
+	LoadRooms(ctx context.Context) ([]*Room, error)
 	DeleteRoom(ctx context.Context, id string) error
 	GetRooms(ctx context.Context) ([]*Room, error)
+	GetRoom(ctx context.Context, id string) (*Room, error)
+	CreateDirect(ctx context.Context, room *Room) (*Room, error)
+	GetDirects(ctx context.Context, userID string) ([]*Room, error)
 	GetClients(ctx context.Context, roomId string) ([]*Client, error)
+	CreateBan(ctx context.Context, ban *Ban) (*Ban, error)
+	DeleteBan(ctx context.Context, roomID string, userID string) error
+	IsBanned(ctx context.Context, roomID string, userID string) (bool, error)
+	CreateMute(ctx context.Context, mute *Mute) (*Mute, error)
+	DeleteMute(ctx context.Context, roomID string, userID string) error
+	CreateModerator(ctx context.Context, roomID string, userID string, createdBy string) error
+	CreateAuditEntry(ctx context.Context, entry *AuditEntry) (*AuditEntry, error)
+	GetAuditLog(ctx context.Context, roomID string) ([]*AuditEntry, error)
+	CreateMessage(ctx context.Context, msg *Message) (*Message, error)
+	GetMessage(ctx context.Context, id string) (*Message, error)
+	GetMessages(ctx context.Context, roomID string, before string, limit int) ([]*Message, error)
+	GetThread(ctx context.Context, parentID string, after string, limit int) ([]*Message, error)
+	Subscribe(ctx context.Context, messageID string, userID string) error
+	Unsubscribe(ctx context.Context, messageID string, userID string) error
+	GetSubscribers(ctx context.Context, messageID string) ([]string, error)
+	EditMessage(ctx context.Context, id string, content string, editedAt time.Time) error
+	DeleteMessage(ctx context.Context, id string, deletedAt time.Time) error
+	GetMessageEdits(ctx context.Context, id string) ([]*MessageRevision, error)
+	AddReaction(ctx context.Context, messageID string, userID string, emoji string) (int, error)
+	RemoveReaction(ctx context.Context, messageID string, userID string, emoji string) (int, error)
+	GetReactions(ctx context.Context, messageIDs []string) (map[string][]Reaction, error)
+	SetReadPosition(ctx context.Context, roomID string, userID string, messageID string) error
+	GetReadPositions(ctx context.Context, roomID string) ([]*ReadPosition, error)
+	GetUnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]UnreadCount, error)
+	GetUserIDsByUsernames(ctx context.Context, usernames []string) ([]string, error)
+	GetUsername(ctx context.Context, userID string) (string, error)
+	CreateMentions(ctx context.Context, msg *Message, userIDs []string) error
+	GetMentions(ctx context.Context, userID string, before string, limit int) ([]*Message, error)
+	CreateAttachment(ctx context.Context, attachment *Attachment) (*Attachment, error)
+	GetAttachment(ctx context.Context, id string) (*Attachment, error)
+	GetAttachmentsByIDs(ctx context.Context, ids []string) ([]*Attachment, error)
+	GetAttachments(ctx context.Context, messageIDs []string) (map[string][]*Attachment, error)
+	SearchMessages(ctx context.Context, query *SearchQuery) ([]*SearchResult, error)
+	GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error)
+	SetRetentionPolicy(ctx context.Context, policy *RetentionPolicy) error
+	DeleteRetentionPolicy(ctx context.Context, roomID string) error
+	PruneMessages(ctx context.Context, roomID string, cutoff *time.Time, maxCount int, limit int, archive bool) ([]string, error)
+	DeleteAttachments(ctx context.Context, messageIDs []string) ([]*Attachment, error)
+	CreateRetentionRun(ctx context.Context, run *RetentionRun) (*RetentionRun, error)
+	GetRetentionRuns(ctx context.Context, roomID string, before int64, limit int) ([]*RetentionRun, error)
+	GetMessagesAfter(ctx context.Context, roomID string, after string, from *time.Time, to *time.Time, limit int) ([]*Message, error)
+	GetRevisions(ctx context.Context, messageIDs []string) (map[string][]*MessageRevision, error)
+}
+
+// Stores uploaded files under keys chosen by the service
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
 }
 
 func NewRoom(id string, name string) *Room {
 	return &Room{
 		ID:         id,
 		Name:       name,
+		Kind:       KindRoom,
+		Moderators: make(map[string]bool),
+		Muted:      make(map[string]time.Time),
 		Clients:    make(map[string]*Client),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
 		Broadcast:  make(chan *Message, 5),
+		Disconnect: make(chan *Disconnect),
+		replayed:   make(chan *Client),
+
+		connections: make(map[string]map[string]*Client),
+		typing:      make(map[string]typist),
+		history:     newRingBuffer(resumeBufferSize),
+		handled:     newHandledCache(handledCacheSize),
+		done:        make(chan struct{}),
 	}
 }
 
+// Creates a 1:1 conversation which only the two given users can join.
+func NewDirectRoom(id string, userID string, peerID string) *Room {
+	room := NewRoom(id, "")
+	room.Kind = KindDirect
+	room.Members = map[string]bool{userID: true, peerID: true}
+	return room
+}
+
+// Creates an unnamed-by-default conversation between several users.
+func NewGroupRoom(id string, name string, userIDs []string) *Room {
+	room := NewRoom(id, name)
+	room.Kind = KindGroup
+	room.Members = make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		room.Members[userID] = true
+	}
+	return room
+}
+
 func NewHub() *Hub {
-	return &Hub{
-		Rooms: make(map[string]*Room),
+	hub := &Hub{
+		Rooms:   make(map[string]*Room),
+		Directs: make(map[string]*Room),
+		polls:   make(map[string]*poller),
+	}
+	hub.Presence = NewPresence(0, hub.broadcastPresence)
+	return hub
+}
+
+// Returns the members of a private conversation in a stable order.
+func (r *Room) MemberIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.Members))
+	for id := range r.Members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Users who can be reached in the room: members of private rooms,
+// connected users of public ones.
+func (r *Room) UserIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := r.Members
+	if r.Kind == KindRoom {
+		users = make(map[string]bool, len(r.connections))
+		for userID := range r.connections {
+			users[userID] = true
+		}
 	}
+
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Public rooms are open to everyone, other kinds only to their members.
+func (r *Room) IsMember(userID string) bool {
+	if r.Kind == KindRoom {
+		return true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.Members[userID]
+}
+
+// The owner is always a moderator of the room.
+func (r *Room) IsModerator(userID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return userID != "" && (r.OwnerID == userID || r.Moderators[userID])
+}
+
+func (r *Room) AddModerator(userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Moderators[userID] = true
+}
+
+// Zero until mutes the user until unmuted.
+func (r *Room) Mute(userID string, until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Muted[userID] = until
+}
+
+func (r *Room) Unmute(userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.Muted, userID)
 }
 
-func Init(cfg *config.Config, val *validator.Validate) *Handler {
+func (r *Room) IsMuted(userID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	until, ok := r.Muted[userID]
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+// Fails if the user is a member already or the room has max members, 0 means no limit.
+func (r *Room) AddMember(userID string, max int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Members[userID] {
+		return errors.New("User is already a member of the group")
+	}
+	if max > 0 && len(r.Members) >= max {
+		return fmt.Errorf("Group can't have more than %d participants", max)
+	}
+
+	r.Members[userID] = true
+	return nil
+}
+
+// Returns the number of members left in the room.
+func (r *Room) RemoveMember(userID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.Members, userID)
+	return len(r.Members)
+}
+
+// Stops run, which drops the connected clients. Called once the room is out of the hub.
+func (r *Room) close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+// Forgets pruned messages, so they are neither replayed to resuming clients
+// nor listed as the last message anymore.
+func (r *Room) forget(ids []string) {
+	pruned := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		pruned[id] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.history.remove(pruned)
+	if r.LastMessage != nil && pruned[r.LastMessage.ID] {
+		r.LastMessage = nil
+	}
+}
+
+// Hands the message to run, dropped once the room is closed.
+func (r *Room) broadcast(msg *Message) {
+	select {
+	case r.Broadcast <- msg:
+	case <-r.done:
+	}
+}
+
+func (r *Room) disconnect(d *Disconnect) {
+	select {
+	case r.Disconnect <- d:
+	case <-r.done:
+	}
+}
+
+// Returns false if the room is closed.
+func (r *Room) join(client *Client) bool {
+	select {
+	case r.Register <- client:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+func (r *Room) leave(client *Client) {
+	select {
+	case r.Unregister <- client:
+	case <-r.done:
+		// Own connections are left to their reader once the room stopped
+		if client.Conn != nil && client.session == nil {
+			close(client.Message)
+		}
+	}
+}
+
+func (r *Room) GetName() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.Name
+}
+
+func (r *Room) SetName(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Name = name
+}
+
+// Same key for (a, b) and (b, a), so a pair of users has a single direct room.
+func directKey(userIDs []string) string {
+	return strings.Join(userIDs, ":")
+}
+
+func Init(cfg *config.Config, val *validator.Validate, db DBTx, notifier Notifier, blobs BlobStore) *Handler {
 	hub := NewHub()
-	roomRep := NewRepository(hub)
-	roomSvc := NewService(roomRep, cfg, val, hub)
+	hub.Presence = NewPresence(cfg.AwayTimeout, hub.broadcastPresence)
+	go hub.Presence.run()
+	roomRep := NewRepository(hub, db)
+	if err := loadRooms(roomRep, cfg.DBTimeout); err != nil {
+		log.Fatalf("Could not load rooms: %s", err)
+	}
+	go runRoomLoader(roomRep, cfg)
+	roomSvc := NewService(roomRep, cfg, val, hub, notifier, blobs)
+	go runJanitor(roomSvc, cfg.RetentionInterval)
 	roomHdl := NewHandler(roomSvc, cfg)
 	return roomHdl
 }
+
+// Starts the saved rooms which are not in the hub yet.
+func loadRooms(repo Repository, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rooms, err := repo.LoadRooms(ctx)
+	if err != nil {
+		return err
+	}
+	for _, room := range rooms {
+		go room.run()
+	}
+
+	return nil
+}
+
+// Picks up rooms saved by other processes, e.g. gochat import, while the server runs.
+func runRoomLoader(repo Repository, cfg *config.Config) {
+	if cfg.RoomReloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.RoomReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := loadRooms(repo, cfg.DBTimeout); err != nil {
+			log.Printf("error: load rooms: %v", err)
+		}
+	}
+}
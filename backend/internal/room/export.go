@@ -0,0 +1,201 @@
+package room
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	ExportJSON     = "json"
+	ExportMarkdown = "md"
+	ExportHTML     = "html"
+)
+
+// Message of a transcript with the contents it had before edits
+type ExportedMessage struct {
+	*Message
+	Revisions []*MessageRevision `json:"revisions,omitempty"`
+}
+
+type exportHeader struct {
+	RoomID     string    `json:"id"`
+	Name       string    `json:"name"`
+	ExportedAt time.Time `json:"exportedAt"`
+}
+
+// Writes a transcript one message at a time, nothing is kept in memory.
+type exporter interface {
+	begin(header *exportHeader) error
+	message(msg *ExportedMessage) error
+	end() error
+}
+
+func newExporter(format string, w io.Writer) exporter {
+	switch format {
+	case ExportMarkdown:
+		return &markdownExporter{w: w}
+	case ExportHTML:
+		return &htmlExporter{w: w}
+	default:
+		return &jsonExporter{w: w}
+	}
+}
+
+func exportContentType(format string) string {
+	switch format {
+	case ExportMarkdown:
+		return "text/markdown; charset=utf-8"
+	case ExportHTML:
+		return "text/html; charset=utf-8"
+	default:
+		return "application/json"
+	}
+}
+
+type jsonExporter struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExporter) begin(header *exportHeader) error {
+	room, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(e.w, `{"room":%s,"messages":[`, room)
+	return err
+}
+
+func (e *jsonExporter) message(msg *ExportedMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if e.count > 0 {
+		data = append([]byte(",\n"), data...)
+	}
+	e.count++
+
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExporter) end() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+const exportTimeFormat = "2006-01-02 15:04 UTC"
+
+type markdownExporter struct {
+	w io.Writer
+}
+
+func (e *markdownExporter) begin(header *exportHeader) error {
+	_, err := fmt.Fprintf(e.w, "# %s\n\nExported %s\n\n", header.Name, formatExportTime(header.ExportedAt))
+	return err
+}
+
+// Replies are quoted below the messages they belong to.
+func (e *markdownExporter) message(msg *ExportedMessage) error {
+	var b strings.Builder
+
+	prefix := ""
+	if msg.ParentID != "" {
+		prefix = "> "
+	}
+
+	fmt.Fprintf(&b, "%s**%s** · %s", prefix, msg.Username, formatExportTime(msg.CreatedAt))
+	if msg.EditedAt != nil {
+		fmt.Fprintf(&b, " (edited %s)", formatExportTime(msg.EditedAt))
+	}
+	b.WriteString("\n")
+
+	for _, line := range strings.Split(msg.Content, "\n") {
+		fmt.Fprintf(&b, "%s%s\n", prefix, line)
+	}
+	for _, a := range msg.Attachments {
+		fmt.Fprintf(&b, "%s- [%s](%s)\n", prefix, a.Name, a.URL)
+	}
+	for _, rev := range msg.Revisions {
+		fmt.Fprintf(&b, "%s- _before %s:_ %s\n", prefix, formatExportTime(rev.EditedAt), strings.ReplaceAll(rev.Content, "\n", " "))
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *markdownExporter) end() error {
+	return nil
+}
+
+// Accepts both time.Time and *time.Time, nil is printed as nothing.
+func formatExportTime(t interface{}) string {
+	switch t := t.(type) {
+	case time.Time:
+		return t.UTC().Format(exportTimeFormat)
+	case *time.Time:
+		if t != nil {
+			return t.UTC().Format(exportTimeFormat)
+		}
+	}
+	return ""
+}
+
+var exportTemplates = template.Must(template.New("").Funcs(template.FuncMap{"time": formatExportTime}).Parse(`
+{{- define "begin" -}}
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; }
+.message { margin-bottom: 1rem; }
+.reply { margin-left: 2rem; }
+.meta { color: #666; font-size: 0.875rem; }
+.content { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p class="meta">Exported {{time .ExportedAt}}</p>
+{{end}}
+
+{{- define "message" -}}
+<div class="message{{if .ParentID}} reply{{end}}" id="{{.ID}}">
+<div class="meta"><strong>{{.Username}}</strong> · {{time .CreatedAt}}{{if .EditedAt}} (edited {{time .EditedAt}}){{end}}</div>
+<div class="content">{{.Content}}</div>
+{{- range .Attachments}}
+<div><a href="{{.URL}}">{{.Name}}</a></div>
+{{- end}}
+{{- range .Revisions}}
+<div class="meta">before {{time .EditedAt}}: {{.Content}}</div>
+{{- end}}
+</div>
+{{end}}`))
+
+type htmlExporter struct {
+	w io.Writer
+}
+
+func (e *htmlExporter) begin(header *exportHeader) error {
+	return exportTemplates.ExecuteTemplate(e.w, "begin", header)
+}
+
+func (e *htmlExporter) message(msg *ExportedMessage) error {
+	return exportTemplates.ExecuteTemplate(e.w, "message", msg)
+}
+
+func (e *htmlExporter) end() error {
+	_, err := io.WriteString(e.w, "</body>\n</html>\n")
+	return err
+}
@@ -0,0 +1,13 @@
+package room
+
+import (
+	"testing"
+	"time"
+)
+
+// Shortens how long typing indicators last without a repeated typing_start.
+func SetTypingTimeout(t testing.TB, d time.Duration) {
+	old := typingTimeout
+	typingTimeout = d
+	t.Cleanup(func() { typingTimeout = old })
+}
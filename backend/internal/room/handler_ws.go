@@ -2,22 +2,33 @@ package room
 
 import (
 	"gochatv1/config"
+	"gochatv1/internal/user"
 
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
 type Handler struct {
-	service Service
-	config  *config.Config
+	service  Service
+	config   *config.Config
+	upgrader *websocket.Upgrader
 }
 
 func NewHandler(svc Service, cfg *config.Config) *Handler {
 	return &Handler{
-		service: svc,
-		config:  cfg,
+		service:  svc,
+		config:   cfg,
+		upgrader: newUpgrader(cfg),
 	}
 }
 
@@ -27,6 +38,7 @@ func (h *Handler) CreateRoom(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	req.OwnerID = c.GetString(user.ContextUserID)
 
 	_, err := h.service.CreateRoom(c.Request.Context(), &req)
 	if err != nil {
@@ -43,6 +55,7 @@ func (h *Handler) DeleteRoom(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	req.CallerID = c.GetString(user.ContextUserID)
 
 	err := h.service.DeleteRoom(c.Request.Context(), &req)
 	if err != nil {
@@ -52,7 +65,11 @@ func (h *Handler) DeleteRoom(c *gin.Context) {
 }
 
 func (h *Handler) GetRooms(c *gin.Context) {
-	res, err := h.service.GetRooms(c.Request.Context())
+	req := GetRoomsReq{
+		CallerID: c.GetString(user.ContextUserID),
+	}
+
+	res, err := h.service.GetRooms(c.Request.Context(), &req)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -61,18 +78,453 @@ func (h *Handler) GetRooms(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+func (h *Handler) CreateDirect(c *gin.Context) {
+	var req CreateDirectReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+
+	res, err := h.service.CreateDirect(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
 }
 
-func (h *Handler) JoinRoom(c *gin.Context) {
-	// CSRF protection
-	upgrader.CheckOrigin = func(_ *http.Request) bool {
-		return c.Request.Header.Get("Origin") == h.config.OriginHost
+func (h *Handler) GetDirects(c *gin.Context) {
+	req := GetDirectsReq{
+		UserID: c.GetString(user.ContextUserID),
+	}
+
+	res, err := h.service.GetDirects(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) CreateGroup(c *gin.Context) {
+	var req CreateGroupReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+
+	res, err := h.service.CreateGroup(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) AddGroupMember(c *gin.Context) {
+	var req AddGroupMemberReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.Username = c.GetString(user.ContextUsername)
+	req.RoomID = c.Param("roomId")
+
+	err := h.service.AddGroupMember(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+func (h *Handler) LeaveGroup(c *gin.Context) {
+	req := LeaveGroupReq{
+		CallerID: c.GetString(user.ContextUserID),
+		Username: c.GetString(user.ContextUsername),
+		RoomID:   c.Param("roomId"),
+	}
+
+	err := h.service.LeaveGroup(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+}
+
+func (h *Handler) RenameGroup(c *gin.Context) {
+	var req RenameGroupReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.Username = c.GetString(user.ContextUsername)
+	req.RoomID = c.Param("roomId")
+
+	err := h.service.RenameGroup(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+func (h *Handler) Kick(c *gin.Context)         { h.moderate(c, h.service.Kick) }
+func (h *Handler) Ban(c *gin.Context)          { h.moderate(c, h.service.Ban) }
+func (h *Handler) Unban(c *gin.Context)        { h.moderate(c, h.service.Unban) }
+func (h *Handler) Mute(c *gin.Context)         { h.moderate(c, h.service.Mute) }
+func (h *Handler) Unmute(c *gin.Context)       { h.moderate(c, h.service.Unmute) }
+func (h *Handler) AddModerator(c *gin.Context) { h.moderate(c, h.service.AddModerator) }
+
+func (h *Handler) moderate(c *gin.Context, action func(context.Context, *ModerateReq) error) {
+	var req ModerateReq
+	// Unban and unmute take the user from the path and have no body
+	if userID := c.Param("userId"); userID != "" {
+		req.UserID = userID
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.Username = c.GetString(user.ContextUsername)
+	req.RoomID = c.Param("roomId")
+
+	err := action(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+func (h *Handler) GetAuditLog(c *gin.Context) {
+	req := GetAuditLogReq{
+		CallerID: c.GetString(user.ContextUserID),
+		RoomID:   c.Param("roomId"),
+	}
+
+	res, err := h.service.GetAuditLog(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetMessages(c *gin.Context) {
+	var req GetMessagesReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.RoomID = c.Param("roomId")
+
+	res, err := h.service.GetMessages(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetMessageEdits(c *gin.Context) {
+	req := GetMessageEditsReq{
+		CallerID:  c.GetString(user.ContextUserID),
+		RoomID:    c.Param("roomId"),
+		MessageID: c.Param("messageId"),
+	}
+
+	res, err := h.service.GetMessageEdits(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetThread(c *gin.Context) {
+	var req GetThreadReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.RoomID = c.Param("roomId")
+	req.MessageID = c.Param("messageId")
+
+	res, err := h.service.GetThread(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetReadPositions(c *gin.Context) {
+	req := GetReadPositionsReq{
+		CallerID: c.GetString(user.ContextUserID),
+		RoomID:   c.Param("roomId"),
+	}
+
+	res, err := h.service.GetReadPositions(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetPresence(c *gin.Context) {
+	req := GetPresenceReq{}
+	if ids := c.Query("ids"); ids != "" {
+		req.UserIDs = strings.Split(ids, ",")
+	}
+
+	res, err := h.service.GetPresence(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetMentions(c *gin.Context) {
+	var req GetMentionsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+
+	res, err := h.service.GetMentions(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) UploadAttachments(c *gin.Context) {
+	// Room for the largest allowed files plus the multipart overhead
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(maxAttachments*h.config.MaxAttachmentSize+1<<20))
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	req := UploadAttachmentsReq{
+		CallerID: c.GetString(user.ContextUserID),
+		RoomID:   c.Param("roomId"),
+		Files:    form.File["file"],
+	}
+
+	res, err := h.service.UploadAttachments(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, res)
+}
+
+func (h *Handler) GetAttachment(c *gin.Context) {
+	var req GetAttachmentReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.RoomID = c.Param("roomId")
+	req.AttachmentID = c.Param("attachmentId")
+
+	attachment, blob, err := h.service.GetAttachment(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	defer blob.Close()
+
+	// Only images are shown inline, anything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+	c.DataFromReader(http.StatusOK, attachment.Size, attachment.ContentType, blob, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=86400",
+	})
+}
+
+func (h *Handler) Search(c *gin.Context) {
+	var req SearchReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+
+	res, err := h.service.Search(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetRetentionPolicies(c *gin.Context) {
+	res, err := h.service.GetRetentionPolicies(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) SetRetentionPolicy(c *gin.Context) {
+	var req SetRetentionPolicyReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.RoomID = c.Param("roomId")
+
+	res, err := h.service.SetRetentionPolicy(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) DeleteRetentionPolicy(c *gin.Context) {
+	req := DeleteRetentionPolicyReq{
+		CallerID: c.GetString(user.ContextUserID),
+		RoomID:   c.Param("roomId"),
+	}
+
+	err := h.service.DeleteRetentionPolicy(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) GetRetentionRuns(c *gin.Context) {
+	var req GetRetentionRunsReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.service.GetRetentionRuns(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// Runs the janitor right away instead of waiting for the next interval.
+func (h *Handler) PruneExpired(c *gin.Context) {
+	res, err := h.service.PruneExpired(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) ExportRoom(c *gin.Context) {
+	var req ExportRoomReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.RoomID = c.Param("roomId")
+
+	res, err := h.service.ExportRoom(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", res.ContentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": res.Filename}))
+	c.Status(http.StatusOK)
+
+	// The status is sent already, a failure can only cut the transcript short
+	if err := res.Write(c.Request.Context(), c.Writer); err != nil {
+		log.Printf("error: export of room %s: %v", req.RoomID, err)
+	}
+}
+
+// Interval of comments keeping an idle event stream open
+const sseKeepAlive = 15 * time.Second
+
+func newUpgrader(cfg *config.Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		HandshakeTimeout: cfg.WSHandshakeTimeout,
+		ReadBufferSize:   cfg.WSReadBufferSize,
+		WriteBufferSize:  cfg.WSWriteBufferSize,
+		// Idle connections don't hold on to a write buffer
+		WriteBufferPool:   &sync.Pool{},
+		EnableCompression: cfg.WSCompression,
+		// CSRF protection
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") == cfg.OriginHost
+		},
+	}
+}
+
+// Upgrades to a websocket using the first wire format requested by the client
+// which is supported, JSON if there is none.
+func (h *Handler) upgrade(c *gin.Context) (*websocket.Conn, error) {
+	var header http.Header
+	if protocol := NegotiateProtocol(websocket.Subprotocols(c.Request)); protocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": []string{protocol}}
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// An invalid level leaves the default, which is the fastest
+	_ = conn.SetCompressionLevel(h.config.WSCompressionLevel)
+	return conn, nil
+}
+
+func (h *Handler) JoinRoom(c *gin.Context) {
+	conn, err := h.upgrade(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -81,25 +533,154 @@ func (h *Handler) JoinRoom(c *gin.Context) {
 	req := &JoinRoomReq{
 		Conn:     conn,
 		RoomID:   c.Param("roomId"),
-		UserID:   c.Query("userId"),
-		Username: c.Query("username"),
+		UserID:   c.GetString(user.ContextUserID),
+		Username: c.GetString(user.ContextUsername),
+
+		LastMessageID: c.Query("lastMessageId"),
+		Unnumbered:    c.Query("seq") == "false",
 	}
 
 	err = h.service.JoinRoom(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		// The connection is already hijacked, so report the error in the close frame
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		conn.Close()
 		return
 	}
 }
 
+// Opens a connection shared by all rooms the client subscribes to.
+func (h *Handler) Connect(c *gin.Context) {
+	conn, err := h.upgrade(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := &ConnectReq{
+		Conn:       conn,
+		UserID:     c.GetString(user.ContextUserID),
+		Username:   c.GetString(user.ContextUsername),
+		Unnumbered: c.Query("seq") == "false",
+	}
+
+	err = h.service.Connect(c.Request.Context(), req)
+	if err != nil {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		conn.Close()
+		return
+	}
+}
+
+// Sends the room's messages as server-sent events. Text messages carry their ID
+// as the event ID, so a reconnecting EventSource resumes where it left off.
+func (h *Handler) StreamEvents(c *gin.Context) {
+	req := OpenStreamReq{
+		CallerID:      c.GetString(user.ContextUserID),
+		Username:      c.GetString(user.ContextUsername),
+		RoomID:        c.Param("roomId"),
+		LastMessageID: c.GetHeader("Last-Event-ID"),
+	}
+	if req.LastMessageID == "" {
+		req.LastMessageID = c.Query("lastMessageId")
+	}
+
+	stream, err := h.service.OpenStream(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer stream.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	var seq uint64
+	for {
+		select {
+		case msg, ok := <-stream.Message:
+			if !ok {
+				return
+			}
+
+			// Numbered like websocket messages
+			seq++
+			numbered := *msg
+			numbered.Seq = seq
+			data, err := json.Marshal(&numbered)
+			if err != nil {
+				log.Printf("error: %v", err)
+				return
+			}
+			if msg.Type == MessageText {
+				fmt.Fprintf(c.Writer, "id: %s\n", msg.ID)
+			}
+			fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+
+		case <-keepAlive.C:
+			// Proxies close connections which stay quiet for too long
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func (h *Handler) PollEvents(c *gin.Context) {
+	var req PollReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.Username = c.GetString(user.ContextUsername)
+	req.RoomID = c.Param("roomId")
+
+	res, err := h.service.Poll(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) PostMessage(c *gin.Context) {
+	var req PostCommandReq
+	if err := c.ShouldBindJSON(&req.Command); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CallerID = c.GetString(user.ContextUserID)
+	req.Username = c.GetString(user.ContextUsername)
+	req.RoomID = c.Param("roomId")
+
+	res, err := h.service.PostCommand(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (h *Handler) GetClients(c *gin.Context) {
 	req := GetClientsReq{
-		RoomID: c.Param("roomId"),
+		CallerID: c.GetString(user.ContextUserID),
+		RoomID:   c.Param("roomId"),
 	}
 
 	res, err := h.service.GetClients(c.Request.Context(), &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -0,0 +1,1778 @@
+package room_test
+
+import (
+	"gochatv1/config"
+	"gochatv1/internal/notification"
+	"gochatv1/internal/room"
+	"gochatv1/internal/user"
+
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+	"github.com/oklog/ulid/v2"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Starts a server with a single room and returns its websocket URL.
+func newTestRoomServer(t *testing.T) (room.Service, string, string) {
+	return newTestRoomServerWithNotifier(t, &testNotifier{})
+}
+
+func newTestRoomServerWithNotifier(t *testing.T, notifier room.Notifier) (room.Service, string, string) {
+	hub := room.NewHub()
+	return newTestRoomServerWith(t, hub, &testRepository{room.NewRepository(hub, nil)}, notifier)
+}
+
+func newTestRoomServerWith(t testing.TB, hub *room.Hub, repo room.Repository, notifier room.Notifier) (room.Service, string, string) {
+	cfg := config.New()
+	blobs, err := room.NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %s", err)
+	}
+	roomSvc := room.NewService(repo, cfg, validator.New(), hub, notifier, blobs)
+	roomHdl := room.NewHandler(roomSvc, cfg)
+
+	r := gin.New()
+
+	// Stands in for user.RequireAuth
+	authorized := r.Group("/", func(c *gin.Context) {
+		c.Set(user.ContextUserID, c.GetHeader("X-User"))
+		c.Set(user.ContextUsername, "user"+c.GetHeader("X-User"))
+	})
+	authorized.GET("/rooms/:roomId", roomHdl.JoinRoom)
+	authorized.GET("/ws", roomHdl.Connect)
+	authorized.GET("/rooms/:roomId/events", roomHdl.StreamEvents)
+	authorized.GET("/rooms/:roomId/poll", roomHdl.PollEvents)
+	authorized.POST("/rooms/:roomId/messages", roomHdl.PostMessage)
+	authorized.GET("/rooms/:roomId/reads", roomHdl.GetReadPositions)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	general, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "general"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+
+	return roomSvc, general.ID, "ws" + strings.TrimPrefix(server.URL, "http") + "/rooms/" + general.ID
+}
+
+// Handshake headers of a user, X-User is read by the stand-in for user.RequireAuth.
+func wsHeader(userID string) http.Header {
+	return http.Header{"Origin": []string{config.New().OriginHost}, "X-User": []string{userID}}
+}
+
+func dialRoom(t testing.TB, url string, userID string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, wsHeader(userID))
+	if err != nil {
+		t.Fatalf("Failed to join room: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Reads messages until one of the given type arrives.
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string) *room.Message {
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		msg := &room.Message{}
+		if err := conn.ReadJSON(msg); err != nil {
+			t.Fatalf("Failed to read %s message: %s", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestHandlerTyping(t *testing.T) {
+	_, _, url := newTestRoomServer(t)
+
+	alice := dialRoom(t, url, "1")
+	bob := dialRoom(t, url, "2")
+	readUntil(t, alice, room.MessageJoin)
+	readUntil(t, bob, room.MessageJoin)
+
+	tests := []struct {
+		name    string
+		command string
+	}{
+		{"Others should see typing start", room.MessageTypingStart},
+		{"Others should see typing stop", room.MessageTypingStop},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := alice.WriteJSON(room.Command{Type: test.command}); err != nil {
+				t.Fatalf("Failed to send command: %s", err)
+			}
+
+			msg := readUntil(t, bob, test.command)
+			if msg.UserID != "1" {
+				t.Errorf("got %s, want %s", msg.UserID, "1")
+			}
+		})
+	}
+
+	// Indicators are not sent back to the typing user
+	_ = alice.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		msg := &room.Message{}
+		if err := alice.ReadJSON(msg); err != nil {
+			break
+		}
+		if msg.Type == room.MessageTypingStart || msg.Type == room.MessageTypingStop {
+			t.Errorf("got own %s indicator", msg.Type)
+		}
+	}
+}
+
+func TestHandlerTypingExpiry(t *testing.T) {
+	room.SetTypingTimeout(t, 300*time.Millisecond)
+	_, _, url := newTestRoomServer(t)
+
+	alice := dialRoom(t, url, "1")
+	bob := dialRoom(t, url, "2")
+	readUntil(t, alice, room.MessageJoin)
+	readUntil(t, bob, room.MessageJoin)
+
+	if err := alice.WriteJSON(room.Command{Type: room.MessageTypingStart}); err != nil {
+		t.Fatalf("Failed to send command: %s", err)
+	}
+	readUntil(t, bob, room.MessageTypingStart)
+	started := time.Now()
+
+	// Alice goes quiet, the server clears her indicator
+	msg := readUntil(t, bob, room.MessageTypingStop)
+	if msg.UserID != "1" || msg.Username != "user1" {
+		t.Errorf("got %s (%s), want %s (%s)", msg.UserID, msg.Username, "1", "user1")
+	}
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond {
+		t.Errorf("expired after %s, want about 300ms", elapsed)
+	}
+}
+
+func TestHandlerMultipleConnections(t *testing.T) {
+	roomSvc, roomID, url := newTestRoomServer(t)
+
+	aliceTab1 := dialRoom(t, url, "1")
+	readUntil(t, aliceTab1, room.MessageJoin)
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+	aliceTab2 := dialRoom(t, url, "1")
+
+	// Bob's message is the next thing he sees, no join for the second tab
+	if err := bob.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	if msg := readUntil(t, bob, room.MessageText); msg.Content != "hi" {
+		t.Errorf("got %s, want %s", msg.Content, "hi")
+	}
+	for _, tab := range []*websocket.Conn{aliceTab1, aliceTab2} {
+		if msg := readUntil(t, tab, room.MessageText); msg.Content != "hi" {
+			t.Errorf("got %s, want %s", msg.Content, "hi")
+		}
+	}
+
+	clients, _ := roomSvc.GetClients(context.Background(), &room.GetClientsReq{CallerID: "1", RoomID: roomID})
+	if len(clients) != 2 {
+		t.Errorf("got %d clients, want %d", len(clients), 2)
+	}
+
+	tests := []struct {
+		name      string
+		tab       *websocket.Conn
+		wantLeave bool
+	}{
+		{"Closing one tab keeps user in the room", aliceTab1, false},
+		{"Closing the last tab leaves the room", aliceTab2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.tab.Close()
+			time.Sleep(100 * time.Millisecond)
+
+			if err := bob.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+				t.Fatalf("Failed to send message: %s", err)
+			}
+
+			_ = bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+			msg := &room.Message{}
+			if err := bob.ReadJSON(msg); err != nil {
+				t.Fatalf("Failed to read message: %s", err)
+			}
+			if (msg.Type == room.MessageLeave) != test.wantLeave {
+				t.Errorf("got %s message, want leave %t", msg.Type, test.wantLeave)
+			}
+		})
+	}
+}
+
+func TestHandlerMentions(t *testing.T) {
+	notifier := &testNotifier{}
+	roomSvc, roomID, url := newTestRoomServerWithNotifier(t, notifier)
+
+	random, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "random"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+	// Carol is only connected to another room
+	carol := dialRoom(t, strings.Replace(url, roomID, random.ID, 1), "3")
+	readUntil(t, carol, room.MessageJoin)
+
+	if err := alice.WriteMessage(websocket.TextMessage, []byte("hi @user3, @user4 and @user1.")); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+
+	msg := readUntil(t, carol, room.MessageMention)
+	if msg.RoomID != roomID || msg.Content != "hi @user3, @user4 and @user1." {
+		t.Errorf("got %#v, want mention from room %s", msg, roomID)
+	}
+
+	// Only Dave is offline and gets notified, right after the mention went out
+	sent := notifier.Sent()
+	for deadline := time.Now().Add(time.Second); len(sent) == 0 && time.Now().Before(deadline); sent = notifier.Sent() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(sent) != 1 || sent[0].UserID != "4" || sent[0].Kind != notification.KindMention {
+		t.Errorf("got %d notifications, want a mention for user 4", len(sent))
+	}
+
+	// The author is not notified about mentioning themselves
+	_ = alice.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		msg := &room.Message{}
+		if err := alice.ReadJSON(msg); err != nil {
+			break
+		}
+		if msg.Type == room.MessageMention {
+			t.Errorf("got own mention")
+		}
+	}
+}
+
+// Fails to store mentions, the messages themselves are stored
+type failingMentionsRepository struct {
+	*testRepository
+}
+
+func (r *failingMentionsRepository) CreateMentions(ctx context.Context, msg *room.Message, userIDs []string) error {
+	return errors.New("mentions are unavailable")
+}
+
+func TestHandlerMentionsFailing(t *testing.T) {
+	hub := room.NewHub()
+	repo := &failingMentionsRepository{&testRepository{room.NewRepository(hub, nil)}}
+	_, _, url := newTestRoomServerWith(t, hub, repo, &testNotifier{})
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	// The message went out, so it is acked instead of failing and being resent
+	if err := alice.WriteJSON(room.Command{Type: room.MessageText, ClientID: "c1", Content: "hi @user2"}); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	sent := readUntil(t, bob, room.MessageText)
+	_ = alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		msg := &room.Message{}
+		if err := alice.ReadJSON(msg); err != nil {
+			t.Fatalf("Failed to read ack: %s", err)
+		}
+		if msg.Type == room.MessageError {
+			t.Fatalf("got error %q, want ack", msg.Content)
+		}
+		if msg.Type == room.MessageAck {
+			if msg.ID != sent.ID {
+				t.Errorf("got ack for %s, want %s", msg.ID, sent.ID)
+			}
+			break
+		}
+	}
+}
+
+// Keeps attachments in memory on top of the test repository. Inserts fail
+// with err when set, or when the context is done like they would in the DB.
+type attachmentRepository struct {
+	*testRepository
+	mu          sync.Mutex
+	attachments map[string]*room.Attachment
+	err         error
+}
+
+func (r *attachmentRepository) CreateAttachment(ctx context.Context, a *room.Attachment) (*room.Attachment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.attachments[a.ID] = a
+	return a, nil
+}
+
+func (r *attachmentRepository) GetAttachment(ctx context.Context, id string) (*room.Attachment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.attachments[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	copied := *a
+	return &copied, nil
+}
+
+// Takes its time to store each blob
+type slowBlobStore struct {
+	room.BlobStore
+	delay time.Duration
+}
+
+func (s *slowBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	time.Sleep(s.delay)
+	return s.BlobStore.Put(ctx, key, r)
+}
+
+func TestHandlerAttachments(t *testing.T) {
+	cfg := config.New()
+	cfg.DBTimeout = 200 * time.Millisecond
+	hub := room.NewHub()
+	dir := t.TempDir()
+	disk, err := room.NewDiskBlobStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %s", err)
+	}
+	blobs := &slowBlobStore{BlobStore: disk}
+	repo := &attachmentRepository{
+		testRepository: &testRepository{room.NewRepository(hub, nil)},
+		attachments:    make(map[string]*room.Attachment),
+	}
+	roomSvc := room.NewService(repo, cfg, validator.New(), hub, &testNotifier{}, blobs)
+	roomHdl := room.NewHandler(roomSvc, cfg)
+
+	general, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "general"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(user.ContextUserID, c.GetHeader("X-User")) })
+	r.POST("/rooms/:roomId/attachments", roomHdl.UploadAttachments)
+	r.GET("/rooms/:roomId/attachments/:attachmentId", roomHdl.GetAttachment)
+
+	photo := &bytes.Buffer{}
+	_ = png.Encode(photo, image.NewRGBA(image.Rect(0, 0, 640, 480)))
+
+	type file struct {
+		name string
+		data []byte
+	}
+	upload := func(files ...file) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		for _, f := range files {
+			part, _ := form.CreateFormFile("file", f.name)
+			_, _ = part.Write(f.data)
+		}
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/rooms/"+general.ID+"/attachments", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-User", "1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Disallowed type", func(t *testing.T) {
+		if w := upload(file{"page.png", []byte("<html><script>alert(1)</script></html>")}); w.Code != http.StatusBadRequest {
+			t.Errorf("got %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+
+	// Stored files of a failed upload are removed again
+	stored := func(t *testing.T) int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Failed to read blob store: %s", err)
+		}
+		return len(entries)
+	}
+	t.Run("Failed upload leaves no files", func(t *testing.T) {
+		if w := upload(file{"photo.png", photo.Bytes()}, file{"page.png", []byte("<html></html>")}); w.Code != http.StatusBadRequest {
+			t.Errorf("got %d, want %d", w.Code, http.StatusBadRequest)
+		}
+		if n := stored(t); n != 0 {
+			t.Errorf("got %d files after a disallowed file, want none", n)
+		}
+
+		repo.mu.Lock()
+		repo.err = errors.New("insert failed")
+		repo.mu.Unlock()
+		defer func() {
+			repo.mu.Lock()
+			repo.err = nil
+			repo.mu.Unlock()
+		}()
+		if w := upload(file{"photo.png", photo.Bytes()}); w.Code == http.StatusCreated {
+			t.Errorf("got %d, want an error", w.Code)
+		}
+		if n := stored(t); n != 0 {
+			t.Errorf("got %d files after a failed insert, want none", n)
+		}
+	})
+
+	// Each file with its thumbnail takes longer to store than the DB timeout
+	t.Run("Slow storage", func(t *testing.T) {
+		blobs.delay = 150 * time.Millisecond
+		defer func() { blobs.delay = 0 }()
+
+		if w := upload(file{"photo.png", photo.Bytes()}, file{"copy.png", photo.Bytes()}); w.Code != http.StatusCreated {
+			t.Errorf("got %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+	})
+
+	w := upload(file{"photo.png", photo.Bytes()})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to upload: %s", w.Body)
+	}
+	attachments := []*room.Attachment{}
+	_ = json.Unmarshal(w.Body.Bytes(), &attachments)
+	if len(attachments) != 1 || attachments[0].Width != 640 || attachments[0].ThumbnailURL == "" {
+		t.Fatalf("got %s, want a 640px wide image with thumbnail", w.Body)
+	}
+
+	tests := []struct {
+		name     string
+		userID   string
+		url      string
+		code     int
+		wantSize image.Point
+	}{
+		{"Should download the file", "1", attachments[0].URL, http.StatusOK, image.Pt(640, 480)},
+		{"Should download the thumbnail", "1", attachments[0].ThumbnailURL, http.StatusOK, image.Pt(320, 240)},
+		{"Unsent upload of someone else", "2", attachments[0].URL, http.StatusNotFound, image.Point{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.Header.Set("X-User", test.userID)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != test.code {
+				t.Fatalf("got %d, want %d", w.Code, test.code)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+
+			img, err := png.Decode(w.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode image: %s", err)
+			}
+			if img.Bounds().Size() != test.wantSize {
+				t.Errorf("got %v, want %v", img.Bounds().Size(), test.wantSize)
+			}
+		})
+	}
+}
+
+func TestHandlerResume(t *testing.T) {
+	_, _, url := newTestRoomServer(t)
+
+	alice := dialRoom(t, url, "1")
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	if err := bob.WriteMessage(websocket.TextMessage, []byte("one")); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	last := readUntil(t, alice, room.MessageText)
+	alice.Close()
+	readUntil(t, bob, room.MessageLeave)
+
+	for _, content := range []string{"two", "three"} {
+		if err := bob.WriteMessage(websocket.TextMessage, []byte(content)); err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		readUntil(t, bob, room.MessageText)
+	}
+
+	// Missed messages come before the join of the new connection
+	alice, _, err := websocket.DefaultDialer.Dial(url+"?lastMessageId="+last.ID, wsHeader("1"))
+	if err != nil {
+		t.Fatalf("Failed to rejoin room: %s", err)
+	}
+	defer alice.Close()
+
+	got := make([]string, 0)
+	_ = alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		msg := &room.Message{}
+		if err := alice.ReadJSON(msg); err != nil {
+			t.Fatalf("Failed to read message: %s", err)
+		}
+		if msg.Type == room.MessageJoin {
+			break
+		}
+		got = append(got, msg.Type+" "+msg.Content)
+	}
+
+	want := []string{"message two", "message three"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHandlerResumeSlowClient(t *testing.T) {
+	roomSvc, generalID, url := newTestRoomServer(t)
+
+	alice := dialRoom(t, url, "1")
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	var first *room.Message
+	for i := 0; i < 50; i++ {
+		if err := bob.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		msg := readUntil(t, alice, room.MessageText)
+		if first == nil {
+			first = msg
+		}
+	}
+
+	// Resumes without ever reading what it missed
+	stream, err := roomSvc.OpenStream(context.Background(), &room.OpenStreamReq{CallerID: "3", Username: "user3", RoomID: generalID, LastMessageID: first.ID})
+	if err != nil {
+		t.Fatalf("Failed to open stream: %s", err)
+	}
+	defer stream.Close()
+
+	if err := bob.WriteMessage(websocket.TextMessage, []byte("still live")); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	if msg := readUntil(t, alice, room.MessageText); msg.Content != "still live" {
+		t.Errorf("got %s, want %s", msg.Content, "still live")
+	}
+
+	// The replay comes first, then what was sent meanwhile
+	got := make([]string, 0)
+	for msg := range stream.Message {
+		if msg.Type == room.MessageText {
+			got = append(got, msg.Content)
+		}
+		if msg.Content == "still live" {
+			break
+		}
+	}
+	if len(got) != 50 || got[0] != "1" || got[48] != "49" {
+		t.Errorf("got %d messages from %v, want 1 to 49 and still live", len(got), got[:1])
+	}
+}
+
+// History with as many messages as asked for after any ID
+type historyRepository struct {
+	*testRepository
+	size int
+}
+
+func (r *historyRepository) GetMessagesAfter(ctx context.Context, roomID string, after string, from *time.Time, to *time.Time, limit int) ([]*room.Message, error) {
+	messages := make([]*room.Message, 0)
+	for i := 1; i <= r.size && i <= limit; i++ {
+		messages = append(messages, &room.Message{
+			ID:      after + strings.Repeat("0", i),
+			Type:    room.MessageText,
+			Content: "missed",
+			RoomID:  roomID,
+		})
+	}
+	return messages, nil
+}
+
+func (r *historyRepository) GetReactions(ctx context.Context, messageIDs []string) (map[string][]room.Reaction, error) {
+	return map[string][]room.Reaction{}, nil
+}
+
+func (r *historyRepository) GetAttachments(ctx context.Context, messageIDs []string) (map[string][]*room.Attachment, error) {
+	return map[string][]*room.Attachment{}, nil
+}
+
+func TestHandlerResumeFromHistory(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want []string
+	}{
+		{"Nothing missed", 0, []string{}},
+		{"Missed messages are replayed", 2, []string{"message missed", "message missed"}},
+		{"Too many missed messages", 1000, []string{"resync Too many missed messages, refetch history"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hub := room.NewHub()
+			repo := &historyRepository{testRepository: &testRepository{room.NewRepository(hub, nil)}, size: test.size}
+			_, _, url := newTestRoomServerWith(t, hub, repo, &testNotifier{})
+
+			conn, _, err := websocket.DefaultDialer.Dial(url+"?lastMessageId=01", wsHeader("1"))
+			if err != nil {
+				t.Fatalf("Failed to join room: %s", err)
+			}
+			defer conn.Close()
+
+			got := make([]string, 0)
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for {
+				msg := &room.Message{}
+				if err := conn.ReadJSON(msg); err != nil {
+					t.Fatalf("Failed to read message: %s", err)
+				}
+				if msg.Type == room.MessageJoin {
+					break
+				}
+				got = append(got, msg.Type+" "+msg.Content)
+			}
+
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandlerAcks(t *testing.T) {
+	_, _, url := newTestRoomServer(t)
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	send := room.Command{Type: room.MessageText, ClientID: "c1", Content: "hi"}
+	if err := alice.WriteJSON(send); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	sent := readUntil(t, bob, room.MessageText)
+	ack := readUntil(t, alice, room.MessageAck)
+	if ack.ClientID != "c1" || ack.ID != sent.ID {
+		t.Errorf("got ack %s for %s, want %s for %s", ack.ID, ack.ClientID, sent.ID, "c1")
+	}
+
+	// The resent message is acked again but not sent twice
+	if err := alice.WriteJSON(send); err != nil {
+		t.Fatalf("Failed to resend message: %s", err)
+	}
+	if again := readUntil(t, alice, room.MessageAck); again.ID != ack.ID {
+		t.Errorf("got %s, want %s", again.ID, ack.ID)
+	}
+	if err := alice.WriteJSON(room.Command{Type: room.MessageText, ClientID: "c2", Content: "bye"}); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	if next := readUntil(t, bob, room.MessageText); next.Content != "bye" {
+		t.Errorf("got %s, want %s", next.Content, "bye")
+	}
+
+	t.Run("Errors carry the client ID", func(t *testing.T) {
+		if err := alice.WriteJSON(room.Command{Type: "unknown", ClientID: "c3"}); err != nil {
+			t.Fatalf("Failed to send command: %s", err)
+		}
+		if msg := readUntil(t, alice, room.MessageError); msg.ClientID != "c3" {
+			t.Errorf("got %s, want %s", msg.ClientID, "c3")
+		}
+	})
+
+	t.Run("Messages are numbered per connection", func(t *testing.T) {
+		if err := bob.WriteMessage(websocket.TextMessage, []byte("numbered")); err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		first := readUntil(t, bob, room.MessageText)
+		if err := bob.WriteMessage(websocket.TextMessage, []byte("numbered")); err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		second := readUntil(t, bob, room.MessageText)
+		if first.Seq == 0 || second.Seq != first.Seq+1 {
+			t.Errorf("got seq %d then %d, want consecutive numbers", first.Seq, second.Seq)
+		}
+	})
+}
+
+// Holds messages back until released, counting how many were created
+type blockingRepository struct {
+	*testRepository
+	created atomic.Int32
+	release chan struct{}
+}
+
+func (r *blockingRepository) CreateMessage(ctx context.Context, msg *room.Message) (*room.Message, error) {
+	r.created.Add(1)
+	<-r.release
+	return msg, nil
+}
+
+func TestHandlerAckConcurrentResend(t *testing.T) {
+	hub := room.NewHub()
+	repo := &blockingRepository{testRepository: &testRepository{room.NewRepository(hub, nil)}, release: make(chan struct{})}
+	_, _, url := newTestRoomServerWith(t, hub, repo, &testNotifier{})
+
+	// The same command resent over a second connection while the first is still running
+	first := dialRoom(t, url, "1")
+	readUntil(t, first, room.MessageJoin)
+	second := dialRoom(t, url, "1")
+
+	send := room.Command{Type: room.MessageText, ClientID: "c1", Content: "hi"}
+	if err := first.WriteJSON(send); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	if err := second.WriteJSON(send); err != nil {
+		t.Fatalf("Failed to resend message: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(repo.release)
+
+	ack := readUntil(t, first, room.MessageAck)
+	again := readUntil(t, second, room.MessageAck)
+	if again.ID != ack.ID {
+		t.Errorf("got ack %s, want %s", again.ID, ack.ID)
+	}
+	if created := repo.created.Load(); created != 1 {
+		t.Errorf("got %d messages created, want 1", created)
+	}
+}
+
+func TestHandlerEditDelete(t *testing.T) {
+	hub := room.NewHub()
+	repo := newMessageRepository(hub)
+	roomSvc, generalID, url := newTestRoomServerWith(t, hub, repo, &testNotifier{})
+	moderated, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{OwnerID: "1", Name: "moderated"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+	url = strings.Replace(url, generalID, moderated.ID, 1)
+
+	// Alice owns the room, so she moderates it
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+	carol := dialRoom(t, url, "3")
+	readUntil(t, carol, room.MessageJoin)
+
+	send := func(conn *websocket.Conn, cmd room.Command) {
+		if err := conn.WriteJSON(cmd); err != nil {
+			t.Fatalf("Failed to send command: %s", err)
+		}
+	}
+	fails := func(t *testing.T, conn *websocket.Conn, cmd room.Command, want string) {
+		send(conn, cmd)
+		if msg := readUntil(t, conn, room.MessageError); msg.ClientID != cmd.ClientID || msg.Content != want {
+			t.Errorf("got error %q for %s, want %q for %s", msg.Content, msg.ClientID, want, cmd.ClientID)
+		}
+	}
+
+	var ids []string
+	for _, content := range []string{"first", "second", "third"} {
+		send(bob, room.Command{Type: room.MessageText, Content: content})
+		ids = append(ids, readUntil(t, carol, room.MessageText).ID)
+	}
+
+	// Sent before the edit window, 15 minutes by default
+	old, _ := repo.CreateMessage(context.Background(), &room.Message{
+		ID:        ulid.Make().String(),
+		Type:      room.MessageText,
+		Content:   "old",
+		RoomID:    moderated.ID,
+		UserID:    "2",
+		Username:  "user2",
+		CreatedAt: time.Now().UTC().Add(-time.Hour),
+	})
+
+	t.Run("Author edits within the window", func(t *testing.T) {
+		send(bob, room.Command{Type: room.MessageEdit, ID: ids[0], Content: "first, edited"})
+		msg := readUntil(t, carol, room.MessageEdit)
+		if msg.ID != ids[0] || msg.Content != "first, edited" || msg.EditedAt == nil {
+			t.Errorf("got edit of %s to %q at %v, want %s edited to %q", msg.ID, msg.Content, msg.EditedAt, ids[0], "first, edited")
+		}
+	})
+
+	t.Run("Only the author edits", func(t *testing.T) {
+		fails(t, alice, room.Command{Type: room.MessageEdit, ClientID: "e1", ID: ids[1], Content: "edited"}, "Only the author can edit a message")
+	})
+
+	t.Run("Edit window", func(t *testing.T) {
+		fails(t, bob, room.Command{Type: room.MessageEdit, ClientID: "e2", ID: old.ID, Content: "edited"}, "Message can no longer be edited")
+	})
+
+	t.Run("Edit history", func(t *testing.T) {
+		for _, userID := range []string{"1", "2"} {
+			edits, err := roomSvc.GetMessageEdits(context.Background(), &room.GetMessageEditsReq{CallerID: userID, RoomID: moderated.ID, MessageID: ids[0]})
+			if err != nil {
+				t.Fatalf("Failed to get edits for user %s: %s", userID, err)
+			}
+			if len(edits) != 1 || edits[0].Content != "first" {
+				t.Errorf("got %+v for user %s, want the original content", edits, userID)
+			}
+		}
+
+		_, err := roomSvc.GetMessageEdits(context.Background(), &room.GetMessageEditsReq{CallerID: "3", RoomID: moderated.ID, MessageID: ids[0]})
+		if err == nil {
+			t.Error("got edits for another member, want error")
+		}
+	})
+
+	t.Run("Only the author or a moderator deletes", func(t *testing.T) {
+		fails(t, carol, room.Command{Type: room.MessageDelete, ClientID: "d1", ID: ids[1]}, "Only the author or a moderator can delete a message")
+
+		// Bob deletes his second message, Alice moderates away the third
+		for i, conn := range []*websocket.Conn{bob, alice} {
+			id := ids[i+1]
+			send(conn, room.Command{Type: room.MessageDelete, ID: id})
+			msg := readUntil(t, carol, room.MessageDelete)
+			if msg.ID != id || !msg.Deleted || msg.Content != "" {
+				t.Errorf("got delete of %s, deleted %t with %q, want %s deleted without content", msg.ID, msg.Deleted, msg.Content, id)
+			}
+		}
+	})
+
+	t.Run("Deleted messages can't be changed", func(t *testing.T) {
+		send(bob, room.Command{Type: room.MessageText, Content: "gone"})
+		gone := readUntil(t, carol, room.MessageText).ID
+		send(bob, room.Command{Type: room.MessageDelete, ID: gone})
+		readUntil(t, carol, room.MessageDelete)
+
+		fails(t, bob, room.Command{Type: room.MessageEdit, ClientID: "e3", ID: gone, Content: "edited"}, "Message does not exist")
+	})
+
+	t.Run("History marks edited and deleted messages", func(t *testing.T) {
+		messages, err := roomSvc.GetMessages(context.Background(), &room.GetMessagesReq{CallerID: "3", RoomID: moderated.ID})
+		if err != nil {
+			t.Fatalf("Failed to get messages: %s", err)
+		}
+
+		got := make([]string, 0)
+		for _, msg := range messages {
+			got = append(got, fmt.Sprintf("%q edited=%t deleted=%t", msg.Content, msg.EditedAt != nil, msg.Deleted))
+		}
+		want := []string{
+			`"first, edited" edited=true deleted=false`,
+			`"" edited=false deleted=true`,
+			`"" edited=false deleted=true`,
+			`"old" edited=false deleted=false`,
+			`"" edited=false deleted=true`,
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("history mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// Pretends every message of the rooms with a policy expired
+type pruneRepository struct {
+	*messageRepository
+	policies []*room.RetentionPolicy
+}
+
+func (r *pruneRepository) GetRetentionPolicies(ctx context.Context) ([]*room.RetentionPolicy, error) {
+	return r.policies, nil
+}
+
+func (r *pruneRepository) PruneMessages(ctx context.Context, roomID string, cutoff *time.Time, maxCount int, limit int, archive bool) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]string, 0)
+	for id, msg := range r.messages {
+		if msg.RoomID == roomID && len(ids) < limit {
+			delete(r.messages, id)
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *pruneRepository) DeleteAttachments(ctx context.Context, messageIDs []string) ([]*room.Attachment, error) {
+	return []*room.Attachment{}, nil
+}
+
+func (r *pruneRepository) CreateRetentionRun(ctx context.Context, run *room.RetentionRun) (*room.RetentionRun, error) {
+	return run, nil
+}
+
+func TestHandlerPrunedMessages(t *testing.T) {
+	hub := room.NewHub()
+	repo := &pruneRepository{messageRepository: newMessageRepository(hub)}
+	roomSvc, generalID, url := newTestRoomServerWith(t, hub, repo, &testNotifier{})
+	direct, err := roomSvc.CreateDirect(context.Background(), &room.CreateDirectReq{CallerID: "1", UserID: "2"})
+	if err != nil {
+		t.Fatalf("Failed to create direct room: %s", err)
+	}
+	url = strings.Replace(url, generalID, direct.ID, 1)
+	maxAgeDays := 1
+	repo.policies = []*room.RetentionPolicy{{RoomID: direct.ID, MaxAgeDays: &maxAgeDays}}
+
+	alice := dialRoom(t, url, "1")
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	for _, content := range []string{"one", "two", "three"} {
+		if err := bob.WriteMessage(websocket.TextMessage, []byte(content)); err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+	}
+	first := readUntil(t, alice, room.MessageText)
+	readUntil(t, alice, room.MessageText)
+	readUntil(t, alice, room.MessageText)
+	alice.Close()
+	readUntil(t, bob, room.MessageLeave)
+
+	if _, err := roomSvc.PruneExpired(context.Background()); err != nil {
+		t.Fatalf("Failed to prune: %s", err)
+	}
+
+	t.Run("Not listed as the last message", func(t *testing.T) {
+		directs, err := roomSvc.GetDirects(context.Background(), &room.GetDirectsReq{UserID: "1"})
+		if err != nil {
+			t.Fatalf("Failed to get directs: %s", err)
+		}
+		if len(directs) != 1 || directs[0].LastMessage != nil {
+			t.Errorf("got %+v, want the direct room without a last message", directs)
+		}
+	})
+
+	t.Run("Not replayed", func(t *testing.T) {
+		alice, _, err := websocket.DefaultDialer.Dial(url+"?lastMessageId="+first.ID, wsHeader("1"))
+		if err != nil {
+			t.Fatalf("Failed to rejoin room: %s", err)
+		}
+		defer alice.Close()
+
+		_ = alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			msg := &room.Message{}
+			if err := alice.ReadJSON(msg); err != nil {
+				t.Fatalf("Failed to read message: %s", err)
+			}
+			if msg.Type == room.MessageJoin {
+				break
+			}
+			if msg.Type == room.MessageText {
+				t.Errorf("got pruned message %q, want none", msg.Content)
+			}
+		}
+	})
+}
+
+func TestHandlerMuted(t *testing.T) {
+	roomSvc, generalID, url := newTestRoomServer(t)
+	moderated, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{OwnerID: "1", Name: "moderated"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+	url = strings.Replace(url, generalID, moderated.ID, 1)
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	if err := alice.WriteJSON(room.Command{Type: room.MessageMute, UserID: "2"}); err != nil {
+		t.Fatalf("Failed to send command: %s", err)
+	}
+	// Names the muted user and the moderator
+	muted := readUntil(t, bob, room.MessageMute)
+	got := []string{muted.UserID, muted.Username, muted.ActorID, muted.ActorName}
+	if want := []string{"2", "user2", "1", "user1"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	tests := []room.Command{
+		{Type: room.MessageText, ClientID: "c1", Content: "hi"},
+		{Type: room.MessageEdit, ClientID: "c2", ID: "01", Content: "edited"},
+		{Type: room.MessageReact, ClientID: "c3", ID: "01", Emoji: "👍"},
+		{Type: room.MessageUnreact, ClientID: "c4", ID: "01", Emoji: "👍"},
+		{Type: room.MessageTypingStart, ClientID: "c5"},
+	}
+	for _, cmd := range tests {
+		t.Run(cmd.Type, func(t *testing.T) {
+			if err := bob.WriteJSON(cmd); err != nil {
+				t.Fatalf("Failed to send command: %s", err)
+			}
+			msg := readUntil(t, bob, room.MessageError)
+			if msg.ClientID != cmd.ClientID || msg.Content != "You are muted in this room" {
+				t.Errorf("got error %q for %s, want muted error for %s", msg.Content, msg.ClientID, cmd.ClientID)
+			}
+		})
+	}
+}
+
+func TestHandlerThreads(t *testing.T) {
+	hub := room.NewHub()
+	repo := &banRepository{Repository: newMessageRepository(hub)}
+	roomSvc, generalID, url := newTestRoomServerWith(t, hub, repo, &testNotifier{})
+	repo.banned = map[[2]string]bool{{generalID, "4"}: true}
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+	carol := dialRoom(t, url, "3")
+	readUntil(t, carol, room.MessageJoin)
+
+	send := func(conn *websocket.Conn, cmd room.Command) {
+		if err := conn.WriteJSON(cmd); err != nil {
+			t.Fatalf("Failed to send command: %s", err)
+		}
+	}
+
+	send(alice, room.Command{Type: room.MessageText, Content: "root"})
+	root := readUntil(t, carol, room.MessageText)
+	readUntil(t, alice, room.MessageText)
+
+	// Bob's reply subscribes him and the author of the root, Carol only sees the counts
+	replies := make([]*room.Message, 0)
+	for i, conn := range []*websocket.Conn{bob, alice} {
+		send(conn, room.Command{Type: room.MessageText, Content: "reply", ParentID: root.ID})
+		reply := readUntil(t, alice, room.MessageText)
+		if reply.ParentID != root.ID {
+			t.Fatalf("got parent %q, want %q", reply.ParentID, root.ID)
+		}
+		replies = append(replies, reply)
+
+		thread := readUntil(t, carol, room.MessageThread)
+		if thread.ID != root.ID || thread.ReplyCount != i+1 || thread.LastReplyAt == nil || !thread.LastReplyAt.Equal(reply.CreatedAt) {
+			t.Errorf("got %d replies at %v, want %d at %v", thread.ReplyCount, thread.LastReplyAt, i+1, reply.CreatedAt)
+		}
+	}
+
+	t.Run("Thread history", func(t *testing.T) {
+		res, err := roomSvc.GetThread(context.Background(), &room.GetThreadReq{CallerID: "3", RoomID: generalID, MessageID: root.ID})
+		if err != nil {
+			t.Fatalf("Failed to get thread: %s", err)
+		}
+		if res.Parent.ReplyCount != 2 || res.Parent.LastReplyAt == nil || !res.Parent.LastReplyAt.Equal(replies[1].CreatedAt) {
+			t.Errorf("got %d replies at %v, want %d at %v", res.Parent.ReplyCount, res.Parent.LastReplyAt, 2, replies[1].CreatedAt)
+		}
+		got := make([]string, 0)
+		for _, reply := range res.Replies {
+			got = append(got, reply.ID)
+		}
+		if diff := cmp.Diff([]string{replies[0].ID, replies[1].ID}, got); diff != "" {
+			t.Errorf("replies mismatch (-want +got):\n%s", diff)
+		}
+
+		after, err := roomSvc.GetThread(context.Background(), &room.GetThreadReq{CallerID: "3", RoomID: generalID, MessageID: root.ID, After: replies[0].ID})
+		if err != nil {
+			t.Fatalf("Failed to get thread: %s", err)
+		}
+		if len(after.Replies) != 1 || after.Replies[0].ID != replies[1].ID {
+			t.Errorf("got %d replies after the first, want only %s", len(after.Replies), replies[1].ID)
+		}
+
+		if _, err := roomSvc.GetThread(context.Background(), &room.GetThreadReq{CallerID: "3", RoomID: generalID, MessageID: replies[0].ID}); err == nil {
+			t.Error("got thread of a reply, want error")
+		}
+		if _, err := roomSvc.GetThread(context.Background(), &room.GetThreadReq{CallerID: "4", RoomID: generalID, MessageID: root.ID}); err == nil {
+			t.Error("got thread for a banned user, want error")
+		}
+	})
+
+	t.Run("Changes to replies go to subscribers", func(t *testing.T) {
+		reply := replies[0].ID
+		send(bob, room.Command{Type: room.MessageEdit, ID: reply, Content: "edited"})
+		send(bob, room.Command{Type: room.MessageReact, ID: reply, Emoji: "👍"})
+		send(bob, room.Command{Type: room.MessageDelete, ID: reply})
+		for _, msgType := range []string{room.MessageEdit, room.MessageReact, room.MessageDelete} {
+			if msg := readUntil(t, alice, msgType); msg.ID != reply {
+				t.Errorf("got %s of %s, want %s", msgType, msg.ID, reply)
+			}
+		}
+
+		// Carol's next message is the marker, nothing about the thread comes before it
+		send(alice, room.Command{Type: room.MessageText, Content: "marker"})
+		_ = carol.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			msg := &room.Message{}
+			if err := carol.ReadJSON(msg); err != nil {
+				t.Fatalf("Failed to read message: %s", err)
+			}
+			if msg.Type == room.MessageText && msg.Content == "marker" {
+				break
+			}
+			if msg.ID == reply || msg.ParentID != "" {
+				t.Errorf("got %s of a reply, want none", msg.Type)
+			}
+		}
+	})
+}
+
+func TestHandlerReactions(t *testing.T) {
+	hub := room.NewHub()
+	roomSvc, generalID, url := newTestRoomServerWith(t, hub, newMessageRepository(hub), &testNotifier{})
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	if err := alice.WriteJSON(room.Command{Type: room.MessageText, Content: "react to me"}); err != nil {
+		t.Fatalf("Failed to send message: %s", err)
+	}
+	msg := readUntil(t, bob, room.MessageText)
+
+	tests := []struct {
+		name  string
+		conn  *websocket.Conn
+		cmd   string
+		emoji string
+		count int
+	}{
+		{"First reaction", alice, room.MessageReact, "👍", 1},
+		{"Same emoji adds up", bob, room.MessageReact, "👍", 2},
+		{"Reacting twice counts once", bob, room.MessageReact, "👍", 2},
+		{"Other emoji counts apart", bob, room.MessageReact, "🇳🇱", 1},
+		{"Sequence emoji", alice, room.MessageReact, "👩🏽‍💻", 1},
+		{"Unreact", alice, room.MessageUnreact, "👍", 1},
+		{"Count of 0 is sent", alice, room.MessageUnreact, "👩🏽‍💻", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.conn.WriteJSON(room.Command{Type: test.cmd, ID: msg.ID, Emoji: test.emoji}); err != nil {
+				t.Fatalf("Failed to send command: %s", err)
+			}
+			got := readUntil(t, bob, test.cmd)
+			if got.ID != msg.ID || got.Emoji != test.emoji || got.Count == nil || *got.Count != test.count {
+				t.Errorf("got %s of %s with count %v, want %s with %d", got.Emoji, got.ID, got.Count, test.emoji, test.count)
+			}
+		})
+	}
+
+	t.Run("Only single emojis", func(t *testing.T) {
+		for _, emoji := range []string{"", "a", "ok", "👍👍", "👍a", "🇳", "1", "👩‍"} {
+			if err := alice.WriteJSON(room.Command{Type: room.MessageReact, ClientID: "invalid", ID: msg.ID, Emoji: emoji}); err != nil {
+				t.Fatalf("Failed to send command: %s", err)
+			}
+			if got := readUntil(t, alice, room.MessageError); got.Content != "Reaction must be a single emoji" {
+				t.Errorf("got %q for %q, want invalid emoji error", got.Content, emoji)
+			}
+		}
+	})
+
+	t.Run("History has the reactions", func(t *testing.T) {
+		messages, err := roomSvc.GetMessages(context.Background(), &room.GetMessagesReq{CallerID: "2", RoomID: generalID})
+		if err != nil {
+			t.Fatalf("Failed to get messages: %s", err)
+		}
+		if len(messages) != 1 {
+			t.Fatalf("got %d messages, want %d", len(messages), 1)
+		}
+		want := []room.Reaction{
+			{Emoji: "👍", Count: 1, UserIDs: []string{"2"}},
+			{Emoji: "🇳🇱", Count: 1, UserIDs: []string{"2"}},
+		}
+		if diff := cmp.Diff(want, messages[0].Reactions); diff != "" {
+			t.Errorf("reactions mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestHandlerGroup(t *testing.T) {
+	roomSvc, generalID, url := newTestRoomServer(t)
+	group, err := roomSvc.CreateGroup(context.Background(), &room.CreateGroupReq{CallerID: "1", UserIDs: []string{"2", "3"}})
+	if err != nil {
+		t.Fatalf("Failed to create group: %s", err)
+	}
+
+	alice := dialRoom(t, strings.Replace(url, generalID, group.ID, 1), "1")
+	readUntil(t, alice, room.MessageJoin)
+
+	t.Run("Member add names the added user and who added them", func(t *testing.T) {
+		err := roomSvc.AddGroupMember(context.Background(), &room.AddGroupMemberReq{CallerID: "2", Username: "user2", RoomID: group.ID, UserID: "4"})
+		if err != nil {
+			t.Fatalf("Failed to add member: %s", err)
+		}
+
+		msg := readUntil(t, alice, room.MessageMemberAdd)
+		got := []string{msg.UserID, msg.Username, msg.ActorID, msg.ActorName}
+		if want := []string{"4", "user4", "2", "user2"}; !cmp.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Last member leaving closes the group's connections", func(t *testing.T) {
+		for _, userID := range []string{"2", "3", "4", "1"} {
+			err := roomSvc.LeaveGroup(context.Background(), &room.LeaveGroupReq{CallerID: userID, RoomID: group.ID})
+			if err != nil {
+				t.Fatalf("Failed to leave group: %s", err)
+			}
+		}
+
+		_ = alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, _, err := alice.ReadMessage()
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("got %v, want close %d", err, websocket.CloseGoingAway)
+			}
+			break
+		}
+	})
+}
+
+func TestHandlerReads(t *testing.T) {
+	hub := room.NewHub()
+	repo := &banRepository{Repository: newMessageRepository(hub)}
+	roomSvc, generalID, url := newTestRoomServerWith(t, hub, repo, &testNotifier{})
+	repo.banned = map[[2]string]bool{{generalID, "3"}: true}
+
+	alice := dialRoom(t, url, "1")
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	// Acked once the mentions are stored
+	for i, content := range []string{"hi", "hello @user1"} {
+		clientID := strconv.Itoa(i)
+		if err := bob.WriteJSON(room.Command{Type: room.MessageText, ClientID: clientID, Content: content}); err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		if msg := readUntil(t, bob, room.MessageAck); msg.ClientID != clientID {
+			t.Fatalf("got ack of %s, want %s", msg.ClientID, clientID)
+		}
+	}
+	first := readUntil(t, alice, room.MessageText)
+	second := readUntil(t, alice, room.MessageText)
+
+	counts := func(t *testing.T, userID string) room.GetRoomsRes {
+		rooms, err := roomSvc.GetRooms(context.Background(), &room.GetRoomsReq{CallerID: userID})
+		if err != nil {
+			t.Fatalf("Failed to get rooms: %s", err)
+		}
+		for _, r := range rooms {
+			if r.ID == generalID {
+				return r
+			}
+		}
+		t.Fatalf("Room %s is not listed", generalID)
+		return room.GetRoomsRes{}
+	}
+
+	read := func(t *testing.T, id string) {
+		if err := alice.WriteJSON(room.Command{Type: room.MessageRead, ClientID: id, ID: id}); err != nil {
+			t.Fatalf("Failed to send command: %s", err)
+		}
+		readUntil(t, alice, room.MessageAck)
+	}
+
+	t.Run("Messages of others are unread", func(t *testing.T) {
+		want := []int{2, 1}
+		if got := counts(t, "1"); !cmp.Equal([]int{got.UnreadCount, got.MentionCount}, want) {
+			t.Errorf("got unread %d, mentions %d, want %v", got.UnreadCount, got.MentionCount, want)
+		}
+		if got := counts(t, "2"); got.UnreadCount != 0 || got.MentionCount != 0 {
+			t.Errorf("got unread %d, mentions %d for own messages, want none", got.UnreadCount, got.MentionCount)
+		}
+	})
+
+	t.Run("Read is broadcast to the room", func(t *testing.T) {
+		read(t, first.ID)
+
+		msg := readUntil(t, bob, room.MessageRead)
+		got := []string{msg.ID, msg.UserID, msg.Username}
+		if want := []string{first.ID, "1", "user1"}; !cmp.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		want := []int{1, 1}
+		if got := counts(t, "1"); !cmp.Equal([]int{got.UnreadCount, got.MentionCount}, want) {
+			t.Errorf("got unread %d, mentions %d, want %v", got.UnreadCount, got.MentionCount, want)
+		}
+	})
+
+	getReads := func(t *testing.T, userID string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(url, "ws")+"/reads", nil)
+		req.Header.Set("X-User", userID)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get read positions: %s", err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+
+		return res
+	}
+
+	t.Run("Read positions only move forward", func(t *testing.T) {
+		read(t, second.ID)
+		read(t, first.ID)
+
+		res := getReads(t, "2")
+
+		positions := make([]*room.ReadPosition, 0)
+		if err := json.NewDecoder(res.Body).Decode(&positions); err != nil {
+			t.Fatalf("Failed to decode read positions: %s", err)
+		}
+		if len(positions) != 1 || positions[0].UserID != "1" || positions[0].MessageID != second.ID {
+			t.Errorf("got %+v, want user 1 at %s", positions, second.ID)
+		}
+
+		if got := counts(t, "1"); got.UnreadCount != 0 || got.MentionCount != 0 {
+			t.Errorf("got unread %d, mentions %d, want none", got.UnreadCount, got.MentionCount)
+		}
+	})
+
+	t.Run("Banned users can't see read positions", func(t *testing.T) {
+		if res := getReads(t, "3"); res.StatusCode == http.StatusOK {
+			t.Errorf("got status %d, want an error", res.StatusCode)
+		}
+	})
+}
+
+func TestHandlerSession(t *testing.T) {
+	roomSvc, generalID, url := newTestRoomServer(t)
+	group, err := roomSvc.CreateGroup(context.Background(), &room.CreateGroupReq{CallerID: "1", UserIDs: []string{"2", "3"}})
+	if err != nil {
+		t.Fatalf("Failed to create group: %s", err)
+	}
+
+	bob := dialRoom(t, url, "2")
+	readUntil(t, bob, room.MessageJoin)
+
+	wsURL := strings.Replace(url, "/rooms/"+generalID, "/ws", 1)
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL, wsHeader("1"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer alice.Close()
+
+	send := func(cmd room.Command) {
+		if err := alice.WriteJSON(cmd); err != nil {
+			t.Fatalf("Failed to send command: %s", err)
+		}
+	}
+
+	subscribeTests := []struct {
+		name    string
+		roomID  string
+		replied string
+	}{
+		{"Subscribe to a room", generalID, room.MessageAck},
+		{"Subscribe to a group", group.ID, room.MessageAck},
+		{"Subscribe twice", group.ID, room.MessageError},
+		{"Subscribe to an unknown room", "unknown", room.MessageError},
+	}
+	for _, test := range subscribeTests {
+		t.Run(test.name, func(t *testing.T) {
+			send(room.Command{Type: room.MessageSubscribe, ClientID: test.name, RoomID: test.roomID})
+			if msg := readUntil(t, alice, test.replied); msg.ClientID != test.name {
+				t.Errorf("got %s, want %s", msg.ClientID, test.name)
+			}
+		})
+	}
+
+	t.Run("Messages of all rooms arrive on the connection", func(t *testing.T) {
+		if err := bob.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		readUntil(t, bob, room.MessageText)
+		if msg := readUntil(t, alice, room.MessageText); msg.RoomID != generalID || msg.Content != "hi" {
+			t.Errorf("got %q in %s, want %q in %s", msg.Content, msg.RoomID, "hi", generalID)
+		}
+
+		send(room.Command{Type: room.MessageText, RoomID: group.ID, Content: "team"})
+		if msg := readUntil(t, alice, room.MessageText); msg.RoomID != group.ID || msg.Content != "team" {
+			t.Errorf("got %q in %s, want %q in %s", msg.Content, msg.RoomID, "team", group.ID)
+		}
+	})
+
+	t.Run("Commands need a subscribed room", func(t *testing.T) {
+		send(room.Command{Type: room.MessageText, Content: "lost"})
+		if msg := readUntil(t, alice, room.MessageError); msg.Content != "Not subscribed to the room" {
+			t.Errorf("got %s, want %s", msg.Content, "Not subscribed to the room")
+		}
+	})
+
+	t.Run("Leaving a group only unsubscribes from it", func(t *testing.T) {
+		err := roomSvc.LeaveGroup(context.Background(), &room.LeaveGroupReq{CallerID: "1", RoomID: group.ID})
+		if err != nil {
+			t.Fatalf("Failed to leave group: %s", err)
+		}
+		if msg := readUntil(t, alice, room.MessageUnsubscribe); msg.RoomID != group.ID {
+			t.Errorf("got %s, want %s", msg.RoomID, group.ID)
+		}
+
+		send(room.Command{Type: room.MessageText, RoomID: generalID, Content: "still here"})
+		if msg := readUntil(t, bob, room.MessageText); msg.Content != "still here" {
+			t.Errorf("got %s, want %s", msg.Content, "still here")
+		}
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		send(room.Command{Type: room.MessageUnsubscribe, RoomID: generalID})
+		if msg := readUntil(t, bob, room.MessageLeave); msg.UserID != "1" {
+			t.Errorf("got %s, want %s", msg.UserID, "1")
+		}
+	})
+}
+
+type sseEvent struct {
+	id  string
+	msg *room.Message
+}
+
+// Reads server-sent events from the response in the background.
+func readEvents(t *testing.T, res *http.Response) <-chan sseEvent {
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+
+		var event sseEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				event.msg = &room.Message{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event.msg); err != nil {
+					t.Errorf("Failed to decode event: %s", err)
+				}
+			case line == "" && event.msg != nil:
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+
+	return events
+}
+
+func TestHandlerHTTPTransports(t *testing.T) {
+	t.Setenv("LONG_POLL_TIMEOUT", "200ms")
+	_, generalID, url := newTestRoomServer(t)
+	httpURL := "http" + strings.TrimPrefix(url, "ws")
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+
+	streamReq, _ := http.NewRequest(http.MethodGet, httpURL+"/events", nil)
+	streamReq.Header.Set("X-User", "2")
+	stream, err := http.DefaultClient.Do(streamReq)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %s", err)
+	}
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %s, want text/event-stream", ct)
+	}
+	events := readEvents(t, stream)
+
+	poll := func(pollID string, after uint64) (*room.PollRes, int) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/poll?pollId=%s&after=%d", httpURL, pollID, after), nil)
+		req.Header.Set("X-User", "3")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to poll: %s", err)
+		}
+		defer res.Body.Close()
+
+		body := &room.PollRes{}
+		_ = json.NewDecoder(res.Body).Decode(body)
+		return body, res.StatusCode
+	}
+	first, status := poll("", 0)
+	if status != http.StatusOK || first.PollID == "" {
+		t.Fatalf("Failed to start polling: %d", status)
+	}
+
+	post := func(body string) *room.PostCommandRes {
+		req, _ := http.NewRequest(http.MethodPost, httpURL+"/messages", strings.NewReader(body))
+		req.Header.Set("X-User", "2")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to post message: %s", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+		}
+
+		posted := &room.PostCommandRes{}
+		_ = json.NewDecoder(res.Body).Decode(posted)
+		return posted
+	}
+	posted := post(`{"clientId": "c1", "content": "hi"}`)
+
+	t.Run("Websocket receives the posted message", func(t *testing.T) {
+		if msg := readUntil(t, alice, room.MessageText); msg.ID != posted.ID || msg.Content != "hi" {
+			t.Errorf("got %q (%s), want %q (%s)", msg.Content, msg.ID, "hi", posted.ID)
+		}
+	})
+
+	t.Run("Event stream receives the posted message", func(t *testing.T) {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.msg.Type != room.MessageText {
+					continue
+				}
+				if event.id != posted.ID || event.msg.Content != "hi" || event.msg.Seq == 0 {
+					t.Errorf("got %q (%s, seq %d), want %q (%s)", event.msg.Content, event.id, event.msg.Seq, "hi", posted.ID)
+				}
+				return
+			case <-timeout:
+				t.Fatal("No message on the event stream")
+			}
+		}
+	})
+
+	t.Run("Poll receives the posted message", func(t *testing.T) {
+		var after uint64
+		for i := 0; i < 10; i++ {
+			res, status := poll(first.PollID, after)
+			if status != http.StatusOK {
+				t.Fatalf("got status %d, want %d", status, http.StatusOK)
+			}
+			for _, msg := range res.Messages {
+				after = msg.Seq
+				if msg.Type == room.MessageText {
+					if msg.ID != posted.ID {
+						t.Errorf("got %s, want %s", msg.ID, posted.ID)
+					}
+					return
+				}
+			}
+		}
+		t.Fatal("No message in polls")
+	})
+
+	t.Run("Confirmed messages are not sent again", func(t *testing.T) {
+		res, _ := poll(first.PollID, 1<<32)
+		if len(res.Messages) != 0 {
+			t.Errorf("got %d messages, want none", len(res.Messages))
+		}
+	})
+
+	t.Run("Unknown poll", func(t *testing.T) {
+		if _, status := poll("unknown", 0); status != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Resent message is only posted once", func(t *testing.T) {
+		if again := post(`{"clientId": "c1", "content": "hi"}`); again.ID != posted.ID {
+			t.Errorf("got %s, want %s", again.ID, posted.ID)
+		}
+	})
+
+	t.Run("Stream of an unknown room is refused", func(t *testing.T) {
+		res, err := http.Get(httpURL[:strings.LastIndex(httpURL, generalID)] + "unknown/events")
+		if err != nil {
+			t.Fatalf("Failed to open event stream: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+		}
+	})
+}
+
+// Encodes commands and decodes messages of a wire format like a client would.
+type wireFormat struct {
+	encode func(cmd *room.Command) []byte
+	decode func(data []byte) *room.Message
+}
+
+var msgpackHandle = &codec.MsgpackHandle{}
+
+var wireFormats = map[string]wireFormat{
+	room.ProtocolJSON: {
+		encode: func(cmd *room.Command) []byte {
+			data, _ := json.Marshal(cmd)
+			return data
+		},
+		decode: func(data []byte) *room.Message {
+			msg := &room.Message{}
+			_ = json.Unmarshal(data, msg)
+			return msg
+		},
+	},
+	room.ProtocolMsgpack: {
+		encode: func(cmd *room.Command) []byte {
+			var data []byte
+			_ = codec.NewEncoderBytes(&data, msgpackHandle).Encode(cmd)
+			return data
+		},
+		decode: func(data []byte) *room.Message {
+			msg := &room.Message{}
+			_ = codec.NewDecoderBytes(data, msgpackHandle).Decode(msg)
+			return msg
+		},
+	},
+	room.ProtocolProto: {
+		encode: func(cmd *room.Command) []byte {
+			var data []byte
+			for num, v := range map[protowire.Number]string{1: cmd.Type, 2: cmd.ClientID, 7: cmd.Content} {
+				data = protowire.AppendTag(data, num, protowire.BytesType)
+				data = protowire.AppendString(data, v)
+			}
+			return data
+		},
+		// Only the fields the test looks at
+		decode: func(data []byte) *room.Message {
+			msg := &room.Message{}
+			for len(data) > 0 {
+				num, typ, n := protowire.ConsumeTag(data)
+				data = data[n:]
+				switch {
+				case typ == protowire.VarintType && num == 3:
+					msg.Seq, n = protowire.ConsumeVarint(data)
+				case typ == protowire.BytesType && num == 2:
+					msg.Type, n = protowire.ConsumeString(data)
+				case typ == protowire.BytesType && num == 4:
+					msg.ClientID, n = protowire.ConsumeString(data)
+				case typ == protowire.BytesType && num == 5:
+					msg.Content, n = protowire.ConsumeString(data)
+				default:
+					n = protowire.ConsumeFieldValue(num, typ, data)
+				}
+				data = data[n:]
+			}
+			return msg
+		},
+	},
+}
+
+func TestHandlerWireFormats(t *testing.T) {
+	_, _, url := newTestRoomServer(t)
+
+	alice := dialRoom(t, url, "1")
+	readUntil(t, alice, room.MessageJoin)
+
+	tests := []struct {
+		name      string
+		requested []string
+		protocol  string
+		frameType int
+	}{
+		{"No subprotocol", nil, "", websocket.TextMessage},
+		{"Unknown subprotocol", []string{"gochat.xml.v1"}, "", websocket.TextMessage},
+		{"JSON", []string{room.ProtocolJSON}, room.ProtocolJSON, websocket.TextMessage},
+		{"MessagePack", []string{room.ProtocolMsgpack}, room.ProtocolMsgpack, websocket.BinaryMessage},
+		{"Protobuf", []string{room.ProtocolProto}, room.ProtocolProto, websocket.BinaryMessage},
+		{"First supported", []string{"gochat.xml.v1", room.ProtocolProto, room.ProtocolJSON}, room.ProtocolProto, websocket.BinaryMessage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: test.requested}
+			conn, _, err := dialer.Dial(url, wsHeader("2"))
+			if err != nil {
+				t.Fatalf("Failed to join room: %s", err)
+			}
+			defer conn.Close()
+
+			if conn.Subprotocol() != test.protocol {
+				t.Fatalf("got subprotocol %q, want %q", conn.Subprotocol(), test.protocol)
+			}
+			format := wireFormats[test.protocol]
+			if test.protocol == "" {
+				format = wireFormats[room.ProtocolJSON]
+			}
+
+			cmd := &room.Command{Type: room.MessageText, ClientID: test.name, Content: "hi " + test.name}
+			if err := conn.WriteMessage(test.frameType, format.encode(cmd)); err != nil {
+				t.Fatalf("Failed to send command: %s", err)
+			}
+
+			// Everything arrives in the negotiated format, numbered in order
+			var seq uint64
+			var acked, received bool
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for !acked || !received {
+				frameType, data, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatalf("Failed to read message: %s", err)
+				}
+				if frameType != test.frameType {
+					t.Fatalf("got frame type %d, want %d", frameType, test.frameType)
+				}
+
+				msg := format.decode(data)
+				if seq++; msg.Seq != seq {
+					t.Errorf("got seq %d, want %d", msg.Seq, seq)
+				}
+				switch msg.Type {
+				case room.MessageAck:
+					acked = msg.ClientID == test.name
+				case room.MessageText:
+					received = msg.Content == cmd.Content
+				case room.MessageError:
+					t.Fatalf("Command failed: %s", msg.Content)
+				}
+			}
+
+			// Others get the message in their own format
+			if msg := readUntil(t, alice, room.MessageText); msg.Content != cmd.Content {
+				t.Errorf("got %q, want %q", msg.Content, cmd.Content)
+			}
+		})
+	}
+
+	t.Run("Malformed command", func(t *testing.T) {
+		dialer := websocket.Dialer{Subprotocols: []string{room.ProtocolProto}}
+		conn, _, err := dialer.Dial(url, wsHeader("3"))
+		if err != nil {
+			t.Fatalf("Failed to join room: %s", err)
+		}
+		defer conn.Close()
+
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0xff}); err != nil {
+			t.Fatalf("Failed to send command: %s", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read message: %s", err)
+			}
+			if msg := wireFormats[room.ProtocolProto].decode(data); msg.Type == room.MessageError {
+				return
+			}
+		}
+	})
+}
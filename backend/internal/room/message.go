@@ -1,7 +1,122 @@
 package room
 
+import "time"
+
+// Message types
+const (
+	MessageText  = "message"
+	MessageJoin  = "join"
+	MessageLeave = "leave"
+
+	// Group membership events, UserID is the affected member
+	MessageMemberAdd   = "member_add"
+	MessageMemberLeave = "member_leave"
+	MessageRename      = "rename"
+
+	// Moderation events, UserID is the affected user
+	MessageKick         = "kick"
+	MessageBan          = "ban"
+	MessageUnban        = "unban"
+	MessageMute         = "mute"
+	MessageUnmute       = "unmute"
+	MessageModeratorAdd = "moderator_add"
+
+	// Changes of a stored message, ID is the changed message
+	MessageEdit   = "edit"
+	MessageDelete = "delete"
+
+	// Reaction deltas, Count is the new number of Emoji reactions on message ID
+	MessageReact   = "react"
+	MessageUnreact = "unreact"
+
+	// Reply count and last reply time of thread ID changed
+	MessageThread = "thread"
+
+	// Commands to follow or stop following replies to message ID
+	MessageSubscribe   = "subscribe"
+	MessageUnsubscribe = "unsubscribe"
+
+	// Typing indicators, never stored
+	MessageTypingStart = "typing_start"
+	MessageTypingStop  = "typing_stop"
+
+	// UserID has read the room up to message ID
+	MessageRead = "read"
+
+	// Presence Status of UserID changed, also sent by clients to set their status
+	MessagePresence = "presence"
+
+	// Copy of a message mentioning the receiving user, sent to all of their connections
+	MessageMention = "mention"
+
+	// Sent only to the client whose command failed
+	MessageError = "error"
+
+	// Sent to a resuming client which missed too much to catch up, it has to refetch history
+	MessageResync = "resync"
+
+	// Confirms the command with ClientID was handled, ID is the message it created or changed
+	MessageAck = "ack"
+)
+
+// Envelope of everything sent to clients. Chat messages are stored in history
+// and have an ID, UserID is their author. Replies have a ParentID and are
+// only delivered to subscribers of the thread.
 type Message struct {
-	Content  string `json:"content"`
-	RoomID   string `json:"roomId"`
-	Username string `json:"username"`
+	ID        string     `json:"id,omitempty"`
+	Type      string     `json:"type"`
+	Seq       uint64     `json:"seq,omitempty"`      // Numbers messages of a connection, starting at 1
+	ClientID  string     `json:"clientId,omitempty"` // Of the command an ack or error is about
+	Content   string     `json:"content"`
+	RoomID    string     `json:"roomId"`
+	UserID    string     `json:"userId,omitempty"`
+	Username  string     `json:"username"`
+	CreatedAt time.Time  `json:"createdAt"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+
+	ParentID    string     `json:"parentId,omitempty"`
+	ReplyCount  int        `json:"replyCount,omitempty"`
+	LastReplyAt *time.Time `json:"lastReplyAt,omitempty"`
+
+	Attachments []*Attachment `json:"attachments,omitempty"`
+
+	Reactions []Reaction `json:"reactions,omitempty"`
+	Emoji     string     `json:"emoji,omitempty"`
+	Count     *int       `json:"count,omitempty"` // Of a react or unreact, sent even when 0
+	Status    string     `json:"status,omitempty"`
+	ActorID   string     `json:"actorId,omitempty"` // Of a member_add or moderation event, who did it
+	ActorName string     `json:"actorName,omitempty"`
+
+	// Users who receive the message, everyone in the room if nil
+	recipients map[string]bool
+	// Set once the message is sent to several connections, see Message.encode
+	wire *wireCache
+}
+
+// How far a member has read a room.
+type ReadPosition struct {
+	UserID    string    `json:"userId"`
+	MessageID string    `json:"messageId"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Messages of a room the user hasn't read yet.
+type UnreadCount struct {
+	Unread   int
+	Mentions int
+}
+
+// Aggregated reactions of one kind on a message.
+type Reaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"userIds"`
+}
+
+// Previous content of an edited message.
+type MessageRevision struct {
+	MessageID string    `json:"messageId"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"editedAt"`
 }
@@ -0,0 +1,240 @@
+package room
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Presence statuses
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// How often users are checked for inactivity
+const presenceCheckInterval = 10 * time.Second
+
+type presenceEntry struct {
+	username   string
+	status     string
+	manual     string         // status set by the user, overrides automatic away
+	rooms      map[string]int // connections per room
+	lastActive time.Time
+}
+
+// Tracks who is online across all rooms and tabs. A user is online while at
+// least one connection is open and goes away after a period of inactivity.
+type Presence struct {
+	awayAfter time.Duration
+	onChange  func(userID string, username string, status string, roomIDs []string)
+	mu        sync.Mutex
+	users     map[string]*presenceEntry
+}
+
+type presenceChange struct {
+	userID   string
+	username string
+	status   string
+	roomIDs  []string
+}
+
+// onChange is called with the rooms the user is connected to whenever the status changes.
+func NewPresence(awayAfter time.Duration, onChange func(userID string, username string, status string, roomIDs []string)) *Presence {
+	return &Presence{
+		awayAfter: awayAfter,
+		onChange:  onChange,
+		users:     make(map[string]*presenceEntry),
+	}
+}
+
+func (p *Presence) Connect(userID string, username string, roomID string) {
+	p.mu.Lock()
+	entry, ok := p.users[userID]
+	if !ok {
+		entry = &presenceEntry{
+			username: username,
+			status:   StatusOffline,
+			rooms:    make(map[string]int),
+		}
+		p.users[userID] = entry
+	}
+	entry.rooms[roomID]++
+	entry.lastActive = time.Now()
+	change := p.update(userID, entry)
+	p.mu.Unlock()
+
+	p.notify(change)
+}
+
+// The user goes offline when the last connection is closed.
+func (p *Presence) Disconnect(userID string, roomID string) {
+	p.mu.Lock()
+	entry, ok := p.users[userID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+
+	entry.rooms[roomID]--
+	if entry.rooms[roomID] > 0 {
+		p.mu.Unlock()
+		return
+	}
+	delete(entry.rooms, roomID)
+
+	var change *presenceChange
+	if len(entry.rooms) == 0 {
+		delete(p.users, userID)
+		change = &presenceChange{userID: userID, username: entry.username, status: StatusOffline, roomIDs: []string{roomID}}
+	}
+	p.mu.Unlock()
+
+	p.notify(change)
+}
+
+// Records activity of the user, bringing them back from automatic away.
+func (p *Presence) Touch(userID string) {
+	p.mu.Lock()
+	entry, ok := p.users[userID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	entry.lastActive = time.Now()
+	change := p.update(userID, entry)
+	p.mu.Unlock()
+
+	p.notify(change)
+}
+
+// Away sticks until the user sets online again, which restores automatic status.
+func (p *Presence) SetStatus(userID string, status string) {
+	p.mu.Lock()
+	entry, ok := p.users[userID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	entry.manual = ""
+	if status == StatusAway {
+		entry.manual = StatusAway
+	}
+	entry.lastActive = time.Now()
+	change := p.update(userID, entry)
+	p.mu.Unlock()
+
+	p.notify(change)
+}
+
+func (p *Presence) Status(userID string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if entry, ok := p.users[userID]; ok {
+		return entry.status
+	}
+
+	return StatusOffline
+}
+
+// Marks inactive users as away, blocks forever.
+func (p *Presence) run() {
+	ticker := time.NewTicker(presenceCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mu.Lock()
+		changes := make([]*presenceChange, 0)
+		for userID, entry := range p.users {
+			if change := p.update(userID, entry); change != nil {
+				changes = append(changes, change)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, change := range changes {
+			p.notify(change)
+		}
+	}
+}
+
+// Recomputes the status of the entry, returns the change if there is one.
+// Must be called with the lock held.
+func (p *Presence) update(userID string, entry *presenceEntry) *presenceChange {
+	status := StatusOnline
+	if entry.manual != "" {
+		status = entry.manual
+	} else if p.awayAfter > 0 && time.Since(entry.lastActive) > p.awayAfter {
+		status = StatusAway
+	}
+
+	if status == entry.status {
+		return nil
+	}
+	entry.status = status
+
+	roomIDs := make([]string, 0, len(entry.rooms))
+	for roomID := range entry.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+
+	return &presenceChange{userID: userID, username: entry.username, status: status, roomIDs: roomIDs}
+}
+
+func (p *Presence) notify(change *presenceChange) {
+	if change != nil && p.onChange != nil {
+		p.onChange(change.userID, change.username, change.status, change.roomIDs)
+	}
+}
+
+// Pushes a presence change to the given rooms.
+func (h *Hub) broadcastPresence(userID string, username string, status string, roomIDs []string) {
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if room, ok := h.Rooms[roomID]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, room := range rooms {
+		room.broadcast(&Message{
+			Type:     MessagePresence,
+			RoomID:   room.ID,
+			UserID:   userID,
+			Username: username,
+			Status:   status,
+		})
+	}
+}
+
+type GetPresenceReq struct {
+	UserIDs []string `json:"-" validate:"required,max=100,dive,required"`
+}
+
+type GetPresenceRes struct {
+	UserID string `json:"userId"`
+	Status string `json:"status"`
+}
+
+func (s *service) GetPresence(ctx context.Context, req *GetPresenceReq) ([]GetPresenceRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]GetPresenceRes, 0, len(req.UserIDs))
+	for _, userID := range req.UserIDs {
+		res = append(res, GetPresenceRes{
+			UserID: userID,
+			Status: s.hub.Presence.Status(userID),
+		})
+	}
+
+	return res, nil
+}
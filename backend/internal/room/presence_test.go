@@ -0,0 +1,87 @@
+package room_test
+
+import (
+	"gochatv1/internal/room"
+
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type presenceEvent struct {
+	UserID  string
+	Status  string
+	RoomIDs []string
+}
+
+func TestPresence(t *testing.T) {
+	events := make([]presenceEvent, 0)
+	presence := room.NewPresence(0, func(userID string, username string, status string, roomIDs []string) {
+		events = append(events, presenceEvent{userID, status, roomIDs})
+	})
+
+	tests := []struct {
+		name   string
+		action func()
+		status string
+		want   []presenceEvent
+	}{
+		{
+			"First connection goes online",
+			func() { presence.Connect("1", "user", "a") },
+			room.StatusOnline,
+			[]presenceEvent{{"1", room.StatusOnline, []string{"a"}}},
+		},
+		{
+			"Second tab changes nothing",
+			func() { presence.Connect("1", "user", "b") },
+			room.StatusOnline,
+			[]presenceEvent{},
+		},
+		{
+			"Manual away is sent to all rooms",
+			func() { presence.SetStatus("1", room.StatusAway) },
+			room.StatusAway,
+			[]presenceEvent{{"1", room.StatusAway, []string{"a", "b"}}},
+		},
+		{
+			"Activity doesn't clear manual away",
+			func() { presence.Touch("1") },
+			room.StatusAway,
+			[]presenceEvent{},
+		},
+		{
+			"Online restores automatic status",
+			func() { presence.SetStatus("1", room.StatusOnline) },
+			room.StatusOnline,
+			[]presenceEvent{{"1", room.StatusOnline, []string{"a", "b"}}},
+		},
+		{
+			"Closing one tab keeps user online",
+			func() { presence.Disconnect("1", "a") },
+			room.StatusOnline,
+			[]presenceEvent{},
+		},
+		{
+			"Last connection goes offline",
+			func() { presence.Disconnect("1", "b") },
+			room.StatusOffline,
+			[]presenceEvent{{"1", room.StatusOffline, []string{"b"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events = events[:0]
+			test.action()
+
+			if !cmp.Equal(events, test.want) {
+				t.Errorf("got %#v, want %#v", events, test.want)
+			}
+
+			if status := presence.Status("1"); status != test.status {
+				t.Errorf("got %s, want %s", status, test.status)
+			}
+		})
+	}
+}
@@ -5,30 +5,46 @@ import (
 	"errors"
 )
 
+// Rooms live in the hub, moderation data is stored in the DB (see repository_sql.go)
 type repository struct {
 	hub *Hub
+	db  DBTx
 }
 
-func NewRepository(hub *Hub) Repository {
-	return &repository{hub: hub}
+func NewRepository(hub *Hub, db DBTx) Repository {
+	return &repository{hub: hub, db: db}
 }
 
 func (r *repository) CreateRoom(ctx context.Context, room *Room) (*Room, error) {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
 	r.hub.Rooms[room.ID] = room
 
 	return room, nil
 }
 
 func (r *repository) DeleteRoom(ctx context.Context, id string) error {
-	if _, ok := r.hub.Rooms[id]; !ok {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
+	room, ok := r.hub.Rooms[id]
+	if !ok {
 		return errors.New("Room does not exist")
 	}
 
+	if room.Kind == KindDirect {
+		delete(r.hub.Directs, directKey(room.MemberIDs()))
+	}
 	delete(r.hub.Rooms, id)
+	room.close()
 	return nil
 }
 
 func (r *repository) GetRooms(ctx context.Context) ([]*Room, error) {
+	r.hub.mu.RLock()
+	defer r.hub.mu.RUnlock()
+
 	rooms := make([]*Room, 0, len(r.hub.Rooms))
 	for _, r := range r.hub.Rooms {
 		rooms = append(rooms, r)
@@ -37,9 +53,59 @@ func (r *repository) GetRooms(ctx context.Context) ([]*Room, error) {
 	return rooms, nil
 }
 
+func (r *repository) GetRoom(ctx context.Context, id string) (*Room, error) {
+	r.hub.mu.RLock()
+	defer r.hub.mu.RUnlock()
+
+	room, ok := r.hub.Rooms[id]
+	if !ok {
+		return nil, errors.New("Room does not exist")
+	}
+
+	return room, nil
+}
+
+// Returns the already existing room if the pair of users has one.
+func (r *repository) CreateDirect(ctx context.Context, room *Room) (*Room, error) {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
+	key := directKey(room.MemberIDs())
+	if existing, ok := r.hub.Directs[key]; ok {
+		return existing, nil
+	}
+
+	r.hub.Rooms[room.ID] = room
+	r.hub.Directs[key] = room
+
+	return room, nil
+}
+
+func (r *repository) GetDirects(ctx context.Context, userID string) ([]*Room, error) {
+	r.hub.mu.RLock()
+	defer r.hub.mu.RUnlock()
+
+	rooms := make([]*Room, 0)
+	for _, room := range r.hub.Rooms {
+		if room.Kind != KindRoom && room.IsMember(userID) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms, nil
+}
+
 func (r *repository) GetClients(ctx context.Context, roomId string) ([]*Client, error) {
-	clients := make([]*Client, 0, len(r.hub.Rooms[roomId].Clients))
-	for _, c := range r.hub.Rooms[roomId].Clients {
+	room, err := r.GetRoom(ctx, roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(room.Clients))
+	for _, c := range room.Clients {
 		clients = append(clients, c)
 	}
 
@@ -0,0 +1,821 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Makes possible to inject DB connection (in prod) or Tx transaction (in tests)
+type DBTx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+// Banning an already banned user replaces the previous ban.
+func (r *repository) CreateBan(ctx context.Context, ban *Ban) (*Ban, error) {
+	query := `INSERT INTO bans(room_id, user_id, reason, created_by, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (room_id, user_id) DO UPDATE
+		SET reason = EXCLUDED.reason, created_by = EXCLUDED.created_by, expires_at = EXCLUDED.expires_at, created_at = now()`
+	_, err := r.db.ExecContext(ctx, query, ban.RoomID, ban.UserID, ban.Reason, ban.CreatedBy, ban.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return ban, nil
+}
+
+func (r *repository) DeleteBan(ctx context.Context, roomID string, userID string) error {
+	query := "DELETE FROM bans WHERE room_id = $1 AND user_id = $2"
+	_, err := r.db.ExecContext(ctx, query, roomID, userID)
+	return err
+}
+
+func (r *repository) IsBanned(ctx context.Context, roomID string, userID string) (bool, error) {
+	var banned bool
+	query := `SELECT EXISTS(
+		SELECT 1 FROM bans WHERE room_id = $1 AND user_id = $2 AND (expires_at IS NULL OR expires_at > now())
+	)`
+	err := r.db.QueryRowContext(ctx, query, roomID, userID).Scan(&banned)
+	if err != nil {
+		return false, err
+	}
+
+	return banned, nil
+}
+
+// Muting an already muted user replaces the previous mute.
+func (r *repository) CreateMute(ctx context.Context, mute *Mute) (*Mute, error) {
+	query := `INSERT INTO mutes(room_id, user_id, created_by, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, user_id) DO UPDATE
+		SET created_by = EXCLUDED.created_by, expires_at = EXCLUDED.expires_at, created_at = now()`
+	_, err := r.db.ExecContext(ctx, query, mute.RoomID, mute.UserID, mute.CreatedBy, mute.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return mute, nil
+}
+
+func (r *repository) DeleteMute(ctx context.Context, roomID string, userID string) error {
+	query := "DELETE FROM mutes WHERE room_id = $1 AND user_id = $2"
+	_, err := r.db.ExecContext(ctx, query, roomID, userID)
+	return err
+}
+
+func (r *repository) CreateModerator(ctx context.Context, roomID string, userID string, createdBy string) error {
+	query := `INSERT INTO moderators(room_id, user_id, created_by) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO NOTHING`
+	_, err := r.db.ExecContext(ctx, query, roomID, userID, createdBy)
+	return err
+}
+
+func (r *repository) CreateAuditEntry(ctx context.Context, entry *AuditEntry) (*AuditEntry, error) {
+	query := `INSERT INTO audit_log(room_id, actor_id, action, target_id, reason, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, entry.RoomID, entry.ActorID, entry.Action, entry.TargetID, entry.Reason, entry.ExpiresAt).
+		Scan(&entry.ID, &entry.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Newest entries first.
+func (r *repository) GetAuditLog(ctx context.Context, roomID string) ([]*AuditEntry, error) {
+	query := `SELECT id, room_id, actor_id, action, target_id, reason, expires_at, created_at FROM audit_log
+		WHERE room_id = $1 ORDER BY id DESC`
+	rows, err := r.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		entry := &AuditEntry{}
+		err := rows.Scan(&entry.ID, &entry.RoomID, &entry.ActorID, &entry.Action, &entry.TargetID, &entry.Reason, &entry.ExpiresAt, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+const messageColumns = `id, room_id, user_id, username,
+	CASE WHEN deleted_at IS NULL THEN content ELSE '' END, created_at, edited_at, deleted_at IS NOT NULL,
+	COALESCE(parent_id, ''), reply_count, last_reply_at`
+
+func scanMessage(row interface{ Scan(...interface{}) error }) (*Message, error) {
+	msg := &Message{Type: MessageText}
+	err := row.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Username, &msg.Content, &msg.CreatedAt, &msg.EditedAt, &msg.Deleted,
+		&msg.ParentID, &msg.ReplyCount, &msg.LastReplyAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func scanMessages(rows *sql.Rows) ([]*Message, error) {
+	defer rows.Close()
+
+	messages := make([]*Message, 0)
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// A reply also bumps the reply count of its parent. Attachments of the
+// message are linked to it in the same statement.
+func (r *repository) CreateMessage(ctx context.Context, msg *Message) (*Message, error) {
+	attachmentIDs := make([]string, 0, len(msg.Attachments))
+	for _, attachment := range msg.Attachments {
+		attachmentIDs = append(attachmentIDs, attachment.ID)
+	}
+
+	query := `WITH parent AS (
+		UPDATE messages SET reply_count = reply_count + 1, last_reply_at = $6 WHERE id = $7
+	), attached AS (
+		UPDATE attachments SET message_id = $1 WHERE id = ANY($8) AND message_id IS NULL
+	)
+	INSERT INTO messages(id, room_id, user_id, username, content, created_at, parent_id) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))`
+	_, err := r.db.ExecContext(ctx, query, msg.ID, msg.RoomID, msg.UserID, msg.Username, msg.Content, msg.CreatedAt, msg.ParentID,
+		pq.Array(attachmentIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (r *repository) GetMessage(ctx context.Context, id string) (*Message, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE id = $1"
+	return scanMessage(r.db.QueryRowContext(ctx, query, id))
+}
+
+// Returns up to limit messages and replies after the given ID (all if empty)
+// created within [from, to), oldest first. Deleted messages are skipped.
+func (r *repository) GetMessagesAfter(ctx context.Context, roomID string, after string, from *time.Time, to *time.Time, limit int) ([]*Message, error) {
+	query := "SELECT " + messageColumns + ` FROM messages
+		WHERE room_id = $1 AND deleted_at IS NULL AND id > $2
+			AND ($3::timestamptz IS NULL OR created_at >= $3) AND ($4::timestamptz IS NULL OR created_at < $4)
+		ORDER BY id LIMIT $5`
+	rows, err := r.db.QueryContext(ctx, query, roomID, after, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMessages(rows)
+}
+
+// Returns up to limit top-level messages older than the before ID (all if empty),
+// oldest first. IDs are ULIDs, so they sort by creation time.
+func (r *repository) GetMessages(ctx context.Context, roomID string, before string, limit int) ([]*Message, error) {
+	query := `SELECT * FROM (
+		SELECT ` + messageColumns + ` FROM messages
+		WHERE room_id = $1 AND parent_id IS NULL AND ($2 = '' OR id < $2) ORDER BY id DESC LIMIT $3
+	) page ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, query, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMessages(rows)
+}
+
+// Returns up to limit replies to the parent newer than the after ID (all if empty), oldest first.
+func (r *repository) GetThread(ctx context.Context, parentID string, after string, limit int) ([]*Message, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE parent_id = $1 AND ($2 = '' OR id > $2) ORDER BY id LIMIT $3"
+	rows, err := r.db.QueryContext(ctx, query, parentID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMessages(rows)
+}
+
+func (r *repository) Subscribe(ctx context.Context, messageID string, userID string) error {
+	query := "INSERT INTO thread_subscriptions(message_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	_, err := r.db.ExecContext(ctx, query, messageID, userID)
+	return err
+}
+
+func (r *repository) Unsubscribe(ctx context.Context, messageID string, userID string) error {
+	query := "DELETE FROM thread_subscriptions WHERE message_id = $1 AND user_id = $2"
+	_, err := r.db.ExecContext(ctx, query, messageID, userID)
+	return err
+}
+
+func (r *repository) GetSubscribers(ctx context.Context, messageID string) ([]string, error) {
+	query := "SELECT user_id FROM thread_subscriptions WHERE message_id = $1"
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := make([]string, 0)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, rows.Err()
+}
+
+// Keeps the previous content in message_edits.
+func (r *repository) EditMessage(ctx context.Context, id string, content string, editedAt time.Time) error {
+	query := `WITH previous AS (
+		INSERT INTO message_edits(message_id, content, edited_at) SELECT id, content, $3 FROM messages WHERE id = $1
+	)
+	UPDATE messages SET content = $2, edited_at = $3 WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, id, content, editedAt)
+	return err
+}
+
+// Messages are only marked as deleted, the content stays for moderation.
+func (r *repository) DeleteMessage(ctx context.Context, id string, deletedAt time.Time) error {
+	query := "UPDATE messages SET deleted_at = $2 WHERE id = $1"
+	_, err := r.db.ExecContext(ctx, query, id, deletedAt)
+	return err
+}
+
+func (r *repository) GetMessageEdits(ctx context.Context, id string) ([]*MessageRevision, error) {
+	query := "SELECT message_id, content, edited_at FROM message_edits WHERE message_id = $1 ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := make([]*MessageRevision, 0)
+	for rows.Next() {
+		edit := &MessageRevision{}
+		if err := rows.Scan(&edit.MessageID, &edit.Content, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+
+	return edits, rows.Err()
+}
+
+// Returns the edit history of the messages keyed by message ID, oldest first.
+func (r *repository) GetRevisions(ctx context.Context, messageIDs []string) (map[string][]*MessageRevision, error) {
+	query := "SELECT message_id, content, edited_at FROM message_edits WHERE message_id = ANY($1) ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := make(map[string][]*MessageRevision)
+	for rows.Next() {
+		edit := &MessageRevision{}
+		if err := rows.Scan(&edit.MessageID, &edit.Content, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits[edit.MessageID] = append(edits[edit.MessageID], edit)
+	}
+
+	return edits, rows.Err()
+}
+
+// Adding the same reaction twice is a no-op. Returns the number of such reactions on the message.
+func (r *repository) AddReaction(ctx context.Context, messageID string, userID string, emoji string) (int, error) {
+	query := "INSERT INTO reactions(message_id, user_id, emoji) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	_, err := r.db.ExecContext(ctx, query, messageID, userID, emoji)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.countReactions(ctx, messageID, emoji)
+}
+
+func (r *repository) RemoveReaction(ctx context.Context, messageID string, userID string, emoji string) (int, error) {
+	query := "DELETE FROM reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3"
+	_, err := r.db.ExecContext(ctx, query, messageID, userID, emoji)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.countReactions(ctx, messageID, emoji)
+}
+
+func (r *repository) countReactions(ctx context.Context, messageID string, emoji string) (int, error) {
+	var count int
+	query := "SELECT count(*) FROM reactions WHERE message_id = $1 AND emoji = $2"
+	err := r.db.QueryRowContext(ctx, query, messageID, emoji).Scan(&count)
+	return count, err
+}
+
+// Returns reactions grouped by message ID, each kind ordered by its first use.
+func (r *repository) GetReactions(ctx context.Context, messageIDs []string) (map[string][]Reaction, error) {
+	query := `SELECT message_id, emoji, count(*), array_agg(user_id ORDER BY created_at) FROM reactions
+		WHERE message_id = ANY($1) GROUP BY message_id, emoji ORDER BY min(created_at)`
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[string][]Reaction)
+	for rows.Next() {
+		var messageID string
+		reaction := Reaction{}
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, pq.Array(&reaction.UserIDs)); err != nil {
+			return nil, err
+		}
+		reactions[messageID] = append(reactions[messageID], reaction)
+	}
+
+	return reactions, rows.Err()
+}
+
+// Read positions only move forward, IDs are ULIDs ordered by time.
+func (r *repository) SetReadPosition(ctx context.Context, roomID string, userID string, messageID string) error {
+	query := `INSERT INTO read_positions(room_id, user_id, message_id) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET message_id = EXCLUDED.message_id, updated_at = now()
+		WHERE read_positions.message_id < EXCLUDED.message_id`
+	_, err := r.db.ExecContext(ctx, query, roomID, userID, messageID)
+	return err
+}
+
+func (r *repository) GetReadPositions(ctx context.Context, roomID string) ([]*ReadPosition, error) {
+	query := "SELECT user_id, message_id, updated_at FROM read_positions WHERE room_id = $1"
+	rows, err := r.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	positions := make([]*ReadPosition, 0)
+	for rows.Next() {
+		position := &ReadPosition{}
+		if err := rows.Scan(&position.UserID, &position.MessageID, &position.UpdatedAt); err != nil {
+			return nil, err
+		}
+		positions = append(positions, position)
+	}
+
+	return positions, rows.Err()
+}
+
+// Counts messages of others after the read position of the user and mentions
+// of the user among them, rooms without unread messages are omitted.
+func (r *repository) GetUnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]UnreadCount, error) {
+	query := `SELECT m.room_id, count(*) FILTER (WHERE m.parent_id IS NULL), count(mn.user_id)
+		FROM messages m
+		LEFT JOIN read_positions rp ON rp.room_id = m.room_id AND rp.user_id = $1
+		LEFT JOIN mentions mn ON mn.message_id = m.id AND mn.user_id = $1
+		WHERE m.room_id = ANY($2) AND m.user_id <> $1 AND m.deleted_at IS NULL
+			AND (rp.message_id IS NULL OR m.id > rp.message_id)
+		GROUP BY m.room_id`
+	rows, err := r.db.QueryContext(ctx, query, userID, pq.Array(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]UnreadCount)
+	for rows.Next() {
+		var roomID string
+		count := UnreadCount{}
+		if err := rows.Scan(&roomID, &count.Unread, &count.Mentions); err != nil {
+			return nil, err
+		}
+		counts[roomID] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (r *repository) GetUserIDsByUsernames(ctx context.Context, usernames []string) ([]string, error) {
+	query := "SELECT id::text FROM users WHERE username = ANY($1)"
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := make([]string, 0)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, rows.Err()
+}
+
+func (r *repository) GetUsername(ctx context.Context, userID string) (string, error) {
+	var username string
+	query := "SELECT username FROM users WHERE id = $1"
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.New("User does not exist")
+	}
+	return username, err
+}
+
+func (r *repository) CreateMentions(ctx context.Context, msg *Message, userIDs []string) error {
+	query := `INSERT INTO mentions(message_id, room_id, user_id, created_at)
+		SELECT $1, $2, unnest($3::varchar[]), $4 ON CONFLICT DO NOTHING`
+	_, err := r.db.ExecContext(ctx, query, msg.ID, msg.RoomID, pq.Array(userIDs), msg.CreatedAt)
+	return err
+}
+
+// Returns messages mentioning the user older than the before ID (all if empty), newest first.
+func (r *repository) GetMentions(ctx context.Context, userID string, before string, limit int) ([]*Message, error) {
+	query := "SELECT " + messageColumns + ` FROM messages
+		WHERE id IN (SELECT message_id FROM mentions WHERE user_id = $1) AND deleted_at IS NULL AND ($2 = '' OR id < $2)
+		ORDER BY id DESC LIMIT $3`
+	rows, err := r.db.QueryContext(ctx, query, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMessages(rows)
+}
+
+const attachmentColumns = `id, room_id, user_id, COALESCE(message_id, ''), name, content_type, size, width, height, thumbnail, created_at`
+
+func scanAttachment(row interface{ Scan(...interface{}) error }) (*Attachment, error) {
+	a := &Attachment{}
+	err := row.Scan(&a.ID, &a.RoomID, &a.UserID, &a.MessageID, &a.Name, &a.ContentType, &a.Size, &a.Width, &a.Height,
+		&a.Thumbnail, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func scanAttachments(rows *sql.Rows) ([]*Attachment, error) {
+	defer rows.Close()
+
+	attachments := make([]*Attachment, 0)
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	return attachments, rows.Err()
+}
+
+func (r *repository) CreateAttachment(ctx context.Context, a *Attachment) (*Attachment, error) {
+	query := `INSERT INTO attachments(id, room_id, user_id, name, content_type, size, width, height, thumbnail, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err := r.db.ExecContext(ctx, query, a.ID, a.RoomID, a.UserID, a.Name, a.ContentType, a.Size, a.Width, a.Height,
+		a.Thumbnail, a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Attachments of deleted messages are gone together with the message.
+func (r *repository) GetAttachment(ctx context.Context, id string) (*Attachment, error) {
+	query := "SELECT " + attachmentColumns + ` FROM attachments a WHERE id = $1
+		AND NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = a.message_id AND m.deleted_at IS NOT NULL)`
+	return scanAttachment(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *repository) GetAttachmentsByIDs(ctx context.Context, ids []string) ([]*Attachment, error) {
+	query := "SELECT " + attachmentColumns + " FROM attachments WHERE id = ANY($1) ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAttachments(rows)
+}
+
+// Returns attachments of the messages keyed by message ID, in upload order.
+func (r *repository) GetAttachments(ctx context.Context, messageIDs []string) (map[string][]*Attachment, error) {
+	query := "SELECT " + attachmentColumns + " FROM attachments WHERE message_id = ANY($1) ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	byMessage := make(map[string][]*Attachment)
+	for _, a := range attachments {
+		byMessage[a.MessageID] = append(byMessage[a.MessageID], a)
+	}
+
+	return byMessage, nil
+}
+
+// Text search configuration, has to match the one of the generated search column
+const searchConfig = "english"
+
+// Matches use websearch syntax: quoted phrases, OR and -excluded words. Content
+// is escaped before highlighting, so the highlight is safe to render as HTML.
+func (r *repository) SearchMessages(ctx context.Context, q *SearchQuery) ([]*SearchResult, error) {
+	query := "SELECT " + messageColumns + `,
+			ts_headline('` + searchConfig + `', replace(replace(replace(content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), tsq,
+				'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5')
+		FROM messages, websearch_to_tsquery('` + searchConfig + `', $1) tsq
+		WHERE search @@ tsq AND room_id = ANY($2) AND deleted_at IS NULL
+			AND ($3 = '' OR username = $3)
+			AND ($4::timestamptz IS NULL OR created_at >= $4)
+			AND ($5::timestamptz IS NULL OR created_at < $5)
+		ORDER BY ts_rank(search, tsq) DESC, id DESC
+		LIMIT $6 OFFSET $7`
+	rows, err := r.db.QueryContext(ctx, query, q.Text, pq.Array(q.RoomIDs), q.Username, q.After, q.Before, q.Limit, q.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*SearchResult, 0)
+	for rows.Next() {
+		msg := &Message{Type: MessageText}
+		result := &SearchResult{Message: msg}
+		err := rows.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Username, &msg.Content, &msg.CreatedAt, &msg.EditedAt, &msg.Deleted,
+			&msg.ParentID, &msg.ReplyCount, &msg.LastReplyAt, &result.Highlight)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+func (r *repository) GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error) {
+	query := "SELECT room_id, max_age_days, max_count, legal_hold, updated_by, updated_at FROM retention_policies ORDER BY room_id"
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make([]*RetentionPolicy, 0)
+	for rows.Next() {
+		p := &RetentionPolicy{}
+		if err := rows.Scan(&p.RoomID, &p.MaxAgeDays, &p.MaxCount, &p.LegalHold, &p.UpdatedBy, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+
+	return policies, rows.Err()
+}
+
+func (r *repository) SetRetentionPolicy(ctx context.Context, p *RetentionPolicy) error {
+	query := `INSERT INTO retention_policies(room_id, max_age_days, max_count, legal_hold, updated_by, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (room_id) DO UPDATE
+		SET max_age_days = EXCLUDED.max_age_days, max_count = EXCLUDED.max_count, legal_hold = EXCLUDED.legal_hold,
+			updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at`
+	_, err := r.db.ExecContext(ctx, query, p.RoomID, p.MaxAgeDays, p.MaxCount, p.LegalHold, p.UpdatedBy, p.UpdatedAt)
+	return err
+}
+
+func (r *repository) DeleteRetentionPolicy(ctx context.Context, roomID string) error {
+	query := "DELETE FROM retention_policies WHERE room_id = $1"
+	_, err := r.db.ExecContext(ctx, query, roomID)
+	return err
+}
+
+// Removes up to limit messages of the room older than cutoff or beyond the
+// newest maxCount top-level messages, oldest first, together with their
+// replies. Parents which are kept count the replies removed from them.
+// Returns the IDs of everything removed.
+func (r *repository) PruneMessages(ctx context.Context, roomID string, cutoff *time.Time, maxCount int, limit int, archive bool) ([]string, error) {
+	pruned := `batch AS (
+			SELECT id FROM messages WHERE room_id = $1 AND (
+				($2::timestamptz IS NOT NULL AND created_at < $2)
+				OR ($3 > 0 AND parent_id IS NULL AND id <= (
+					SELECT id FROM messages WHERE room_id = $1 AND parent_id IS NULL ORDER BY id DESC OFFSET $3 LIMIT 1
+				))
+			) ORDER BY id LIMIT $4
+		), pruned AS (
+			DELETE FROM messages WHERE id IN (SELECT id FROM batch) OR parent_id IN (SELECT id FROM batch) RETURNING *
+		), replies AS (
+			UPDATE messages p SET reply_count = p.reply_count - r.removed
+			FROM (SELECT parent_id, count(*) AS removed FROM pruned WHERE parent_id IS NOT NULL GROUP BY parent_id) r
+			WHERE p.id = r.parent_id AND p.id NOT IN (SELECT id FROM pruned)
+		)`
+	query := "WITH " + pruned + " SELECT id FROM pruned"
+	if archive {
+		query = "WITH " + pruned + `, archived AS (
+			INSERT INTO messages_archive SELECT * FROM pruned
+		) SELECT id FROM pruned`
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, roomID, cutoff, maxCount, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Deletes attachment records of the messages and returns them, so their files can be removed.
+func (r *repository) DeleteAttachments(ctx context.Context, messageIDs []string) ([]*Attachment, error) {
+	query := "DELETE FROM attachments WHERE message_id = ANY($1) RETURNING " + attachmentColumns
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAttachments(rows)
+}
+
+func (r *repository) CreateRetentionRun(ctx context.Context, run *RetentionRun) (*RetentionRun, error) {
+	query := `INSERT INTO retention_runs(room_id, pruned, archived, cutoff, max_count) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, run.RoomID, run.Pruned, run.Archived, run.Cutoff, run.MaxCount).Scan(&run.ID, &run.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// Returns runs older than the before ID (all if 0), newest first, optionally of one room.
+func (r *repository) GetRetentionRuns(ctx context.Context, roomID string, before int64, limit int) ([]*RetentionRun, error) {
+	query := `SELECT id, room_id, pruned, archived, cutoff, max_count, created_at FROM retention_runs
+		WHERE ($1 = '' OR room_id = $1) AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3`
+	rows, err := r.db.QueryContext(ctx, query, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]*RetentionRun, 0)
+	for rows.Next() {
+		run := &RetentionRun{}
+		if err := rows.Scan(&run.ID, &run.RoomID, &run.Pruned, &run.Archived, &run.Cutoff, &run.MaxCount, &run.CreatedAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// Rooms live in the hub, the rooms table only keeps them across restarts.
+func (r *repository) SaveRoom(ctx context.Context, room *Room) error {
+	query := `INSERT INTO rooms(id, name, kind, owner_id, member_ids) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, owner_id = EXCLUDED.owner_id, member_ids = EXCLUDED.member_ids`
+	_, err := r.db.ExecContext(ctx, query, room.ID, room.GetName(), room.Kind, room.OwnerID, pq.Array(room.MemberIDs()))
+	return err
+}
+
+func (r *repository) DeleteSavedRoom(ctx context.Context, id string) error {
+	query := "DELETE FROM rooms WHERE id = $1"
+	_, err := r.db.ExecContext(ctx, query, id)
+	return err
+}
+
+// Puts the saved rooms missing from the hub into it and returns those,
+// starting them is up to the caller. Rooms already in the hub are kept as they are.
+func (r *repository) LoadRooms(ctx context.Context) ([]*Room, error) {
+	query := "SELECT id, name, kind, owner_id, member_ids FROM rooms ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make([]*Room, 0)
+	for rows.Next() {
+		var id, name, kind, ownerID string
+		var memberIDs []string
+		err := rows.Scan(&id, &name, &kind, &ownerID, pq.Array(&memberIDs))
+		if err != nil {
+			return nil, err
+		}
+
+		room := NewRoom(id, name)
+		if kind != KindRoom {
+			room = NewGroupRoom(id, name, memberIDs)
+			room.Kind = kind
+		}
+		room.OwnerID = ownerID
+		rooms = append(rooms, room)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = r.loadModeration(ctx, rooms)
+	if err != nil {
+		return nil, err
+	}
+
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
+	added := make([]*Room, 0)
+	for _, room := range rooms {
+		if _, ok := r.hub.Rooms[room.ID]; ok {
+			continue
+		}
+		if room.Kind == KindDirect {
+			key := directKey(room.MemberIDs())
+			if _, ok := r.hub.Directs[key]; ok {
+				continue
+			}
+			r.hub.Directs[key] = room
+		}
+		r.hub.Rooms[room.ID] = room
+		added = append(added, room)
+	}
+
+	return added, nil
+}
+
+// Restores the moderators and the mutes which haven't expired yet.
+func (r *repository) loadModeration(ctx context.Context, rooms []*Room) error {
+	byID := make(map[string]*Room, len(rooms))
+	for _, room := range rooms {
+		byID[room.ID] = room
+	}
+
+	rows, err := r.db.QueryContext(ctx, "SELECT room_id, user_id FROM moderators")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomID, userID string
+		if err := rows.Scan(&roomID, &userID); err != nil {
+			return err
+		}
+		if room, ok := byID[roomID]; ok {
+			room.AddModerator(userID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	query := "SELECT room_id, user_id, expires_at FROM mutes WHERE expires_at IS NULL OR expires_at > now()"
+	mutes, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer mutes.Close()
+
+	for mutes.Next() {
+		var roomID, userID string
+		var expiresAt *time.Time
+		if err := mutes.Scan(&roomID, &userID, &expiresAt); err != nil {
+			return err
+		}
+		var until time.Time
+		if expiresAt != nil {
+			until = *expiresAt
+		}
+		if room, ok := byID[roomID]; ok {
+			room.Mute(userID, until)
+		}
+	}
+
+	return mutes.Err()
+}
@@ -0,0 +1,181 @@
+package room
+
+import "context"
+
+const (
+	// Stored message events each room keeps for clients resuming after a reconnect
+	resumeBufferSize = 256
+	// Most messages replayed from history when the buffer doesn't go back far enough
+	resumeHistoryLimit = 200
+)
+
+// Recent events about stored messages, oldest first. Only used with the room's lock held.
+type ringBuffer struct {
+	msgs  []*Message
+	start int
+	size  int
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{msgs: make([]*Message, capacity)}
+}
+
+// Events a client which missed them can catch up with, others are only of live interest.
+func replayable(msg *Message) bool {
+	switch msg.Type {
+	case MessageText, MessageEdit, MessageDelete, MessageReact, MessageUnreact, MessageThread:
+		return true
+	}
+	return false
+}
+
+// Overwrites the oldest event once full.
+func (b *ringBuffer) push(msg *Message) {
+	if b.size < len(b.msgs) {
+		b.msgs[(b.start+b.size)%len(b.msgs)] = msg
+		b.size++
+		return
+	}
+
+	b.msgs[b.start] = msg
+	b.start = (b.start + 1) % len(b.msgs)
+}
+
+func (b *ringBuffer) at(i int) *Message {
+	return b.msgs[(b.start+i)%len(b.msgs)]
+}
+
+// Whether the message with the given ID is still buffered.
+func (b *ringBuffer) contains(id string) bool {
+	return b.index(id) >= 0
+}
+
+func (b *ringBuffer) index(id string) int {
+	for i := b.size - 1; i >= 0; i-- {
+		if msg := b.at(i); msg.Type == MessageText && msg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Drops the events about the given messages, the rest keep their order.
+func (b *ringBuffer) remove(ids map[string]bool) {
+	kept := 0
+	for i := 0; i < b.size; i++ {
+		if msg := b.at(i); !ids[msg.ID] {
+			b.msgs[(b.start+kept)%len(b.msgs)] = msg
+			kept++
+		}
+	}
+	for i := kept; i < b.size; i++ {
+		b.msgs[(b.start+i)%len(b.msgs)] = nil
+	}
+	b.size = kept
+}
+
+// Returns the events following the message with the given ID. When it is no
+// longer buffered, only events about newer messages are returned.
+func (b *ringBuffer) after(id string) []*Message {
+	msgs := make([]*Message, 0)
+	if i := b.index(id); i >= 0 {
+		for i++; i < b.size; i++ {
+			msgs = append(msgs, b.at(i))
+		}
+		return msgs
+	}
+
+	for i := 0; i < b.size; i++ {
+		if msg := b.at(i); msg.ID > id {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// Sends a registered client what it missed, or tells it to refetch history
+// when that can't be done. Called on the client's side once something reads
+// its channel, so a slow client doesn't hold up the room, which keeps its live
+// messages until the replay is done.
+func (r *Room) replay(client *Client) {
+	if client.resumeFrom == "" {
+		return
+	}
+	missed := <-client.missed
+
+	if client.resync {
+		client.Message <- &Message{
+			Type:    MessageResync,
+			Content: "Too many missed messages, refetch history",
+			RoomID:  r.ID,
+		}
+	} else {
+		for _, msg := range client.backlog {
+			client.Message <- msg
+		}
+		for _, msg := range missed {
+			if msg.recipients != nil && !msg.recipients[client.UserID] {
+				continue
+			}
+			client.Message <- msg
+		}
+	}
+
+	select {
+	case r.replayed <- client:
+	case <-r.done:
+		// Dropped by run when it stopped, the channel of a stream or poll was kept open
+		if client.Conn == nil {
+			close(client.Message)
+		}
+	}
+}
+
+// Fetches what a resuming client missed from history when the room's buffer
+// no longer has its last message. Replies are left to thread fetches.
+func (s *service) loadBacklog(ctx context.Context, room *Room, client *Client) error {
+	if client.resumeFrom == "" {
+		return nil
+	}
+
+	room.mu.RLock()
+	buffered := room.history.contains(client.resumeFrom)
+	room.mu.RUnlock()
+	if buffered {
+		return nil
+	}
+
+	messages, err := s.repository.GetMessagesAfter(ctx, room.ID, client.resumeFrom, nil, nil, resumeHistoryLimit+1)
+	if err != nil {
+		return err
+	}
+	if len(messages) > resumeHistoryLimit {
+		client.resync = true
+		return nil
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	backlog := make([]*Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg.ParentID == "" {
+			backlog = append(backlog, msg)
+		}
+	}
+
+	err = s.attachReactions(ctx, backlog)
+	if err != nil {
+		return err
+	}
+
+	err = s.loadAttachments(ctx, backlog)
+	if err != nil {
+		return err
+	}
+
+	// The buffer takes over from the last message in history
+	client.backlog = backlog
+	client.resumeFrom = messages[len(messages)-1].ID
+	return nil
+}
@@ -4,6 +4,11 @@ import (
 	"gochatv1/config"
 
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/websocket"
@@ -15,19 +20,24 @@ type service struct {
 	config     *config.Config
 	validate   *validator.Validate
 	hub        *Hub
+	notifier   Notifier
+	blobs      BlobStore
 }
 
-func NewService(repo Repository, cfg *config.Config, val *validator.Validate, hub *Hub) Service {
+func NewService(repo Repository, cfg *config.Config, val *validator.Validate, hub *Hub, notifier Notifier, blobs BlobStore) Service {
 	return &service{
 		repo,
 		cfg,
 		val,
 		hub,
+		notifier,
+		blobs,
 	}
 }
 
 type CreateRoomReq struct {
-	Name string `json:"name" validate:"required,min=3"`
+	OwnerID string `json:"-"`
+	Name    string `json:"name" validate:"required,min=3"`
 }
 
 type CreateRoomRes struct {
@@ -45,12 +55,20 @@ func (s *service) CreateRoom(ctx context.Context, req *CreateRoomReq) (*CreateRo
 
 	id := ulid.Make().String()
 	newRoom := NewRoom(id, req.Name)
+	newRoom.OwnerID = req.OwnerID
 	room, err := s.repository.CreateRoom(context, newRoom)
 	if err != nil {
 		return nil, err
 	}
 
-	go newRoom.run(s.hub)
+	// Saved once in the hub, so the room loader doesn't start a second copy
+	err = s.repository.SaveRoom(context, newRoom)
+	if err != nil {
+		_ = s.repository.DeleteRoom(context, newRoom.ID)
+		return nil, err
+	}
+
+	go newRoom.run()
 
 	res := &CreateRoomRes{ID: room.ID}
 
@@ -58,27 +76,53 @@ func (s *service) CreateRoom(ctx context.Context, req *CreateRoomReq) (*CreateRo
 }
 
 type DeleteRoomReq struct {
-	ID string `json:"id"`
+	CallerID string `json:"-"  validate:"required"`
+	ID       string `json:"id" validate:"required"`
 }
 
+// Named rooms can only be deleted by their owner, DMs and groups by any member.
 func (s *service) DeleteRoom(ctx context.Context, req *DeleteRoomReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
 	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
 	defer cancel()
 
-	err := s.repository.DeleteRoom(context, req.ID)
+	room, err := s.repository.GetRoom(context, req.ID)
 	if err != nil {
 		return err
 	}
+	if room.Kind == KindRoom && room.OwnerID != req.CallerID {
+		return errors.New("Only the owner can delete the room")
+	}
+	if room.Kind != KindRoom && !room.IsMember(req.CallerID) {
+		return errors.New("User is not a member of the room")
+	}
 
-	return nil
+	// Unsaved first, so the room loader doesn't bring it back
+	err = s.repository.DeleteSavedRoom(context, req.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.repository.DeleteRoom(context, req.ID)
+}
+
+// Caller is optional, unread counts are only returned to signed in users
+type GetRoomsReq struct {
+	CallerID string `json:"-"`
 }
 
 type GetRoomsRes struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	UnreadCount  int    `json:"unreadCount"`
+	MentionCount int    `json:"mentionCount"`
 }
 
-func (s *service) GetRooms(ctx context.Context) ([]GetRoomsRes, error) {
+func (s *service) GetRooms(ctx context.Context, req *GetRoomsReq) ([]GetRoomsRes, error) {
 	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
 	defer cancel()
 
@@ -89,20 +133,372 @@ func (s *service) GetRooms(ctx context.Context) ([]GetRoomsRes, error) {
 
 	res := make([]GetRoomsRes, 0)
 	for _, r := range rooms {
+		// Direct conversations are private and listed in GetDirects
+		if r.Kind != KindRoom {
+			continue
+		}
 		res = append(res, GetRoomsRes{
 			ID:   r.ID,
 			Name: r.Name,
 		})
 	}
 
+	if req.CallerID == "" {
+		return res, nil
+	}
+
+	roomIDs := make([]string, 0, len(res))
+	for _, r := range res {
+		roomIDs = append(roomIDs, r.ID)
+	}
+
+	counts, err := s.repository.GetUnreadCounts(context, req.CallerID, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range res {
+		res[i].UnreadCount = counts[res[i].ID].Unread
+		res[i].MentionCount = counts[res[i].ID].Mentions
+	}
+
 	return res, nil
 }
 
+type CreateDirectReq struct {
+	CallerID string `json:"-"      validate:"required"`
+	UserID   string `json:"userId" validate:"required,nefield=CallerID"`
+}
+
+type CreateDirectRes struct {
+	ID      string   `json:"id"`
+	UserIDs []string `json:"userIds"`
+}
+
+// Idempotent: the same pair of users always gets the same room.
+func (s *service) CreateDirect(ctx context.Context, req *CreateDirectReq) (*CreateDirectRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	newRoom := NewDirectRoom(ulid.Make().String(), req.CallerID, req.UserID)
+	room, err := s.repository.CreateDirect(context, newRoom)
+	if err != nil {
+		return nil, err
+	}
+
+	if room == newRoom {
+		err = s.repository.SaveRoom(context, newRoom)
+		if err != nil {
+			_ = s.repository.DeleteRoom(context, newRoom.ID)
+			return nil, err
+		}
+
+		go newRoom.run()
+	}
+
+	res := &CreateDirectRes{
+		ID:      room.ID,
+		UserIDs: room.MemberIDs(),
+	}
+
+	return res, nil
+}
+
+type GetDirectsReq struct {
+	UserID string `json:"-" validate:"required"`
+}
+
+type GetDirectsRes struct {
+	ID           string   `json:"id"`
+	Kind         string   `json:"kind"`
+	Name         string   `json:"name,omitempty"`
+	UserIDs      []string `json:"userIds"`
+	LastMessage  *Message `json:"lastMessage"`
+	UnreadCount  int      `json:"unreadCount"`
+	MentionCount int      `json:"mentionCount"`
+}
+
+func (s *service) GetDirects(ctx context.Context, req *GetDirectsReq) ([]GetDirectsRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	rooms, err := s.repository.GetDirects(context, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	roomIDs := make([]string, 0, len(rooms))
+	for _, r := range rooms {
+		roomIDs = append(roomIDs, r.ID)
+	}
+
+	counts, err := s.repository.GetUnreadCounts(context, req.UserID, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]GetDirectsRes, 0, len(rooms))
+	for _, r := range rooms {
+		r.mu.RLock()
+		lastMessage := r.LastMessage
+		r.mu.RUnlock()
+
+		res = append(res, GetDirectsRes{
+			ID:           r.ID,
+			Kind:         r.Kind,
+			Name:         r.GetName(),
+			UserIDs:      r.MemberIDs(),
+			LastMessage:  lastMessage,
+			UnreadCount:  counts[r.ID].Unread,
+			MentionCount: counts[r.ID].Mentions,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res, nil
+}
+
+type CreateGroupReq struct {
+	CallerID string   `json:"-"       validate:"required"`
+	Name     string   `json:"name"`
+	UserIDs  []string `json:"userIds" validate:"required,min=2,dive,required"`
+}
+
+type CreateGroupRes struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	UserIDs []string `json:"userIds"`
+}
+
+func (s *service) CreateGroup(ctx context.Context, req *CreateGroupReq) (*CreateGroupRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string]bool{req.CallerID: true}
+	for _, userID := range req.UserIDs {
+		members[userID] = true
+	}
+	if len(members) < 3 {
+		return nil, errors.New("Group needs at least 3 participants")
+	}
+	if s.config.MaxGroupMembers > 0 && len(members) > s.config.MaxGroupMembers {
+		return nil, fmt.Errorf("Group can't have more than %d participants", s.config.MaxGroupMembers)
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	userIDs := make([]string, 0, len(members))
+	for userID := range members {
+		userIDs = append(userIDs, userID)
+	}
+
+	newRoom := NewGroupRoom(ulid.Make().String(), req.Name, userIDs)
+	newRoom.OwnerID = req.CallerID
+	room, err := s.repository.CreateRoom(context, newRoom)
+	if err != nil {
+		return nil, err
+	}
+
+	// Saved once in the hub, so the room loader doesn't start a second copy
+	err = s.repository.SaveRoom(context, newRoom)
+	if err != nil {
+		_ = s.repository.DeleteRoom(context, newRoom.ID)
+		return nil, err
+	}
+
+	go newRoom.run()
+
+	res := &CreateGroupRes{
+		ID:      room.ID,
+		Name:    room.Name,
+		UserIDs: room.MemberIDs(),
+	}
+
+	return res, nil
+}
+
+// Returns the group if the caller is one of its members.
+func (s *service) getGroup(ctx context.Context, roomID string, callerID string) (*Room, error) {
+	room, err := s.repository.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if room.Kind != KindGroup {
+		return nil, errors.New("Room is not a group")
+	}
+
+	if !room.IsMember(callerID) {
+		return nil, errors.New("User is not a member of the group")
+	}
+
+	return room, nil
+}
+
+type AddGroupMemberReq struct {
+	CallerID string `json:"-"      validate:"required"`
+	Username string `json:"-"`
+	RoomID   string `json:"-"      validate:"required"`
+	UserID   string `json:"userId" validate:"required"`
+}
+
+// Any member of a group can add people to it.
+func (s *service) AddGroupMember(ctx context.Context, req *AddGroupMemberReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	room, err := s.getGroup(ctx, req.RoomID, req.CallerID)
+	if err != nil {
+		return err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	username, err := s.repository.GetUsername(context, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	err = room.AddMember(req.UserID, s.config.MaxGroupMembers)
+	if err != nil {
+		return err
+	}
+	err = s.repository.SaveRoom(context, room)
+	if err != nil {
+		room.RemoveMember(req.UserID)
+		return err
+	}
+
+	room.broadcast(&Message{
+		Type:      MessageMemberAdd,
+		Content:   "User was added to the group",
+		RoomID:    room.ID,
+		UserID:    req.UserID,
+		Username:  username,
+		ActorID:   req.CallerID,
+		ActorName: req.Username,
+	})
+
+	return nil
+}
+
+type LeaveGroupReq struct {
+	CallerID string `json:"-" validate:"required"`
+	Username string `json:"-"`
+	RoomID   string `json:"-" validate:"required"`
+}
+
+func (s *service) LeaveGroup(ctx context.Context, req *LeaveGroupReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	room, err := s.getGroup(ctx, req.RoomID, req.CallerID)
+	if err != nil {
+		return err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	// The last member to leave takes the group with them
+	if room.RemoveMember(req.CallerID) == 0 {
+		err = s.repository.DeleteSavedRoom(context, room.ID)
+		if err != nil {
+			return err
+		}
+
+		return s.repository.DeleteRoom(context, room.ID)
+	}
+
+	err = s.repository.SaveRoom(context, room)
+	if err != nil {
+		// Takes back the seat just freed, whatever the limit
+		_ = room.AddMember(req.CallerID, 0)
+		return err
+	}
+
+	room.broadcast(&Message{
+		Type:     MessageMemberLeave,
+		Content:  "User left the group",
+		RoomID:   room.ID,
+		UserID:   req.CallerID,
+		Username: req.Username,
+	})
+	room.disconnect(&Disconnect{
+		UserID: req.CallerID,
+		Reason: "You left the group",
+	})
+
+	return nil
+}
+
+type RenameGroupReq struct {
+	CallerID string `json:"-"    validate:"required"`
+	Username string `json:"-"`
+	RoomID   string `json:"-"    validate:"required"`
+	Name     string `json:"name" validate:"max=100"`
+}
+
+// An empty name turns the group back into an unnamed one.
+func (s *service) RenameGroup(ctx context.Context, req *RenameGroupReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	room, err := s.getGroup(ctx, req.RoomID, req.CallerID)
+	if err != nil {
+		return err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	name := room.GetName()
+	room.SetName(req.Name)
+	err = s.repository.SaveRoom(context, room)
+	if err != nil {
+		room.SetName(name)
+		return err
+	}
+
+	room.broadcast(&Message{
+		Type:     MessageRename,
+		Content:  req.Name,
+		RoomID:   room.ID,
+		UserID:   req.CallerID,
+		Username: req.Username,
+	})
+
+	return nil
+}
+
+// Clients reconnecting pass the last message they got to be sent what they missed.
 type JoinRoomReq struct {
-	Conn     *websocket.Conn
-	UserID   string `json:"userId"   validate:"required"`
-	RoomID   string `json:"roomId"   validate:"required"`
-	Username string `json:"username" validate:"required"`
+	Conn          *websocket.Conn
+	UserID        string `json:"userId"        validate:"required"`
+	RoomID        string `json:"roomId"        validate:"required"`
+	Username      string `json:"username"      validate:"required"`
+	LastMessageID string `json:"lastMessageId"`
+	Unnumbered    bool   `json:"-"` // Messages are sent without seq, see writeMessages
 }
 
 func (s *service) JoinRoom(ctx context.Context, req *JoinRoomReq) error {
@@ -111,31 +507,71 @@ func (s *service) JoinRoom(ctx context.Context, req *JoinRoomReq) error {
 		return err
 	}
 
+	room, err := s.repository.GetRoom(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+
 	client := &Client{
 		Conn:     req.Conn,
-		Message:  make(chan *Message, 10),
+		Message:  make(chan *Message, clientBufferSize),
+		ConnID:   ulid.Make().String(),
 		UserID:   req.UserID,
 		RoomID:   req.RoomID,
 		Username: req.Username,
-	}
 
-	msg := &Message{
-		Content:  "New user has joined",
-		RoomID:   req.RoomID,
-		Username: req.Username,
+		framing:    s.framing(req.Conn, !req.Unnumbered),
+		resumeFrom: req.LastMessageID,
 	}
 
-	s.hub.Rooms[req.RoomID].Register <- client
-	s.hub.Rooms[req.RoomID].Broadcast <- msg
+	err = s.register(ctx, room, client)
+	if err != nil {
+		return err
+	}
 
 	go client.writeMessage()
-	go client.readMessage(s.hub.Rooms[req.RoomID])
+	room.replay(client)
+	go client.readMessage(room, s)
+
+	return nil
+}
+
+// Adds the client to the room if its user may be there.
+func (s *service) register(ctx context.Context, room *Room, client *Client) error {
+	if !room.IsMember(client.UserID) {
+		return errors.New("User is not a member of the room")
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	banned, err := s.repository.IsBanned(context, room.ID, client.UserID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return errors.New("User is banned from the room")
+	}
+
+	err = s.loadBacklog(context, room, client)
+	if err != nil {
+		return err
+	}
+
+	if client.resumeFrom != "" {
+		client.missed = make(chan []*Message, 1)
+	}
+	if !room.join(client) {
+		return errors.New("Room does not exist")
+	}
+	s.hub.Presence.Connect(client.UserID, client.Username, room.ID)
 
 	return nil
 }
 
 type GetClientsReq struct {
-	RoomID string `json:"id" validate:"required"`
+	CallerID string `json:"-"  validate:"required"`
+	RoomID   string `json:"id" validate:"required"`
 }
 
 type GetClientsRes struct {
@@ -152,13 +588,28 @@ func (s *service) GetClients(ctx context.Context, req *GetClientsReq) ([]GetClie
 	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
 	defer cancel()
 
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkAccess(context, room, req.CallerID, false)
+	if err != nil {
+		return nil, err
+	}
+
 	clients, err := s.repository.GetClients(context, req.RoomID)
 	if err != nil {
 		return nil, err
 	}
 
+	// Users with several connections are listed once
+	seen := make(map[string]bool, len(clients))
 	res := make([]GetClientsRes, 0)
 	for _, c := range clients {
+		if seen[c.UserID] {
+			continue
+		}
+		seen[c.UserID] = true
 		res = append(res, GetClientsRes{
 			ID:       c.UserID,
 			Username: c.Username,
@@ -168,27 +619,268 @@ func (s *service) GetClients(ctx context.Context, req *GetClientsReq) ([]GetClie
 	return res, nil
 }
 
-func (r *Room) run(hub *Hub) {
+func (r *Room) run() {
+	// Runs while someone types, until the first indicator expires
+	var typingTimer *time.Timer
+	var typingExpired <-chan time.Time
+	defer func() {
+		if typingTimer != nil {
+			typingTimer.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case client := <-r.Register:
-			hub.Rooms[client.RoomID].Clients[client.UserID] = client
+			r.mu.Lock()
+			r.Clients[client.ConnID] = client
+			conns, ok := r.connections[client.UserID]
+			if !ok {
+				conns = make(map[string]*Client)
+				r.connections[client.UserID] = conns
+			}
+			conns[client.ConnID] = client
+			if client.resumeFrom != "" {
+				// Sent by the client's side, see Room.replay
+				client.replaying = true
+				client.missed <- r.history.after(client.resumeFrom)
+			}
+			r.mu.Unlock()
+
+			// Only the first connection of a user joins, other tabs are silent
+			if len(conns) == 1 {
+				r.deliver(&Message{
+					Type:      MessageJoin,
+					Content:   "New user has joined",
+					RoomID:    r.ID,
+					UserID:    client.UserID,
+					Username:  client.Username,
+					CreatedAt: time.Now().UTC(),
+				})
+			}
 
 		case client := <-r.Unregister:
-			if _, ok := hub.Rooms[client.RoomID].Clients[client.UserID]; ok {
-				r.Broadcast <- &Message{
-					Content:  "User left the chat",
-					RoomID:   client.RoomID,
-					Username: client.Username,
-				}
-				delete(hub.Rooms[client.RoomID].Clients, client.UserID)
+			r.unregister(client)
+
+		case client := <-r.replayed:
+			client.replaying = false
+			if client.overflow {
+				client.pending = []*Message{{
+					Type:    MessageResync,
+					Content: "Too many missed messages, refetch history",
+					RoomID:  r.ID,
+				}}
+			}
+			for _, msg := range client.pending {
+				r.send(client, msg)
+			}
+			client.pending = nil
+
+			// Left while replaying, the channel was kept open until now
+			if _, ok := r.Clients[client.ConnID]; !ok && client.session == nil {
 				close(client.Message)
 			}
 
 		case msg := <-r.Broadcast:
-			for _, client := range hub.Rooms[msg.RoomID].Clients {
-				client.Message <- msg
+			if msg.CreatedAt.IsZero() {
+				msg.CreatedAt = time.Now().UTC()
 			}
+
+			r.mu.Lock()
+			if replayable(msg) {
+				r.history.push(msg)
+			}
+			switch {
+			case msg.Type == MessageText && msg.ParentID == "":
+				r.LastMessage = msg
+			case (msg.Type == MessageEdit || msg.Type == MessageDelete) && r.LastMessage != nil && r.LastMessage.ID == msg.ID:
+				updated := *r.LastMessage
+				updated.Content = msg.Content
+				updated.EditedAt = msg.EditedAt
+				updated.Deleted = msg.Deleted
+				r.LastMessage = &updated
+			}
+			r.mu.Unlock()
+
+			switch msg.Type {
+			case MessageTypingStart:
+				_, alreadyTyping := r.typing[msg.UserID]
+				r.typing[msg.UserID] = typist{
+					username:  msg.Username,
+					expiresAt: time.Now().Add(typingTimeout),
+				}
+				if !alreadyTyping {
+					r.deliver(msg)
+				}
+			case MessageTypingStop:
+				r.stopTyping(msg.UserID)
+			case MessageText:
+				// Sending a message ends typing, clients clear the indicator themselves
+				delete(r.typing, msg.UserID)
+				r.deliver(msg)
+			default:
+				r.deliver(msg)
+			}
+
+		case d := <-r.Disconnect:
+			for _, client := range r.connections[d.UserID] {
+				r.drop(client, websocket.ClosePolicyViolation, d.Reason)
+			}
+
+		case <-r.done:
+			for _, client := range r.Clients {
+				r.drop(client, websocket.CloseGoingAway, "Room was deleted")
+			}
+			return
+
+		case now := <-typingExpired:
+			typingTimer, typingExpired = nil, nil
+			for userID, t := range r.typing {
+				if !now.Before(t.expiresAt) {
+					r.stopTyping(userID)
+				}
+			}
+		}
+
+		switch {
+		case len(r.typing) == 0 && typingTimer != nil:
+			typingTimer.Stop()
+			typingTimer, typingExpired = nil, nil
+		case len(r.typing) > 0 && typingTimer == nil:
+			typingTimer = time.NewTimer(time.Until(r.firstTypingExpiry()))
+			typingExpired = typingTimer.C
+		}
+	}
+}
+
+// Tells the client why it is removed from the room. Own connections are
+// closed, the reader then unregisters the client. Only called by run.
+func (r *Room) drop(client *Client, code int, reason string) {
+	switch {
+	case client.session != nil:
+		// Shared connections stay open for the user's other rooms
+		client.session.drop(client, reason)
+		r.unregister(client)
+	case client.Conn == nil:
+		// Streams and polls end once they got the reason
+		r.send(client, &Message{
+			Type:    MessageUnsubscribe,
+			Content: reason,
+			RoomID:  r.ID,
+		})
+		r.unregister(client)
+	default:
+		client.close(code, reason)
+	}
+}
+
+// Removes the client, the user leaves with their last connection. Only called by run.
+func (r *Room) unregister(client *Client) {
+	if _, ok := r.Clients[client.ConnID]; !ok {
+		return
+	}
+
+	r.mu.Lock()
+	delete(r.Clients, client.ConnID)
+	conns := r.connections[client.UserID]
+	delete(conns, client.ConnID)
+	if len(conns) == 0 {
+		delete(r.connections, client.UserID)
+	}
+	r.mu.Unlock()
+
+	// The channel of a shared connection is closed by its session,
+	// that of a replaying client once it is done
+	if client.session == nil && !client.replaying {
+		close(client.Message)
+	}
+
+	if len(conns) == 0 {
+		r.stopTyping(client.UserID)
+		r.deliver(&Message{
+			Type:      MessageLeave,
+			Content:   "User left the chat",
+			RoomID:    r.ID,
+			UserID:    client.UserID,
+			Username:  client.Username,
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+}
+
+// Sends the message to its recipients among the connected clients.
+func (r *Room) deliver(msg *Message) {
+	if msg.wire == nil {
+		msg.wire = newWireCache()
+	}
+	for _, client := range r.Clients {
+		if msg.recipients != nil && !msg.recipients[client.UserID] {
+			continue
+		}
+		// Typing indicators are only for the others
+		if (msg.Type == MessageTypingStart || msg.Type == MessageTypingStop) && client.UserID == msg.UserID {
+			continue
+		}
+		r.send(client, msg)
+	}
+}
+
+// Sends the message to the client, or keeps it until the client is done
+// replaying. The room doesn't wait for clients, one whose channel is full
+// can't keep up and is disconnected.
+func (r *Room) send(client *Client, msg *Message) {
+	if client.slow {
+		return
+	}
+
+	if client.replaying {
+		// Past what the room buffers the client has to refetch anyway
+		if len(client.pending) < resumeBufferSize {
+			client.pending = append(client.pending, msg)
+		} else {
+			client.overflow = true
+		}
+		return
+	}
+
+	select {
+	case client.Message <- msg:
+	default:
+		client.slow = true
+		log.Printf("error: user %s can't keep up with room %s, disconnecting", client.UserID, r.ID)
+		if client.Conn == nil {
+			// Streams and polls end once their channel is closed
+			go r.leave(client)
+		} else {
+			// Readers unregister once the connection is closed, shared ones leave all their rooms
+			go client.close(websocket.CloseTryAgainLater, "Too slow to keep up")
+		}
+	}
+}
+
+func (r *Room) stopTyping(userID string) {
+	t, ok := r.typing[userID]
+	if !ok {
+		return
+	}
+
+	delete(r.typing, userID)
+	r.deliver(&Message{
+		Type:      MessageTypingStop,
+		RoomID:    r.ID,
+		UserID:    userID,
+		Username:  t.username,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// When the first typing indicator expires. Only called by run while someone types.
+func (r *Room) firstTypingExpiry() time.Time {
+	var first time.Time
+	for _, t := range r.typing {
+		if first.IsZero() || t.expiresAt.Before(first) {
+			first = t.expiresAt
 		}
 	}
+	return first
 }
@@ -0,0 +1,327 @@
+package room
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Files which can be uploaded at once and attached to one message
+const maxAttachments = 10
+
+// Uploaded file, MessageID is empty until it is sent in a message.
+type Attachment struct {
+	ID           string    `json:"id"`
+	RoomID       string    `json:"roomId"`
+	UserID       string    `json:"userId"`
+	MessageID    string    `json:"messageId,omitempty"`
+	Name         string    `json:"name"`
+	ContentType  string    `json:"contentType"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	Thumbnail    bool      `json:"-"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnailUrl,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Download URLs check access of the caller, they are not shareable links.
+func (a *Attachment) setURLs() {
+	a.URL = fmt.Sprintf("/rooms/%s/attachments/%s", a.RoomID, a.ID)
+	if a.Thumbnail {
+		a.ThumbnailURL = a.URL + "?thumbnail=true"
+	}
+}
+
+func thumbnailKey(id string) string {
+	return id + "_thumb"
+}
+
+var (
+	errNotMember = errors.New("User is not a member of the room")
+	errBanned    = errors.New("User is banned from the room")
+)
+
+// Members who are not banned can see the files of a room, posting also needs them not muted.
+func (s *service) checkAccess(ctx context.Context, room *Room, userID string, post bool) error {
+	if !room.IsMember(userID) {
+		return errNotMember
+	}
+
+	banned, err := s.repository.IsBanned(ctx, room.ID, userID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return errBanned
+	}
+
+	if post && room.IsMuted(userID) {
+		return errors.New("User is muted in the room")
+	}
+
+	return nil
+}
+
+type UploadAttachmentsReq struct {
+	CallerID string                  `validate:"required"`
+	RoomID   string                  `validate:"required"`
+	Files    []*multipart.FileHeader `validate:"required,min=1,max=10"`
+}
+
+// Stores the files, their IDs are then sent with a message to attach them.
+func (s *service) UploadAttachments(ctx context.Context, req *UploadAttachmentsReq) ([]*Attachment, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkAccess(context, room, req.CallerID, true); err != nil {
+		return nil, err
+	}
+
+	// Files of a failed upload are removed again, the client never learns their IDs
+	attachments := make([]*Attachment, 0, len(req.Files))
+	for _, fh := range req.Files {
+		// Storing files may take longer than a DB call
+		attachment, err := s.storeAttachment(ctx, room, req.CallerID, fh)
+		if err != nil {
+			s.discardBlobs(ctx, attachments)
+			return nil, fmt.Errorf("%s: %w", fh.Filename, err)
+		}
+		attachments = append(attachments, attachment)
+
+		err = s.createAttachment(ctx, attachment)
+		if err != nil {
+			s.discardBlobs(ctx, attachments)
+			return nil, err
+		}
+		attachment.setURLs()
+	}
+
+	return attachments, nil
+}
+
+// Each file gets its own DB timeout, counted after it was stored.
+func (s *service) createAttachment(ctx context.Context, attachment *Attachment) error {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	_, err := s.repository.CreateAttachment(context, attachment)
+	return err
+}
+
+// Deletes the files and thumbnails of the attachments.
+func (s *service) deleteBlobs(ctx context.Context, attachments []*Attachment) error {
+	for _, attachment := range attachments {
+		if err := s.blobs.Delete(ctx, attachment.ID); err != nil {
+			return err
+		}
+		if attachment.Thumbnail {
+			if err := s.blobs.Delete(ctx, thumbnailKey(attachment.ID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Cleans up after a failed upload, which already failed for a reason of its own.
+func (s *service) discardBlobs(ctx context.Context, attachments []*Attachment) {
+	if err := s.deleteBlobs(ctx, attachments); err != nil {
+		log.Printf("error: discarding uploaded files: %v", err)
+	}
+}
+
+// Checks the file against the limits and writes it and its thumbnail to the blob store.
+func (s *service) storeAttachment(ctx context.Context, room *Room, userID string, fh *multipart.FileHeader) (*Attachment, error) {
+	if fh.Size > int64(s.config.MaxAttachmentSize) {
+		return nil, fmt.Errorf("File is larger than %d bytes", s.config.MaxAttachmentSize)
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The declared type can't be trusted, it is detected from the content
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !s.allowedType(contentType) {
+		return nil, fmt.Errorf("Files of type %s are not allowed", contentType)
+	}
+
+	attachment := &Attachment{
+		ID:          ulid.Make().String(),
+		RoomID:      room.ID,
+		UserID:      userID,
+		Name:        fh.Filename,
+		ContentType: contentType,
+		Size:        fh.Size,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	if err := s.blobs.Put(ctx, attachment.ID, io.MultiReader(bytes.NewReader(head[:n]), file)); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		if err := s.storeThumbnail(ctx, attachment, file); err != nil {
+			s.discardBlobs(ctx, []*Attachment{attachment})
+			return nil, err
+		}
+	}
+
+	return attachment, nil
+}
+
+// Images which can't be decoded are still fine as plain files, they just get no thumbnail.
+func (s *service) storeThumbnail(ctx context.Context, attachment *Attachment, file io.ReadSeeker) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	width, height, thumb, err := makeThumbnail(file)
+	if err != nil {
+		return nil
+	}
+	if err := s.blobs.Put(ctx, thumbnailKey(attachment.ID), bytes.NewReader(thumb)); err != nil {
+		return err
+	}
+	attachment.Width, attachment.Height, attachment.Thumbnail = width, height, true
+
+	return nil
+}
+
+func (s *service) allowedType(contentType string) bool {
+	for _, allowed := range s.config.AttachmentTypes {
+		if allowed == contentType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the uploads of the client which can be attached to a new message in the room.
+func (s *service) getPendingAttachments(ctx context.Context, client *Client, room *Room, ids []string) ([]*Attachment, error) {
+	if len(ids) > maxAttachments {
+		return nil, fmt.Errorf("A message can have at most %d attachments", maxAttachments)
+	}
+
+	attachments, err := s.repository.GetAttachmentsByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) != len(ids) {
+		return nil, errors.New("Attachment does not exist")
+	}
+
+	for _, attachment := range attachments {
+		if attachment.RoomID != room.ID || attachment.UserID != client.UserID || attachment.MessageID != "" {
+			return nil, errors.New("Attachment does not exist")
+		}
+		attachment.setURLs()
+	}
+
+	return attachments, nil
+}
+
+func (s *service) loadAttachments(ctx context.Context, messages []*Message) error {
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+
+	attachments, err := s.repository.GetAttachments(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		for _, attachment := range attachments[msg.ID] {
+			attachment.setURLs()
+		}
+		msg.Attachments = attachments[msg.ID]
+	}
+
+	return nil
+}
+
+type GetAttachmentReq struct {
+	CallerID     string `form:"-"         validate:"required"`
+	RoomID       string `form:"-"         validate:"required"`
+	AttachmentID string `form:"-"         validate:"required"`
+	Thumbnail    bool   `form:"thumbnail"`
+}
+
+// Opens the file or its thumbnail for download, the caller closes the reader.
+func (s *service) GetAttachment(ctx context.Context, req *GetAttachmentReq) (*Attachment, io.ReadCloser, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.checkAccess(context, room, req.CallerID, false); err != nil {
+		return nil, nil, err
+	}
+
+	attachment, err := s.repository.GetAttachment(context, req.AttachmentID)
+	if err != nil || attachment.RoomID != room.ID {
+		return nil, nil, errors.New("Attachment does not exist")
+	}
+
+	// Uploads are private to their author until they are sent
+	if attachment.MessageID == "" && attachment.UserID != req.CallerID {
+		return nil, nil, errors.New("Attachment does not exist")
+	}
+
+	key := attachment.ID
+	if req.Thumbnail {
+		if !attachment.Thumbnail {
+			return nil, nil, errors.New("Attachment has no thumbnail")
+		}
+		key = thumbnailKey(attachment.ID)
+		attachment.ContentType = thumbnailType(attachment.ContentType)
+		attachment.Size = -1
+	}
+
+	blob, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return attachment, blob, nil
+}
@@ -0,0 +1,148 @@
+package room
+
+import (
+	"gochatv1/internal/user"
+
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Messages loaded per query while exporting
+const exportPageSize = 500
+
+type ExportRoomReq struct {
+	CallerID string    `form:"-"      validate:"required"`
+	RoomID   string    `form:"-"      validate:"required"`
+	Format   string    `form:"format" validate:"omitempty,oneof=json md html"`
+	From     time.Time `form:"from"   time_format:"2006-01-02"`
+	To       time.Time `form:"to"     time_format:"2006-01-02"`
+}
+
+// Transcript ready to be written, access was checked when it was created
+type ExportRoomRes struct {
+	Filename    string
+	ContentType string
+	service     *service
+	room        *Room
+	req         *ExportRoomReq
+}
+
+// Transcripts are available to the room owner and admins.
+func (s *service) ExportRoom(ctx context.Context, req *ExportRoomReq) (*ExportRoomRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if room.OwnerID != req.CallerID && !user.IsAdmin(s.config, req.CallerID) {
+		return nil, errors.New("Only the room owner or an admin can export the room")
+	}
+
+	if req.Format == "" {
+		req.Format = ExportJSON
+	}
+
+	res := &ExportRoomRes{
+		Filename:    fmt.Sprintf("%s-%s.%s", room.ID, time.Now().UTC().Format("20060102"), req.Format),
+		ContentType: exportContentType(req.Format),
+		service:     s,
+		room:        room,
+		req:         req,
+	}
+
+	return res, nil
+}
+
+// Streams the transcript page by page, flushing after each one.
+func (res *ExportRoomRes) Write(ctx context.Context, w io.Writer) error {
+	s := res.service
+	exp := newExporter(res.req.Format, w)
+
+	err := exp.begin(&exportHeader{RoomID: res.room.ID, Name: res.room.GetName(), ExportedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	var from, to *time.Time
+	if !res.req.From.IsZero() {
+		from = &res.req.From
+	}
+	if !res.req.To.IsZero() {
+		to = &res.req.To
+	}
+
+	after := ""
+	for {
+		page, err := s.getExportPage(ctx, res.room.ID, after, from, to)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range page {
+			if err := exp.message(msg); err != nil {
+				return err
+			}
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if len(page) < exportPageSize {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+
+	return exp.end()
+}
+
+// Loads messages after the given ID with their attachments and earlier revisions.
+func (s *service) getExportPage(ctx context.Context, roomID string, after string, from *time.Time, to *time.Time) ([]*ExportedMessage, error) {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	messages, err := s.repository.GetMessagesAfter(context, roomID, after, from, to, exportPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.loadAttachments(context, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	revisions, err := s.repository.GetRevisions(context, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	page := make([]*ExportedMessage, 0, len(messages))
+	for _, msg := range messages {
+		// Links in a transcript have to work outside of the app
+		for _, a := range msg.Attachments {
+			a.URL = s.config.PublicURL + a.URL
+			if a.ThumbnailURL != "" {
+				a.ThumbnailURL = s.config.PublicURL + a.ThumbnailURL
+			}
+		}
+		page = append(page, &ExportedMessage{Message: msg, Revisions: revisions[msg.ID]})
+	}
+
+	return page, nil
+}
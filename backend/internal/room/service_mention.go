@@ -0,0 +1,146 @@
+package room
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// @username at the start of the content or after a space
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@([\pL\pN_.\-]+)`)
+
+// Mentions everyone who can be reached in the room
+const mentionRoom = "room"
+
+// Returns the mentioned usernames and whether the whole room is mentioned.
+func parseMentions(content string) ([]string, bool) {
+	usernames := make([]string, 0)
+	everyone := false
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// Trailing dots are punctuation, not part of the name
+		name := strings.TrimRight(match[1], ".")
+		if name == mentionRoom {
+			everyone = true
+			continue
+		}
+		if name != "" {
+			usernames = append(usernames, name)
+		}
+	}
+
+	return usernames, everyone
+}
+
+// Resolves mentions in the message, stores them and pushes a mention event to
+// all connections of the mentioned users. Returns who was mentioned.
+func (s *service) notifyMentions(ctx context.Context, room *Room, msg *Message) (map[string]bool, error) {
+	usernames, everyone := parseMentions(msg.Content)
+	if len(usernames) == 0 && !everyone {
+		return nil, nil
+	}
+
+	userIDs := make([]string, 0)
+	if len(usernames) > 0 {
+		ids, err := s.repository.GetUserIDsByUsernames(ctx, usernames)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, ids...)
+	}
+	if everyone {
+		userIDs = append(userIDs, room.UserIDs()...)
+	}
+
+	recipients := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		// Nobody is notified about their own message or about a room they can't see
+		if userID != msg.UserID && room.IsMember(userID) {
+			recipients[userID] = true
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	mentioned := make([]string, 0, len(recipients))
+	for userID := range recipients {
+		mentioned = append(mentioned, userID)
+	}
+
+	err := s.repository.CreateMentions(ctx, msg, mentioned)
+	if err != nil {
+		return nil, err
+	}
+
+	mention := *msg
+	mention.Type = MessageMention
+	mention.recipients = recipients
+	s.hub.sendToUsers(&mention, mentioned)
+
+	return recipients, nil
+}
+
+// Delivers the message to every room where one of the users is connected,
+// only those users receive it.
+func (h *Hub) sendToUsers(msg *Message, userIDs []string) {
+	// Rooms would set it concurrently
+	msg.wire = newWireCache()
+
+	h.mu.RLock()
+	rooms := make([]*Room, 0)
+	for _, room := range h.Rooms {
+		room.mu.RLock()
+		for _, userID := range userIDs {
+			if _, ok := room.connections[userID]; ok {
+				rooms = append(rooms, room)
+				break
+			}
+		}
+		room.mu.RUnlock()
+	}
+	h.mu.RUnlock()
+
+	for _, room := range rooms {
+		room.broadcast(msg)
+	}
+}
+
+type GetMentionsReq struct {
+	CallerID string `form:"-"      validate:"required"`
+	Before   string `form:"before"`
+	Limit    int    `form:"limit"  validate:"min=0,max=100"`
+}
+
+// Returns messages mentioning the caller, newest first. Use the ID of the
+// oldest one as Before for the next page.
+func (s *service) GetMentions(ctx context.Context, req *GetMentionsReq) ([]*Message, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = 50
+	}
+
+	messages, err := s.repository.GetMentions(context, req.CallerID, req.Before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop mentions from private rooms the caller has left since
+	res := make([]*Message, 0, len(messages))
+	for _, msg := range messages {
+		room, err := s.repository.GetRoom(context, msg.RoomID)
+		if err == nil && !room.IsMember(req.CallerID) {
+			continue
+		}
+		res = append(res, msg)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,274 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Stores a chat message in history and broadcasts it to the room,
+// messages with a parent go to its thread. Returns the ID of the new message.
+func (s *service) sendMessage(ctx context.Context, client *Client, room *Room, content string, parentID string, attachmentIDs []string) (string, error) {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	var attachments []*Attachment
+	if len(attachmentIDs) > 0 {
+		var err error
+		attachments, err = s.getPendingAttachments(context, client, room, attachmentIDs)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	msg := &Message{
+		ID:        ulid.Make().String(),
+		Type:      MessageText,
+		Content:   content,
+		RoomID:    room.ID,
+		UserID:    client.UserID,
+		Username:  client.Username,
+		CreatedAt: time.Now().UTC(),
+
+		Attachments: attachments,
+	}
+
+	if parentID != "" {
+		return msg.ID, s.sendReply(context, room, msg, parentID)
+	}
+
+	msg, err := s.repository.CreateMessage(context, msg)
+	if err != nil {
+		return "", err
+	}
+
+	room.broadcast(msg)
+	s.notifyRecipients(context, room, msg)
+	return msg.ID, nil
+}
+
+// Returns a message of the room which is not deleted yet.
+func (s *service) getMessage(ctx context.Context, room *Room, id string) (*Message, error) {
+	msg, err := s.repository.GetMessage(ctx, id)
+	if err != nil || msg.RoomID != room.ID || msg.Deleted {
+		return nil, errors.New("Message does not exist")
+	}
+
+	return msg, nil
+}
+
+// Only the author can edit a message, within the configured edit window.
+func (s *service) editMessage(ctx context.Context, client *Client, room *Room, id string, content string) error {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	msg, err := s.getMessage(context, room, id)
+	if err != nil {
+		return err
+	}
+
+	if msg.UserID != client.UserID {
+		return errors.New("Only the author can edit a message")
+	}
+
+	now := time.Now().UTC()
+	if s.config.EditWindow > 0 && now.Sub(msg.CreatedAt) > s.config.EditWindow {
+		return errors.New("Message can no longer be edited")
+	}
+
+	err = s.repository.EditMessage(context, msg.ID, content, now)
+	if err != nil {
+		return err
+	}
+
+	msg.Type = MessageEdit
+	msg.Content = content
+	msg.EditedAt = &now
+	if msg.ParentID != "" {
+		msg.recipients, err = s.threadRecipients(context, msg.ParentID)
+		if err != nil {
+			return err
+		}
+	}
+	room.broadcast(msg)
+
+	return nil
+}
+
+// Authors can delete their messages, moderators anyone's.
+func (s *service) deleteMessage(ctx context.Context, client *Client, room *Room, id string) error {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	msg, err := s.getMessage(context, room, id)
+	if err != nil {
+		return err
+	}
+
+	if msg.UserID != client.UserID && !room.IsModerator(client.UserID) {
+		return errors.New("Only the author or a moderator can delete a message")
+	}
+
+	err = s.repository.DeleteMessage(context, msg.ID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	msg.Type = MessageDelete
+	msg.Content = ""
+	msg.Deleted = true
+	if msg.ParentID != "" {
+		msg.recipients, err = s.threadRecipients(context, msg.ParentID)
+		if err != nil {
+			return err
+		}
+	}
+	room.broadcast(msg)
+
+	return nil
+}
+
+// Adds or removes a reaction of the client and broadcasts the new count.
+func (s *service) react(ctx context.Context, client *Client, room *Room, id string, emoji string, add bool) error {
+	if !isEmoji(emoji) {
+		return errors.New("Reaction must be a single emoji")
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	msg, err := s.getMessage(context, room, id)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	eventType := MessageReact
+	if add {
+		count, err = s.repository.AddReaction(context, msg.ID, client.UserID, emoji)
+	} else {
+		eventType = MessageUnreact
+		count, err = s.repository.RemoveReaction(context, msg.ID, client.UserID, emoji)
+	}
+	if err != nil {
+		return err
+	}
+
+	event := &Message{
+		ID:       msg.ID,
+		Type:     eventType,
+		RoomID:   room.ID,
+		UserID:   client.UserID,
+		Username: client.Username,
+		Emoji:    emoji,
+		Count:    &count,
+		ParentID: msg.ParentID,
+	}
+	if msg.ParentID != "" {
+		event.recipients, err = s.threadRecipients(context, msg.ParentID)
+		if err != nil {
+			return err
+		}
+	}
+	room.broadcast(event)
+
+	return nil
+}
+
+type GetMessagesReq struct {
+	CallerID string `form:"-"      validate:"required"`
+	RoomID   string `form:"-"      validate:"required"`
+	Before   string `form:"before"`
+	Limit    int    `form:"limit"  validate:"min=0,max=100"`
+}
+
+// Returns a page of history, use the ID of the oldest message as Before for the next one.
+func (s *service) GetMessages(ctx context.Context, req *GetMessagesReq) ([]*Message, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkAccess(context, room, req.CallerID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = 50
+	}
+
+	messages, err := s.repository.GetMessages(context, room.ID, req.Before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.attachReactions(context, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, s.loadAttachments(context, messages)
+}
+
+func (s *service) attachReactions(ctx context.Context, messages []*Message) error {
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+
+	reactions, err := s.repository.GetReactions(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		msg.Reactions = reactions[msg.ID]
+	}
+
+	return nil
+}
+
+type GetMessageEditsReq struct {
+	CallerID  string `json:"-" validate:"required"`
+	RoomID    string `json:"-" validate:"required"`
+	MessageID string `json:"-" validate:"required"`
+}
+
+// Edit history is visible to the author and moderators.
+func (s *service) GetMessageEdits(ctx context.Context, req *GetMessageEditsReq) ([]*MessageRevision, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := s.repository.GetMessage(context, req.MessageID)
+	if err != nil || msg.RoomID != room.ID {
+		return nil, errors.New("Message does not exist")
+	}
+
+	if msg.UserID != req.CallerID && !room.IsModerator(req.CallerID) {
+		return nil, errors.New("Only the author or a moderator can see edit history")
+	}
+
+	return s.repository.GetMessageEdits(context, msg.ID)
+}
@@ -0,0 +1,210 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type ModerateReq struct {
+	CallerID string `json:"-"        validate:"required"`
+	Username string `json:"-"` // of the caller
+	RoomID   string `json:"-"        validate:"required"`
+	UserID   string `json:"userId"   validate:"required,nefield=CallerID"`
+	Reason   string `json:"reason"   validate:"max=500"`
+	Duration int    `json:"duration" validate:"min=0"` // seconds, 0 means no expiry (ban, mute)
+}
+
+func (s *service) Kick(ctx context.Context, req *ModerateReq) error {
+	return s.moderate(ctx, req, MessageKick)
+}
+
+func (s *service) Ban(ctx context.Context, req *ModerateReq) error {
+	return s.moderate(ctx, req, MessageBan)
+}
+
+func (s *service) Unban(ctx context.Context, req *ModerateReq) error {
+	return s.moderate(ctx, req, MessageUnban)
+}
+
+func (s *service) Mute(ctx context.Context, req *ModerateReq) error {
+	return s.moderate(ctx, req, MessageMute)
+}
+
+func (s *service) Unmute(ctx context.Context, req *ModerateReq) error {
+	return s.moderate(ctx, req, MessageUnmute)
+}
+
+func (s *service) AddModerator(ctx context.Context, req *ModerateReq) error {
+	return s.moderate(ctx, req, MessageModeratorAdd)
+}
+
+// Applies a moderation action, records it in the audit log and tells the room about it.
+func (s *service) moderate(ctx context.Context, req *ModerateReq, action string) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return err
+	}
+
+	if action == MessageModeratorAdd {
+		if room.OwnerID != req.CallerID {
+			return errors.New("Only the room owner can add moderators")
+		}
+	} else if !room.IsModerator(req.CallerID) {
+		return fmt.Errorf("Only moderators can %s users", action)
+	}
+
+	if room.OwnerID == req.UserID {
+		return errors.New("Room owner can't be moderated")
+	}
+
+	username, err := s.repository.GetUsername(context, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if req.Duration > 0 && (action == MessageBan || action == MessageMute) {
+		t := time.Now().Add(time.Duration(req.Duration) * time.Second)
+		expiresAt = &t
+	}
+
+	switch action {
+	case MessageBan:
+		_, err = s.repository.CreateBan(context, &Ban{
+			RoomID:    room.ID,
+			UserID:    req.UserID,
+			Reason:    req.Reason,
+			CreatedBy: req.CallerID,
+			ExpiresAt: expiresAt,
+		})
+	case MessageUnban:
+		err = s.repository.DeleteBan(context, room.ID, req.UserID)
+	case MessageMute:
+		_, err = s.repository.CreateMute(context, &Mute{
+			RoomID:    room.ID,
+			UserID:    req.UserID,
+			CreatedBy: req.CallerID,
+			ExpiresAt: expiresAt,
+		})
+	case MessageUnmute:
+		err = s.repository.DeleteMute(context, room.ID, req.UserID)
+	case MessageModeratorAdd:
+		err = s.repository.CreateModerator(context, room.ID, req.UserID, req.CallerID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The room only keeps what was stored, see LoadRooms
+	switch action {
+	case MessageMute:
+		var until time.Time
+		if expiresAt != nil {
+			until = *expiresAt
+		}
+		room.Mute(req.UserID, until)
+	case MessageUnmute:
+		room.Unmute(req.UserID)
+	case MessageModeratorAdd:
+		room.AddModerator(req.UserID)
+	}
+
+	_, err = s.repository.CreateAuditEntry(context, &AuditEntry{
+		RoomID:    room.ID,
+		ActorID:   req.CallerID,
+		Action:    action,
+		TargetID:  req.UserID,
+		Reason:    req.Reason,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	room.broadcast(&Message{
+		Type:      action,
+		Content:   req.Reason,
+		RoomID:    room.ID,
+		UserID:    req.UserID,
+		Username:  username,
+		ActorID:   req.CallerID,
+		ActorName: req.Username,
+	})
+
+	if action == MessageKick || action == MessageBan {
+		reason := "You were removed from the room"
+		if req.Reason != "" {
+			reason = req.Reason
+		}
+		room.disconnect(&Disconnect{
+			UserID: req.UserID,
+			Reason: reason,
+		})
+	}
+
+	return nil
+}
+
+type GetAuditLogReq struct {
+	CallerID string `json:"-" validate:"required"`
+	RoomID   string `json:"-" validate:"required"`
+}
+
+type GetAuditLogRes struct {
+	ID        int64      `json:"id"`
+	ActorID   string     `json:"actorId"`
+	Action    string     `json:"action"`
+	TargetID  string     `json:"targetId"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+func (s *service) GetAuditLog(ctx context.Context, req *GetAuditLogReq) ([]GetAuditLogRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !room.IsModerator(req.CallerID) {
+		return nil, errors.New("Only moderators can see the audit log")
+	}
+
+	entries, err := s.repository.GetAuditLog(context, room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]GetAuditLogRes, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, GetAuditLogRes{
+			ID:        e.ID,
+			ActorID:   e.ActorID,
+			Action:    e.Action,
+			TargetID:  e.TargetID,
+			Reason:    e.Reason,
+			ExpiresAt: e.ExpiresAt,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+
+	return res, nil
+}
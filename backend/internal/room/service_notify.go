@@ -0,0 +1,76 @@
+package room
+
+import (
+	"gochatv1/internal/notification"
+
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Tells mentioned and offline users about a delivered message. The message is
+// stored and broadcast already, failing now would only make the client resend it.
+func (s *service) notifyRecipients(ctx context.Context, room *Room, msg *Message) {
+	mentioned, err := s.notifyMentions(ctx, room, msg)
+	if err != nil {
+		log.Printf("error: mentions in message %s: %v", msg.ID, err)
+	}
+
+	s.notifyOffline(room, msg, mentioned)
+}
+
+// Notifies offline users about the message: mentioned users anywhere, members
+// of direct rooms and groups about every message. The notifier looks up their
+// settings in the background, failures are only logged since the message itself
+// has been delivered already.
+func (s *service) notifyOffline(room *Room, msg *Message, mentioned map[string]bool) {
+	notifications := make([]*notification.Notification, 0)
+	notify := func(userID string, kind string, title string) {
+		if s.hub.Presence.Status(userID) != StatusOffline {
+			return
+		}
+
+		notifications = append(notifications, &notification.Notification{
+			ID:        ulid.Make().String(),
+			Kind:      kind,
+			UserID:    userID,
+			RoomID:    room.ID,
+			MessageID: msg.ID,
+			Title:     title,
+			Body:      msg.Content,
+			CreatedAt: msg.CreatedAt,
+		})
+	}
+
+	for userID := range mentioned {
+		notify(userID, notification.KindMention, fmt.Sprintf("%s mentioned you in %s", msg.Username, room.GetName()))
+	}
+
+	if room.Kind != KindRoom {
+		for _, userID := range room.MemberIDs() {
+			if userID == msg.UserID || mentioned[userID] {
+				continue
+			}
+
+			if room.Kind == KindDirect {
+				notify(userID, notification.KindDirect, fmt.Sprintf("%s sent you a message", msg.Username))
+			} else {
+				notify(userID, notification.KindMessage, fmt.Sprintf("%s in %s", msg.Username, room.GetName()))
+			}
+		}
+	}
+
+	if len(notifications) == 0 {
+		return
+	}
+
+	// Not tied to the sender's request, which is done before the lookup is
+	go func() {
+		err := s.notifier.Notify(context.Background(), notifications...)
+		if err != nil {
+			log.Printf("error: notify about message %s: %v", msg.ID, err)
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package room
+
+import (
+	"context"
+	"errors"
+)
+
+// Moves the read position of the client forward and, if enabled, lets the room know.
+func (s *service) markRead(ctx context.Context, client *Client, room *Room, id string) error {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	msg, err := s.repository.GetMessage(context, id)
+	if err != nil || msg.RoomID != room.ID {
+		return errors.New("Message does not exist")
+	}
+
+	err = s.repository.SetReadPosition(context, room.ID, client.UserID, msg.ID)
+	if err != nil {
+		return err
+	}
+
+	if s.config.BroadcastReads {
+		room.broadcast(&Message{
+			ID:       msg.ID,
+			Type:     MessageRead,
+			RoomID:   room.ID,
+			UserID:   client.UserID,
+			Username: client.Username,
+		})
+	}
+
+	return nil
+}
+
+type GetReadPositionsReq struct {
+	CallerID string `json:"-" validate:"required"`
+	RoomID   string `json:"-" validate:"required"`
+}
+
+// Returns how far each member has read the room, used to show "seen by".
+func (s *service) GetReadPositions(ctx context.Context, req *GetReadPositionsReq) ([]*ReadPosition, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.config.BroadcastReads {
+		return nil, errors.New("Read receipts are disabled")
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkAccess(context, room, req.CallerID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repository.GetReadPositions(context, room.ID)
+}
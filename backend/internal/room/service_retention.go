@@ -0,0 +1,298 @@
+package room
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Audit log action of retention policy changes
+const auditRetention = "retention"
+
+// Retention of a room overriding the server default, nil limits inherit the
+// default. Rooms on legal hold are never pruned.
+type RetentionPolicy struct {
+	RoomID     string    `json:"roomId"`
+	MaxAgeDays *int      `json:"maxAgeDays" validate:"omitempty,min=1"`
+	MaxCount   *int      `json:"maxCount"   validate:"omitempty,min=1"`
+	LegalHold  bool      `json:"legalHold"`
+	UpdatedBy  string    `json:"updatedBy"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Summary of the limits for the audit log.
+func (p *RetentionPolicy) describe() string {
+	limit := func(v *int) string {
+		if v == nil {
+			return "default"
+		}
+		return fmt.Sprint(*v)
+	}
+
+	return fmt.Sprintf("max age days: %s, max count: %s, legal hold: %t", limit(p.MaxAgeDays), limit(p.MaxCount), p.LegalHold)
+}
+
+// Messages pruned from a room by one janitor pass
+type RetentionRun struct {
+	ID        int64      `json:"id"`
+	RoomID    string     `json:"roomId"`
+	Pruned    int        `json:"pruned"`
+	Archived  bool       `json:"archived"`
+	Cutoff    *time.Time `json:"cutoff,omitempty"`
+	MaxCount  int        `json:"maxCount,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Prunes expired messages of every room on each interval, 0 disables pruning.
+func runJanitor(svc Service, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := svc.PruneExpired(context.Background()); err != nil {
+			log.Printf("error: retention: %v", err)
+		}
+	}
+}
+
+// Applies retention to all rooms and returns what was pruned. Messages are
+// removed in batches, each batch is a separate statement so the janitor never
+// holds locks for long. A room which fails is logged and left for the next pass.
+func (s *service) PruneExpired(ctx context.Context) ([]*RetentionRun, error) {
+	policies, rooms, err := s.getRetentionTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byRoom := make(map[string]*RetentionPolicy, len(policies))
+	for _, policy := range policies {
+		byRoom[policy.RoomID] = policy
+	}
+
+	runs := make([]*RetentionRun, 0)
+	for _, room := range rooms {
+		run, err := s.pruneRoom(ctx, room, byRoom[room.ID])
+		if err != nil {
+			log.Printf("error: retention of room %s: %v", room.ID, err)
+			continue
+		}
+		if run != nil {
+			runs = append(runs, run)
+		}
+	}
+
+	return runs, nil
+}
+
+func (s *service) getRetentionTargets(ctx context.Context) ([]*RetentionPolicy, []*Room, error) {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	policies, err := s.repository.GetRetentionPolicies(context)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rooms, err := s.repository.GetRooms(context)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return policies, rooms, nil
+}
+
+// Returns nil if the room has no retention or nothing expired.
+func (s *service) pruneRoom(ctx context.Context, room *Room, policy *RetentionPolicy) (*RetentionRun, error) {
+	maxAgeDays, maxCount := s.config.RetentionMaxAgeDays, s.config.RetentionMaxCount
+	if policy != nil {
+		if policy.LegalHold {
+			return nil, nil
+		}
+		if policy.MaxAgeDays != nil {
+			maxAgeDays = *policy.MaxAgeDays
+		}
+		if policy.MaxCount != nil {
+			maxCount = *policy.MaxCount
+		}
+	}
+	if maxAgeDays == 0 && maxCount == 0 {
+		return nil, nil
+	}
+
+	run := &RetentionRun{RoomID: room.ID, Archived: s.config.RetentionArchive, MaxCount: maxCount}
+	if maxAgeDays > 0 {
+		cutoff := time.Now().UTC().AddDate(0, 0, -maxAgeDays)
+		run.Cutoff = &cutoff
+	}
+
+	for {
+		ids, err := s.pruneBatch(ctx, run)
+		if err != nil {
+			return nil, err
+		}
+		room.forget(ids)
+		run.Pruned += len(ids)
+		if len(ids) < s.config.RetentionBatch {
+			break
+		}
+	}
+
+	if run.Pruned == 0 {
+		return nil, nil
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	return s.repository.CreateRetentionRun(context, run)
+}
+
+// Removes one batch and, unless archiving, the files attached to it.
+func (s *service) pruneBatch(ctx context.Context, run *RetentionRun) ([]string, error) {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	ids, err := s.repository.PruneMessages(context, run.RoomID, run.Cutoff, run.MaxCount, s.config.RetentionBatch, run.Archived)
+	if err != nil || run.Archived || len(ids) == 0 {
+		return ids, err
+	}
+
+	attachments, err := s.repository.DeleteAttachments(context, ids)
+	if err != nil {
+		return nil, err
+	}
+	err = s.deleteBlobs(context, attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+type RetentionPoliciesRes struct {
+	DefaultMaxAgeDays int                `json:"defaultMaxAgeDays"`
+	DefaultMaxCount   int                `json:"defaultMaxCount"`
+	Archive           bool               `json:"archive"`
+	Rooms             []*RetentionPolicy `json:"rooms"`
+}
+
+func (s *service) GetRetentionPolicies(ctx context.Context) (*RetentionPoliciesRes, error) {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	policies, err := s.repository.GetRetentionPolicies(context)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RetentionPoliciesRes{
+		DefaultMaxAgeDays: s.config.RetentionMaxAgeDays,
+		DefaultMaxCount:   s.config.RetentionMaxCount,
+		Archive:           s.config.RetentionArchive,
+		Rooms:             policies,
+	}
+
+	return res, nil
+}
+
+type SetRetentionPolicyReq struct {
+	CallerID string `json:"-" validate:"required"`
+	RoomID   string `json:"-" validate:"required"`
+	RetentionPolicy
+}
+
+// Replaces the policy of the room, the change is written to its audit log.
+func (s *service) SetRetentionPolicy(ctx context.Context, req *SetRetentionPolicyReq) (*RetentionPolicy, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := req.RetentionPolicy
+	policy.RoomID = room.ID
+	policy.UpdatedBy = req.CallerID
+	policy.UpdatedAt = time.Now().UTC()
+
+	err = s.repository.SetRetentionPolicy(context, &policy)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.repository.CreateAuditEntry(context, &AuditEntry{
+		RoomID:  room.ID,
+		ActorID: req.CallerID,
+		Action:  auditRetention,
+		Reason:  policy.describe(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+type DeleteRetentionPolicyReq struct {
+	CallerID string `json:"-" validate:"required"`
+	RoomID   string `json:"-" validate:"required"`
+}
+
+// The room falls back to the server default.
+func (s *service) DeleteRetentionPolicy(ctx context.Context, req *DeleteRetentionPolicyReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	err = s.repository.DeleteRetentionPolicy(context, req.RoomID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.repository.CreateAuditEntry(context, &AuditEntry{
+		RoomID:  req.RoomID,
+		ActorID: req.CallerID,
+		Action:  auditRetention,
+		Reason:  "server default",
+	})
+	return err
+}
+
+type GetRetentionRunsReq struct {
+	RoomID string `form:"room"`
+	Before int64  `form:"before"`
+	Limit  int    `form:"limit"  validate:"min=0,max=100"`
+}
+
+// Returns the latest janitor passes, use the ID of the oldest as Before for the next page.
+func (s *service) GetRetentionRuns(ctx context.Context, req *GetRetentionRunsReq) ([]*RetentionRun, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = 50
+	}
+
+	return s.repository.GetRetentionRuns(context, req.RoomID, req.Before, limit)
+}
@@ -0,0 +1,109 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Search hit, Highlight is HTML escaped content with matches wrapped in <mark>
+type SearchResult struct {
+	*Message
+	Highlight string `json:"highlight"`
+}
+
+// Filters of a search, RoomIDs are the rooms the caller can access
+type SearchQuery struct {
+	Text     string
+	RoomIDs  []string
+	Username string
+	After    *time.Time
+	Before   *time.Time
+	Limit    int
+	Offset   int
+}
+
+type SearchReq struct {
+	CallerID string    `form:"-"      validate:"required"`
+	Query    string    `form:"q"      validate:"required,max=200"`
+	RoomID   string    `form:"room"`
+	From     string    `form:"from"` // username of the author
+	After    time.Time `form:"after"  time_format:"2006-01-02"`
+	Before   time.Time `form:"before" time_format:"2006-01-02"`
+	Limit    int       `form:"limit"  validate:"min=0,max=100"`
+	Offset   int       `form:"offset" validate:"min=0,max=1000"`
+}
+
+// Searches messages of every room the caller can access, or of a single one,
+// best matches first. Use Offset for the next page.
+func (s *service) Search(ctx context.Context, req *SearchReq) ([]*SearchResult, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	var rooms []*Room
+	if req.RoomID != "" {
+		room, err := s.repository.GetRoom(context, req.RoomID)
+		if err != nil {
+			return nil, err
+		}
+		err = s.checkAccess(context, room, req.CallerID, false)
+		if err != nil {
+			return nil, err
+		}
+		rooms = []*Room{room}
+	} else {
+		rooms, err = s.repository.GetRooms(context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := &SearchQuery{
+		Text:     req.Query,
+		RoomIDs:  make([]string, 0, len(rooms)),
+		Username: req.From,
+		Limit:    req.Limit,
+		Offset:   req.Offset,
+	}
+	for _, room := range rooms {
+		err = s.checkAccess(context, room, req.CallerID, false)
+		if errors.Is(err, errNotMember) || errors.Is(err, errBanned) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		query.RoomIDs = append(query.RoomIDs, room.ID)
+	}
+	if !req.After.IsZero() {
+		query.After = &req.After
+	}
+	if !req.Before.IsZero() {
+		query.Before = &req.Before
+	}
+	if query.Limit == 0 {
+		query.Limit = 20
+	}
+
+	results, err := s.repository.SearchMessages(context, query)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0, len(results))
+	for _, result := range results {
+		messages = append(messages, result.Message)
+	}
+
+	err = s.attachReactions(context, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, s.loadAttachments(context, messages)
+}
@@ -0,0 +1,333 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Messages a poller keeps for its next poll, older ones are dropped and the
+// gap shows in the sequence numbers
+const pollBufferSize = 256
+
+// A room's messages for a receiver without a websocket, e.g. server-sent events.
+// Its client is in the room like any other, so it sees the same messages.
+type Stream struct {
+	Message <-chan *Message
+
+	client *Client
+	room   *Room
+	svc    *service
+	once   sync.Once
+}
+
+type OpenStreamReq struct {
+	CallerID      string `json:"-" validate:"required"`
+	Username      string `json:"-" validate:"required"`
+	RoomID        string `json:"-" validate:"required"`
+	LastMessageID string `json:"lastMessageId"`
+}
+
+func (s *service) OpenStream(ctx context.Context, req *OpenStreamReq) (*Stream, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	room, client, err := s.openClient(ctx, req.CallerID, req.Username, req.RoomID, req.LastMessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stream{Message: client.Message, client: client, room: room, svc: s}, nil
+}
+
+// Leaves the room. The channel is closed once the room let go of the client.
+func (st *Stream) Close() {
+	st.once.Do(func() {
+		go func() {
+			for range st.client.Message {
+			}
+		}()
+		st.svc.leave(st.room, st.client)
+	})
+}
+
+// Registers a client without a connection, its messages are read from the channel.
+func (s *service) openClient(ctx context.Context, userID, username, roomID, lastMessageID string) (*Room, *Client, error) {
+	room, err := s.repository.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := &Client{
+		Message:  make(chan *Message, clientBufferSize),
+		ConnID:   ulid.Make().String(),
+		UserID:   userID,
+		RoomID:   room.ID,
+		Username: username,
+
+		resumeFrom: lastMessageID,
+	}
+
+	err = s.register(ctx, room, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The caller starts reading once this returns
+	go room.replay(client)
+
+	return room, client, nil
+}
+
+// Collects a room's messages between long polls. Messages stay until a poll
+// confirms them, so a response lost on the way is sent again.
+type poller struct {
+	ID     string
+	client *Client
+	room   *Room
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	pending []*Message
+	seq     uint64
+	polled  time.Time
+	closed  bool
+}
+
+type PollReq struct {
+	CallerID      string `form:"-" validate:"required"`
+	Username      string `form:"-" validate:"required"`
+	RoomID        string `form:"-" validate:"required"`
+	PollID        string `form:"pollId"`
+	After         uint64 `form:"after"` // Sequence number of the last message received
+	LastMessageID string `form:"lastMessageId"`
+}
+
+type PollRes struct {
+	PollID   string     `json:"pollId"`
+	Messages []*Message `json:"messages"`
+}
+
+// Waits for messages newer than After, up to the long poll timeout. Without
+// a PollID a new poller joins the room, its ID is used for the following polls.
+func (s *service) Poll(ctx context.Context, req *PollReq) (*PollRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := s.getPoller(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.config.LongPollTimeout)
+	defer timer.Stop()
+
+	for {
+		msgs, closed := p.take(req.After)
+		if len(msgs) > 0 {
+			return &PollRes{PollID: p.ID, Messages: msgs}, nil
+		}
+		if closed {
+			s.removePoller(p)
+			return nil, errors.New("Poll has ended")
+		}
+
+		select {
+		case <-p.wake:
+		case <-timer.C:
+			return &PollRes{PollID: p.ID, Messages: make([]*Message, 0)}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *service) getPoller(ctx context.Context, req *PollReq) (*poller, error) {
+	if req.PollID != "" {
+		s.hub.mu.RLock()
+		p, ok := s.hub.polls[req.PollID]
+		s.hub.mu.RUnlock()
+		if !ok || p.client.UserID != req.CallerID || p.room.ID != req.RoomID {
+			return nil, errors.New("Unknown poll")
+		}
+		return p, nil
+	}
+
+	room, client, err := s.openClient(ctx, req.CallerID, req.Username, req.RoomID, req.LastMessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &poller{
+		ID:     client.ConnID,
+		client: client,
+		room:   room,
+		wake:   make(chan struct{}, 1),
+		polled: time.Now(),
+	}
+
+	s.hub.mu.Lock()
+	s.hub.polls[p.ID] = p
+	s.hub.mu.Unlock()
+
+	go s.pump(p)
+	return p, nil
+}
+
+func (s *service) removePoller(p *poller) {
+	s.hub.mu.Lock()
+	delete(s.hub.polls, p.ID)
+	s.hub.mu.Unlock()
+}
+
+// Moves the room's messages to the poller until the room lets go of its client.
+// A poller not polled for twice the timeout leaves the room.
+func (s *service) pump(p *poller) {
+	ticker := time.NewTicker(s.config.LongPollTimeout)
+	defer ticker.Stop()
+
+	messages := p.client.Message
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				// Kept a while longer for polls to pick up the rest, e.g. why it was kicked
+				messages = nil
+				p.close()
+				s.hub.Presence.Disconnect(p.client.UserID, p.room.ID)
+				continue
+			}
+			p.push(msg)
+
+		case <-ticker.C:
+			if !p.idle(2 * s.config.LongPollTimeout) {
+				continue
+			}
+			if messages == nil {
+				s.removePoller(p)
+				return
+			}
+
+			// The room may be waiting for this loop to take a message
+			go p.room.leave(p.client)
+		}
+	}
+}
+
+func (p *poller) push(msg *Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Messages are shared by all clients of the room
+	p.seq++
+	numbered := *msg
+	numbered.Seq = p.seq
+	if len(p.pending) == pollBufferSize {
+		p.pending = p.pending[1:]
+	}
+	p.pending = append(p.pending, &numbered)
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *poller) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Drops the messages up to after and returns the rest.
+func (p *poller) take(after uint64) ([]*Message, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.polled = time.Now()
+	for len(p.pending) > 0 && p.pending[0].Seq <= after {
+		p.pending = p.pending[1:]
+	}
+
+	msgs := make([]*Message, len(p.pending))
+	copy(msgs, p.pending)
+	return msgs, p.closed
+}
+
+func (p *poller) idle(d time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return time.Since(p.polled) > d
+}
+
+type PostCommandReq struct {
+	CallerID string `validate:"required"`
+	Username string `validate:"required"`
+	RoomID   string `validate:"required"`
+	Command  Command
+}
+
+type PostCommandRes struct {
+	ID string `json:"id"`
+}
+
+// Runs a command sent over HTTP as if it came from a websocket in the room.
+// A text message is assumed when the command has no type.
+func (s *service) PostCommand(ctx context.Context, req *PostCommandReq) (*PostCommandRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.repository.GetRoom(ctx, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if !room.IsMember(req.CallerID) {
+		return nil, errors.New("User is not a member of the room")
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	banned, err := s.repository.IsBanned(context, room.ID, req.CallerID)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		return nil, errors.New("User is banned from the room")
+	}
+
+	cmd := req.Command
+	if cmd.Type == "" {
+		cmd.Type = MessageText
+	}
+
+	client := &Client{
+		ConnID:   ulid.Make().String(),
+		UserID:   req.CallerID,
+		RoomID:   room.ID,
+		Username: req.Username,
+	}
+	s.hub.Presence.Touch(req.CallerID)
+
+	id, err := s.execute(ctx, client, room, &cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostCommandRes{ID: id}, nil
+}
@@ -0,0 +1,1096 @@
+package room_test
+
+import (
+	"gochatv1/config"
+	"gochatv1/internal/notification"
+	"gochatv1/internal/room"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/go-cmp/cmp"
+)
+
+// In-memory repository which stubs the DB backed lookups used outside of message handling
+type testRepository struct {
+	room.Repository
+}
+
+func (r *testRepository) SaveRoom(ctx context.Context, rm *room.Room) error {
+	return nil
+}
+
+func (r *testRepository) DeleteSavedRoom(ctx context.Context, id string) error {
+	return nil
+}
+
+func (r *testRepository) IsBanned(ctx context.Context, roomID string, userID string) (bool, error) {
+	return false, nil
+}
+
+func (r *testRepository) CreateMute(ctx context.Context, mute *room.Mute) (*room.Mute, error) {
+	return mute, nil
+}
+
+func (r *testRepository) CreateAuditEntry(ctx context.Context, entry *room.AuditEntry) (*room.AuditEntry, error) {
+	return entry, nil
+}
+
+func (r *testRepository) CreateMessage(ctx context.Context, msg *room.Message) (*room.Message, error) {
+	return msg, nil
+}
+
+// Nothing is stored, so nothing is unread, see messageRepository for counts
+func (r *testRepository) GetUnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]room.UnreadCount, error) {
+	return map[string]room.UnreadCount{}, nil
+}
+
+// Test users are named "user" followed by their ID
+func (r *testRepository) GetUserIDsByUsernames(ctx context.Context, usernames []string) ([]string, error) {
+	userIDs := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		if id, ok := strings.CutPrefix(username, "user"); ok {
+			userIDs = append(userIDs, id)
+		}
+	}
+	return userIDs, nil
+}
+
+func (r *testRepository) GetUsername(ctx context.Context, userID string) (string, error) {
+	return "user" + userID, nil
+}
+
+func (r *testRepository) CreateMentions(ctx context.Context, msg *room.Message, userIDs []string) error {
+	return nil
+}
+
+// Keeps messages, edit history, thread subscriptions, reactions, read
+// positions and mentions in memory, like the SQL repository does
+type messageRepository struct {
+	*testRepository
+
+	mu          sync.Mutex
+	messages    map[string]*room.Message
+	edits       map[string][]*room.MessageRevision
+	subscribers map[string][]string
+	reactions   []messageReaction
+	reads       map[string][]*room.ReadPosition
+	mentions    map[string][]string
+}
+
+type messageReaction struct {
+	messageID, userID, emoji string
+}
+
+func newMessageRepository(hub *room.Hub) *messageRepository {
+	return &messageRepository{
+		testRepository: &testRepository{room.NewRepository(hub, nil)},
+		messages:       make(map[string]*room.Message),
+		edits:          make(map[string][]*room.MessageRevision),
+		subscribers:    make(map[string][]string),
+		reads:          make(map[string][]*room.ReadPosition),
+		mentions:       make(map[string][]string),
+	}
+}
+
+func (r *messageRepository) CreateMessage(ctx context.Context, msg *room.Message) (*room.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := *msg
+	r.messages[msg.ID] = &stored
+	if parent, ok := r.messages[msg.ParentID]; ok {
+		parent.ReplyCount++
+		parent.LastReplyAt = &stored.CreatedAt
+	}
+	return msg, nil
+}
+
+func (r *messageRepository) GetMessage(ctx context.Context, id string) (*room.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("message %s not found", id)
+	}
+	found := *msg
+	return &found, nil
+}
+
+// Messages and replies of the room after the given ID, oldest first
+func (r *messageRepository) GetMessagesAfter(ctx context.Context, roomID string, after string, from *time.Time, to *time.Time, limit int) ([]*room.Message, error) {
+	return r.find(func(msg *room.Message) bool {
+		return msg.RoomID == roomID && !msg.Deleted && msg.ID > after
+	}, limit), nil
+}
+
+// Top level messages of the room, oldest first
+func (r *messageRepository) GetMessages(ctx context.Context, roomID string, before string, limit int) ([]*room.Message, error) {
+	return r.find(func(msg *room.Message) bool {
+		return msg.RoomID == roomID && msg.ParentID == "" && (before == "" || msg.ID < before)
+	}, limit), nil
+}
+
+func (r *messageRepository) GetThread(ctx context.Context, parentID string, after string, limit int) ([]*room.Message, error) {
+	return r.find(func(msg *room.Message) bool {
+		return msg.ParentID == parentID && msg.ID > after
+	}, limit), nil
+}
+
+func (r *messageRepository) find(match func(*room.Message) bool, limit int) []*room.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found := make([]*room.Message, 0)
+	for _, msg := range r.messages {
+		if match(msg) {
+			m := *msg
+			found = append(found, &m)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+func (r *messageRepository) EditMessage(ctx context.Context, id string, content string, editedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.edits[id] = append(r.edits[id], &room.MessageRevision{MessageID: id, Content: r.messages[id].Content, EditedAt: editedAt})
+	r.messages[id].Content = content
+	r.messages[id].EditedAt = &editedAt
+	return nil
+}
+
+// Previous contents of the message, oldest first
+func (r *messageRepository) GetMessageEdits(ctx context.Context, id string) ([]*room.MessageRevision, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*room.MessageRevision(nil), r.edits[id]...), nil
+}
+
+func (r *messageRepository) DeleteMessage(ctx context.Context, id string, deletedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messages[id].Content = ""
+	r.messages[id].Deleted = true
+	return nil
+}
+
+func (r *messageRepository) Subscribe(ctx context.Context, messageID string, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range r.subscribers[messageID] {
+		if id == userID {
+			return nil
+		}
+	}
+	r.subscribers[messageID] = append(r.subscribers[messageID], userID)
+	return nil
+}
+
+func (r *messageRepository) GetSubscribers(ctx context.Context, messageID string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.subscribers[messageID]...), nil
+}
+
+func (r *messageRepository) AddReaction(ctx context.Context, messageID string, userID string, emoji string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reaction := messageReaction{messageID, userID, emoji}
+	if !r.reacted(reaction) {
+		r.reactions = append(r.reactions, reaction)
+	}
+	return r.count(messageID, emoji), nil
+}
+
+func (r *messageRepository) RemoveReaction(ctx context.Context, messageID string, userID string, emoji string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reaction := messageReaction{messageID, userID, emoji}
+	for i, existing := range r.reactions {
+		if existing == reaction {
+			r.reactions = append(r.reactions[:i], r.reactions[i+1:]...)
+			break
+		}
+	}
+	return r.count(messageID, emoji), nil
+}
+
+func (r *messageRepository) reacted(reaction messageReaction) bool {
+	for _, existing := range r.reactions {
+		if existing == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *messageRepository) count(messageID string, emoji string) int {
+	count := 0
+	for _, reaction := range r.reactions {
+		if reaction.messageID == messageID && reaction.emoji == emoji {
+			count++
+		}
+	}
+	return count
+}
+
+// Grouped by emoji in the order they were first used, like the SQL query
+func (r *messageRepository) GetReactions(ctx context.Context, messageIDs []string) (map[string][]room.Reaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reactions := make(map[string][]room.Reaction)
+	for _, id := range messageIDs {
+		for _, reaction := range r.reactions {
+			if reaction.messageID != id {
+				continue
+			}
+			grouped := reactions[id]
+			i := 0
+			for i < len(grouped) && grouped[i].Emoji != reaction.emoji {
+				i++
+			}
+			if i == len(grouped) {
+				grouped = append(grouped, room.Reaction{Emoji: reaction.emoji})
+			}
+			grouped[i].Count++
+			grouped[i].UserIDs = append(grouped[i].UserIDs, reaction.userID)
+			reactions[id] = grouped
+		}
+	}
+	return reactions, nil
+}
+
+// Positions only move forward, like the SQL upsert
+func (r *messageRepository) SetReadPosition(ctx context.Context, roomID string, userID string, messageID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if position := r.readPosition(roomID, userID); position != nil {
+		if position.MessageID < messageID {
+			position.MessageID = messageID
+			position.UpdatedAt = time.Now()
+		}
+		return nil
+	}
+	r.reads[roomID] = append(r.reads[roomID], &room.ReadPosition{UserID: userID, MessageID: messageID, UpdatedAt: time.Now()})
+	return nil
+}
+
+func (r *messageRepository) GetReadPositions(ctx context.Context, roomID string) ([]*room.ReadPosition, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	positions := make([]*room.ReadPosition, 0, len(r.reads[roomID]))
+	for _, position := range r.reads[roomID] {
+		p := *position
+		positions = append(positions, &p)
+	}
+	return positions, nil
+}
+
+func (r *messageRepository) readPosition(roomID string, userID string) *room.ReadPosition {
+	for _, position := range r.reads[roomID] {
+		if position.UserID == userID {
+			return position
+		}
+	}
+	return nil
+}
+
+func (r *messageRepository) CreateMentions(ctx context.Context, msg *room.Message, userIDs []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.mentions[msg.ID] = append(r.mentions[msg.ID], userIDs...)
+	return nil
+}
+
+// Messages of others after the user's read position which are not deleted.
+// Replies only count as mentions, like the SQL query.
+func (r *messageRepository) GetUnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]room.UnreadCount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[string]room.UnreadCount)
+	for _, roomID := range roomIDs {
+		read := ""
+		if position := r.readPosition(roomID, userID); position != nil {
+			read = position.MessageID
+		}
+
+		for _, msg := range r.messages {
+			if msg.RoomID != roomID || msg.UserID == userID || msg.Deleted || msg.ID <= read {
+				continue
+			}
+			count := counts[roomID]
+			if msg.ParentID == "" {
+				count.Unread++
+			}
+			for _, mentioned := range r.mentions[msg.ID] {
+				if mentioned == userID {
+					count.Mentions++
+				}
+			}
+			counts[roomID] = count
+		}
+	}
+	return counts, nil
+}
+
+func (r *messageRepository) GetAttachments(ctx context.Context, messageIDs []string) (map[string][]*room.Attachment, error) {
+	return map[string][]*room.Attachment{}, nil
+}
+
+// Records notifications instead of delivering them
+type testNotifier struct {
+	mu            sync.Mutex
+	notifications []*notification.Notification
+}
+
+func (n *testNotifier) Notify(ctx context.Context, notifications ...*notification.Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.notifications = append(n.notifications, notifications...)
+	return nil
+}
+
+func (n *testNotifier) Sent() []*notification.Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]*notification.Notification(nil), n.notifications...)
+}
+
+func newTestService() room.Service {
+	hub := room.NewHub()
+	roomRep := &testRepository{room.NewRepository(hub, nil)}
+	return room.NewService(roomRep, config.New(), validator.New(), hub, &testNotifier{}, nil)
+}
+
+func TestServiceCreateDirect(t *testing.T) {
+	roomSvc := newTestService()
+
+	first, err := roomSvc.CreateDirect(context.Background(), &room.CreateDirectReq{CallerID: "1", UserID: "2"})
+	if err != nil {
+		t.Fatalf("Failed to create direct room: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   *room.CreateDirectReq
+		want    *room.CreateDirectRes
+		wantErr bool
+	}{
+		{
+			"Should return existing room",
+			&room.CreateDirectReq{CallerID: "1", UserID: "2"},
+			&room.CreateDirectRes{ID: first.ID, UserIDs: []string{"1", "2"}},
+			false,
+		},
+		{
+			"Should return existing room for reversed pair",
+			&room.CreateDirectReq{CallerID: "2", UserID: "1"},
+			&room.CreateDirectRes{ID: first.ID, UserIDs: []string{"1", "2"}},
+			false,
+		},
+		{
+			"Direct room with yourself",
+			&room.CreateDirectReq{CallerID: "1", UserID: "1"},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ans, err := roomSvc.CreateDirect(context.Background(), test.input)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+
+			if !cmp.Equal(ans, test.want) {
+				t.Errorf("got %#v, want %#v", ans, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceGetDirects(t *testing.T) {
+	roomSvc := newTestService()
+
+	_, _ = roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "general"})
+	direct, _ := roomSvc.CreateDirect(context.Background(), &room.CreateDirectReq{CallerID: "1", UserID: "2"})
+
+	rooms, _ := roomSvc.GetRooms(context.Background(), &room.GetRoomsReq{})
+	if len(rooms) != 1 || rooms[0].Name != "general" {
+		t.Errorf("direct rooms must not be listed in rooms, got %#v", rooms)
+	}
+
+	tests := []struct {
+		name  string
+		input *room.GetDirectsReq
+		want  []room.GetDirectsRes
+	}{
+		{
+			"Should list direct rooms of member",
+			&room.GetDirectsReq{UserID: "2"},
+			[]room.GetDirectsRes{{ID: direct.ID, Kind: room.KindDirect, UserIDs: []string{"1", "2"}}},
+		},
+		{
+			"No direct rooms",
+			&room.GetDirectsReq{UserID: "3"},
+			[]room.GetDirectsRes{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ans, _ := roomSvc.GetDirects(context.Background(), test.input)
+			if !cmp.Equal(ans, test.want) {
+				t.Errorf("got %#v, want %#v", ans, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceCreateGroup(t *testing.T) {
+	roomSvc := newTestService()
+
+	tests := []struct {
+		name    string
+		input   *room.CreateGroupReq
+		want    []string
+		wantErr bool
+	}{
+		{
+			"Should create group",
+			&room.CreateGroupReq{CallerID: "1", Name: "team", UserIDs: []string{"2", "3"}},
+			[]string{"1", "2", "3"},
+			false,
+		},
+		{
+			"Too few participants",
+			&room.CreateGroupReq{CallerID: "1", UserIDs: []string{"2", "1"}},
+			nil,
+			true,
+		},
+		{
+			"Too many participants",
+			&room.CreateGroupReq{CallerID: "1", UserIDs: []string{"2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ans, err := roomSvc.CreateGroup(context.Background(), test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+
+			if ans != nil && !cmp.Equal(ans.UserIDs, test.want) {
+				t.Errorf("got %#v, want %#v", ans.UserIDs, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceAddGroupMember(t *testing.T) {
+	roomSvc := newTestService()
+
+	group, err := roomSvc.CreateGroup(context.Background(), &room.CreateGroupReq{CallerID: "1", UserIDs: []string{"2", "3"}})
+	if err != nil {
+		t.Fatalf("Failed to create group: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   *room.AddGroupMemberReq
+		wantErr bool
+	}{
+		{
+			"Member should add user",
+			&room.AddGroupMemberReq{CallerID: "2", RoomID: group.ID, UserID: "4"},
+			false,
+		},
+		{
+			"User is already a member",
+			&room.AddGroupMemberReq{CallerID: "2", RoomID: group.ID, UserID: "4"},
+			true,
+		},
+		{
+			"Non-member can't add users",
+			&room.AddGroupMemberReq{CallerID: "5", RoomID: group.ID, UserID: "6"},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := roomSvc.AddGroupMember(context.Background(), test.input)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceGroupWithoutLimit(t *testing.T) {
+	cfg := config.New()
+	cfg.MaxGroupMembers = 0
+	hub := room.NewHub()
+	roomSvc := room.NewService(&testRepository{room.NewRepository(hub, nil)}, cfg, validator.New(), hub, &testNotifier{}, nil)
+
+	userIDs := make([]string, 0)
+	for i := 2; i <= 20; i++ {
+		userIDs = append(userIDs, strconv.Itoa(i))
+	}
+	group, err := roomSvc.CreateGroup(context.Background(), &room.CreateGroupReq{CallerID: "1", UserIDs: userIDs})
+	if err != nil {
+		t.Fatalf("Failed to create group: %s", err)
+	}
+	if len(group.UserIDs) != 20 {
+		t.Errorf("got %d members, want %d", len(group.UserIDs), 20)
+	}
+
+	err = roomSvc.AddGroupMember(context.Background(), &room.AddGroupMemberReq{CallerID: "1", RoomID: group.ID, UserID: "21"})
+	if err != nil {
+		t.Errorf("Failed to add member: %s", err)
+	}
+}
+
+func TestServiceAddGroupMemberConcurrently(t *testing.T) {
+	roomSvc := newTestService()
+	maxMembers := config.New().MaxGroupMembers
+
+	group, err := roomSvc.CreateGroup(context.Background(), &room.CreateGroupReq{CallerID: "1", UserIDs: []string{"2", "3"}})
+	if err != nil {
+		t.Fatalf("Failed to create group: %s", err)
+	}
+
+	var added atomic.Int32
+	var done sync.WaitGroup
+	for i := 0; i < 2*maxMembers; i++ {
+		done.Add(1)
+		go func(userID string) {
+			defer done.Done()
+			err := roomSvc.AddGroupMember(context.Background(), &room.AddGroupMemberReq{CallerID: "1", RoomID: group.ID, UserID: userID})
+			if err == nil {
+				added.Add(1)
+			}
+		}(strconv.Itoa(100 + i))
+	}
+	done.Wait()
+
+	if got, want := int(added.Load()), maxMembers-3; got != want {
+		t.Errorf("got %d members added, want %d", got, want)
+	}
+}
+
+func TestServiceModerateNotAllowed(t *testing.T) {
+	roomSvc := newTestService()
+
+	general, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{OwnerID: "1", Name: "general"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		action func(context.Context, *room.ModerateReq) error
+		input  *room.ModerateReq
+	}{
+		{
+			"Regular user can't kick",
+			roomSvc.Kick,
+			&room.ModerateReq{CallerID: "2", RoomID: general.ID, UserID: "3"},
+		},
+		{
+			"Regular user can't mute",
+			roomSvc.Mute,
+			&room.ModerateReq{CallerID: "2", RoomID: general.ID, UserID: "3", Duration: 60},
+		},
+		{
+			"Owner can't be banned",
+			roomSvc.Ban,
+			&room.ModerateReq{CallerID: "2", RoomID: general.ID, UserID: "1"},
+		},
+		{
+			"Only owner adds moderators",
+			roomSvc.AddModerator,
+			&room.ModerateReq{CallerID: "2", RoomID: general.ID, UserID: "3"},
+		},
+		{
+			"Can't moderate yourself",
+			roomSvc.Kick,
+			&room.ModerateReq{CallerID: "1", RoomID: general.ID, UserID: "1"},
+		},
+		{
+			"Room does not exist",
+			roomSvc.Kick,
+			&room.ModerateReq{CallerID: "1", RoomID: "unknown", UserID: "2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.action(context.Background(), test.input); err == nil {
+				t.Error("got no error, want error")
+			}
+		})
+	}
+}
+
+func TestServiceDeleteRoom(t *testing.T) {
+	roomSvc := newTestService()
+
+	general, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{OwnerID: "1", Name: "general"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+	direct, err := roomSvc.CreateDirect(context.Background(), &room.CreateDirectReq{CallerID: "1", UserID: "2"})
+	if err != nil {
+		t.Fatalf("Failed to create direct: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   *room.DeleteRoomReq
+		wantErr bool
+	}{
+		{"Regular user can't delete a room", &room.DeleteRoomReq{CallerID: "2", ID: general.ID}, true},
+		{"Non-member can't delete a direct", &room.DeleteRoomReq{CallerID: "3", ID: direct.ID}, true},
+		{"Member deletes a direct", &room.DeleteRoomReq{CallerID: "2", ID: direct.ID}, false},
+		{"Owner deletes a room", &room.DeleteRoomReq{CallerID: "1", ID: general.ID}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := roomSvc.DeleteRoom(context.Background(), test.input)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// Bans users on top of another repository, keyed by room ID and user ID
+type banRepository struct {
+	room.Repository
+	banned map[[2]string]bool
+}
+
+func (r *banRepository) IsBanned(ctx context.Context, roomID string, userID string) (bool, error) {
+	return r.banned[[2]string{roomID, userID}], nil
+}
+
+func TestServiceGetMessagesNotAllowed(t *testing.T) {
+	hub := room.NewHub()
+	repo := &banRepository{Repository: newMessageRepository(hub)}
+	roomSvc := room.NewService(repo, config.New(), validator.New(), hub, &testNotifier{}, nil)
+
+	direct, err := roomSvc.CreateDirect(context.Background(), &room.CreateDirectReq{CallerID: "1", UserID: "2"})
+	if err != nil {
+		t.Fatalf("Failed to create direct room: %s", err)
+	}
+	general, err := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "general"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %s", err)
+	}
+	repo.banned = map[[2]string]bool{{general.ID, "3"}: true}
+
+	tests := []struct {
+		name  string
+		input *room.GetMessagesReq
+	}{
+		{
+			"Non-member can't read history",
+			&room.GetMessagesReq{CallerID: "3", RoomID: direct.ID},
+		},
+		{
+			"Page is too large",
+			&room.GetMessagesReq{CallerID: "1", RoomID: direct.ID, Limit: 1000},
+		},
+		{
+			"Banned user can't read history",
+			&room.GetMessagesReq{CallerID: "3", RoomID: general.ID},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := roomSvc.GetMessages(context.Background(), test.input); err == nil {
+				t.Error("got no error, want error")
+			}
+		})
+	}
+}
+
+// Records the search query instead of running it. Bans are keyed by room ID and user ID.
+type searchRepository struct {
+	*testRepository
+	query  *room.SearchQuery
+	banned map[[2]string]bool
+}
+
+func (r *searchRepository) IsBanned(ctx context.Context, roomID string, userID string) (bool, error) {
+	return r.banned[[2]string{roomID, userID}], nil
+}
+
+func (r *searchRepository) SearchMessages(ctx context.Context, query *room.SearchQuery) ([]*room.SearchResult, error) {
+	r.query = query
+	return []*room.SearchResult{}, nil
+}
+
+func (r *searchRepository) GetReactions(ctx context.Context, messageIDs []string) (map[string][]room.Reaction, error) {
+	return map[string][]room.Reaction{}, nil
+}
+
+func (r *searchRepository) GetAttachments(ctx context.Context, messageIDs []string) (map[string][]*room.Attachment, error) {
+	return map[string][]*room.Attachment{}, nil
+}
+
+func TestServiceSearch(t *testing.T) {
+	hub := room.NewHub()
+	repo := &searchRepository{testRepository: &testRepository{room.NewRepository(hub, nil)}}
+	roomSvc := room.NewService(repo, config.New(), validator.New(), hub, &testNotifier{}, nil)
+
+	general, _ := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "general"})
+	team, _ := roomSvc.CreateGroup(context.Background(), &room.CreateGroupReq{CallerID: "1", UserIDs: []string{"2", "5"}})
+	other, _ := roomSvc.CreateGroup(context.Background(), &room.CreateGroupReq{CallerID: "3", UserIDs: []string{"4", "5"}})
+	repo.banned = map[[2]string]bool{{general.ID, "5"}: true}
+
+	tests := []struct {
+		name    string
+		input   *room.SearchReq
+		want    []string
+		wantErr bool
+	}{
+		{
+			"Should search public rooms and own groups",
+			&room.SearchReq{CallerID: "2", Query: "deploy"},
+			[]string{general.ID, team.ID},
+			false,
+		},
+		{
+			"Should search a single room",
+			&room.SearchReq{CallerID: "2", Query: "deploy", RoomID: team.ID},
+			[]string{team.ID},
+			false,
+		},
+		{
+			"Group of others",
+			&room.SearchReq{CallerID: "3", Query: "deploy", RoomID: team.ID},
+			nil,
+			true,
+		},
+		{
+			"Should skip rooms the caller is banned from",
+			&room.SearchReq{CallerID: "5", Query: "deploy"},
+			[]string{team.ID, other.ID},
+			false,
+		},
+		{
+			"Banned from the room",
+			&room.SearchReq{CallerID: "5", Query: "deploy", RoomID: general.ID},
+			nil,
+			true,
+		},
+		{
+			"Empty query",
+			&room.SearchReq{CallerID: "2"},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo.query = nil
+			_, err := roomSvc.Search(context.Background(), test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+
+			sort.Strings(repo.query.RoomIDs)
+			sort.Strings(test.want)
+			if !cmp.Equal(repo.query.RoomIDs, test.want) {
+				t.Errorf("got %v, want %v", repo.query.RoomIDs, test.want)
+			}
+		})
+	}
+}
+
+type pruneCall struct {
+	roomID   string
+	cutoff   bool
+	maxCount int
+}
+
+// Pretends every room has three expired messages
+type retentionRepository struct {
+	*testRepository
+	policies []*room.RetentionPolicy
+	calls    []pruneCall
+	left     map[string]int
+	failing  string // room ID whose pruning fails
+}
+
+func (r *retentionRepository) GetRetentionPolicies(ctx context.Context) ([]*room.RetentionPolicy, error) {
+	return r.policies, nil
+}
+
+func (r *retentionRepository) PruneMessages(ctx context.Context, roomID string, cutoff *time.Time, maxCount int, limit int, archive bool) ([]string, error) {
+	r.calls = append(r.calls, pruneCall{roomID, cutoff != nil, maxCount})
+	if roomID == r.failing {
+		return nil, errors.New("prune failed")
+	}
+	if _, ok := r.left[roomID]; !ok {
+		r.left[roomID] = 3
+	}
+
+	ids := make([]string, 0)
+	for len(ids) < limit && r.left[roomID] > 0 {
+		ids = append(ids, roomID+"-"+strconv.Itoa(r.left[roomID]))
+		r.left[roomID]--
+	}
+	return ids, nil
+}
+
+func (r *retentionRepository) DeleteAttachments(ctx context.Context, messageIDs []string) ([]*room.Attachment, error) {
+	return []*room.Attachment{}, nil
+}
+
+func (r *retentionRepository) CreateRetentionRun(ctx context.Context, run *room.RetentionRun) (*room.RetentionRun, error) {
+	return run, nil
+}
+
+func TestServicePruneExpired(t *testing.T) {
+	cfg := config.New()
+	cfg.RetentionMaxAgeDays = 30
+	cfg.RetentionBatch = 2
+	hub := room.NewHub()
+	repo := &retentionRepository{testRepository: &testRepository{room.NewRepository(hub, nil)}, left: map[string]int{}}
+	roomSvc := room.NewService(repo, cfg, validator.New(), hub, &testNotifier{}, nil)
+
+	general, _ := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "general"})
+	legal, _ := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "legal"})
+	counted, _ := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "counted"})
+	broken, _ := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{Name: "broken"})
+	repo.failing = broken.ID
+	noAge := 0
+	maxCount := 100
+	repo.policies = []*room.RetentionPolicy{
+		{RoomID: legal.ID, LegalHold: true},
+		{RoomID: counted.ID, MaxAgeDays: &noAge, MaxCount: &maxCount},
+	}
+
+	runs, err := roomSvc.PruneExpired(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to prune: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		roomID    string
+		wantCalls []pruneCall
+		wantRun   bool
+	}{
+		{
+			"Should prune by server default in batches",
+			general.ID,
+			[]pruneCall{{general.ID, true, 0}, {general.ID, true, 0}},
+			true,
+		},
+		{
+			"Legal hold",
+			legal.ID,
+			[]pruneCall{},
+			false,
+		},
+		{
+			"Should prune by room policy",
+			counted.ID,
+			[]pruneCall{{counted.ID, false, 100}, {counted.ID, false, 100}},
+			true,
+		},
+		{
+			"Failing room doesn't stop the others",
+			broken.ID,
+			[]pruneCall{{broken.ID, true, 0}},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := make([]pruneCall, 0)
+			for _, call := range repo.calls {
+				if call.roomID == test.roomID {
+					calls = append(calls, call)
+				}
+			}
+			if !cmp.Equal(calls, test.wantCalls, cmp.AllowUnexported(pruneCall{})) {
+				t.Errorf("got %v, want %v", calls, test.wantCalls)
+			}
+
+			var run *room.RetentionRun
+			for _, r := range runs {
+				if r.RoomID == test.roomID {
+					run = r
+				}
+			}
+			if (run != nil) != test.wantRun || (run != nil && run.Pruned != 3) {
+				t.Errorf("got run %#v, want run %t with 3 pruned", run, test.wantRun)
+			}
+		})
+	}
+}
+
+// Serves a history of generated messages, the first one edited and with a file
+type exportRepository struct {
+	*testRepository
+	messages []*room.Message
+}
+
+func (r *exportRepository) GetMessagesAfter(ctx context.Context, roomID string, after string, from *time.Time, to *time.Time, limit int) ([]*room.Message, error) {
+	page := make([]*room.Message, 0, limit)
+	for _, msg := range r.messages {
+		if msg.ID > after && len(page) < limit {
+			copied := *msg
+			page = append(page, &copied)
+		}
+	}
+	return page, nil
+}
+
+func (r *exportRepository) GetAttachments(ctx context.Context, messageIDs []string) (map[string][]*room.Attachment, error) {
+	return map[string][]*room.Attachment{
+		r.messages[0].ID: {{ID: "a1", RoomID: r.messages[0].RoomID, MessageID: r.messages[0].ID, Name: "notes.txt"}},
+	}, nil
+}
+
+func (r *exportRepository) GetRevisions(ctx context.Context, messageIDs []string) (map[string][]*room.MessageRevision, error) {
+	return map[string][]*room.MessageRevision{
+		r.messages[0].ID: {{MessageID: r.messages[0].ID, Content: "first draft"}},
+	}, nil
+}
+
+func TestServiceExportRoom(t *testing.T) {
+	cfg := config.New()
+	cfg.AdminIDs = []string{"9"}
+	hub := room.NewHub()
+	repo := &exportRepository{testRepository: &testRepository{room.NewRepository(hub, nil)}}
+	roomSvc := room.NewService(repo, cfg, validator.New(), hub, &testNotifier{}, nil)
+
+	general, _ := roomSvc.CreateRoom(context.Background(), &room.CreateRoomReq{OwnerID: "1", Name: "general"})
+	// More than one page of history
+	for i := 0; i < 501; i++ {
+		repo.messages = append(repo.messages, &room.Message{
+			ID:       fmt.Sprintf("%04d", i),
+			RoomID:   general.ID,
+			Username: "alice",
+			Content:  fmt.Sprintf("<b>message %d</b>", i),
+		})
+	}
+
+	tests := []struct {
+		name      string
+		input     *room.ExportRoomReq
+		wantParts []string
+		wantErr   bool
+	}{
+		{
+			"Should export JSON",
+			&room.ExportRoomReq{CallerID: "1", RoomID: general.ID},
+			[]string{`"name":"general"`, `"content":"first draft"`, `"url":"http://localhost:8080/rooms/`},
+			false,
+		},
+		{
+			"Should export Markdown for admins",
+			&room.ExportRoomReq{CallerID: "9", RoomID: general.ID, Format: room.ExportMarkdown},
+			[]string{"# general", "**alice**", "- [notes.txt](http://localhost:8080/rooms/", "<b>message 500</b>"},
+			false,
+		},
+		{
+			"Should export escaped HTML",
+			&room.ExportRoomReq{CallerID: "1", RoomID: general.ID, Format: room.ExportHTML},
+			[]string{"<h1>general</h1>", "&lt;b&gt;message 500&lt;/b&gt;", "</html>"},
+			false,
+		},
+		{
+			"Member who is not the owner",
+			&room.ExportRoomReq{CallerID: "2", RoomID: general.ID},
+			nil,
+			true,
+		},
+		{
+			"Unknown format",
+			&room.ExportRoomReq{CallerID: "1", RoomID: general.ID, Format: "pdf"},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := roomSvc.ExportRoom(context.Background(), test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+
+			var out strings.Builder
+			if err := res.Write(context.Background(), &out); err != nil {
+				t.Fatalf("Failed to write export: %s", err)
+			}
+			for _, part := range test.wantParts {
+				if !strings.Contains(out.String(), part) {
+					t.Errorf("export does not contain %q", part)
+				}
+			}
+		})
+	}
+
+	res, _ := roomSvc.ExportRoom(context.Background(), &room.ExportRoomReq{CallerID: "1", RoomID: general.ID})
+	var out strings.Builder
+	_ = res.Write(context.Background(), &out)
+	exported := struct{ Messages []room.ExportedMessage }{}
+	if err := json.Unmarshal([]byte(out.String()), &exported); err != nil {
+		t.Fatalf("Export is not valid JSON: %s", err)
+	}
+	if len(exported.Messages) != 501 {
+		t.Errorf("got %d messages, want %d", len(exported.Messages), 501)
+	}
+}
@@ -0,0 +1,159 @@
+package room
+
+import (
+	"context"
+	"errors"
+)
+
+// Stores a reply, subscribes its author to the thread and delivers it to the
+// thread subscribers. The rest of the room only gets the new reply count.
+func (s *service) sendReply(ctx context.Context, room *Room, msg *Message, parentID string) error {
+	parent, err := s.getMessage(ctx, room, parentID)
+	if err != nil {
+		return err
+	}
+
+	// Threads are one level deep, replies to a reply go to the same thread
+	if parent.ParentID != "" {
+		parent, err = s.getMessage(ctx, room, parent.ParentID)
+		if err != nil {
+			return err
+		}
+	}
+	msg.ParentID = parent.ID
+
+	_, err = s.repository.CreateMessage(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range []string{parent.UserID, msg.UserID} {
+		if err := s.repository.Subscribe(ctx, parent.ID, userID); err != nil {
+			return err
+		}
+	}
+
+	msg.recipients, err = s.threadRecipients(ctx, parent.ID)
+	if err != nil {
+		return err
+	}
+
+	parent, err = s.repository.GetMessage(ctx, parent.ID)
+	if err != nil {
+		return err
+	}
+
+	room.broadcast(msg)
+	room.broadcast(&Message{
+		ID:          parent.ID,
+		Type:        MessageThread,
+		RoomID:      room.ID,
+		ReplyCount:  parent.ReplyCount,
+		LastReplyAt: parent.LastReplyAt,
+	})
+
+	s.notifyRecipients(ctx, room, msg)
+	return nil
+}
+
+// Events about a reply only go to the subscribers of its thread.
+func (s *service) threadRecipients(ctx context.Context, parentID string) (map[string]bool, error) {
+	subscribers, err := s.repository.GetSubscribers(ctx, parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make(map[string]bool, len(subscribers))
+	for _, userID := range subscribers {
+		recipients[userID] = true
+	}
+	return recipients, nil
+}
+
+func (s *service) subscribe(ctx context.Context, client *Client, room *Room, id string, subscribe bool) error {
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	msg, err := s.getMessage(context, room, id)
+	if err != nil {
+		return err
+	}
+
+	if msg.ParentID != "" {
+		return errors.New("Message is a reply, subscribe to its parent")
+	}
+
+	if subscribe {
+		return s.repository.Subscribe(context, msg.ID, client.UserID)
+	}
+
+	return s.repository.Unsubscribe(context, msg.ID, client.UserID)
+}
+
+type GetThreadReq struct {
+	CallerID  string `form:"-"     validate:"required"`
+	RoomID    string `form:"-"     validate:"required"`
+	MessageID string `form:"-"     validate:"required"`
+	After     string `form:"after"`
+	Limit     int    `form:"limit" validate:"min=0,max=100"`
+}
+
+type GetThreadRes struct {
+	Parent  *Message   `json:"parent"`
+	Replies []*Message `json:"replies"`
+}
+
+// Returns the thread root with a page of replies, use the ID of the newest
+// reply as After for the next one.
+func (s *service) GetThread(ctx context.Context, req *GetThreadReq) (*GetThreadRes, error) {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	context, cancel := context.WithTimeout(ctx, s.config.DBTimeout)
+	defer cancel()
+
+	room, err := s.repository.GetRoom(context, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkAccess(context, room, req.CallerID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := s.repository.GetMessage(context, req.MessageID)
+	if err != nil || parent.RoomID != room.ID || parent.ParentID != "" {
+		return nil, errors.New("Thread does not exist")
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = 50
+	}
+
+	replies, err := s.repository.GetThread(context, parent.ID, req.After, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := append([]*Message{parent}, replies...)
+	err = s.attachReactions(context, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.loadAttachments(context, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &GetThreadRes{
+		Parent:  parent,
+		Replies: replies,
+	}
+
+	return res, nil
+}
@@ -0,0 +1,245 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/oklog/ulid/v2"
+)
+
+// Mentions remembered per session, a mention is sent once for each room the user is in
+const sessionMentions = 64
+
+// A user's connection carrying several rooms. Rooms are joined with subscribe
+// commands, every other command names the room it is for.
+type Session struct {
+	Conn     *websocket.Conn
+	Message  chan *Message
+	UserID   string
+	Username string
+
+	framing  framing
+	presence *Presence
+	mu       sync.Mutex
+	rooms    map[string]*Room
+	clients  map[string]*Client // by room ID
+	closed   bool
+}
+
+type ConnectReq struct {
+	Conn       *websocket.Conn
+	UserID     string `json:"userId"   validate:"required"`
+	Username   string `json:"username" validate:"required"`
+	Unnumbered bool   `json:"-"`
+}
+
+func (s *service) Connect(ctx context.Context, req *ConnectReq) error {
+	err := s.validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	session := &Session{
+		Conn:     req.Conn,
+		Message:  make(chan *Message, clientBufferSize),
+		UserID:   req.UserID,
+		Username: req.Username,
+		framing:  s.framing(req.Conn, !req.Unnumbered),
+		presence: s.hub.Presence,
+		rooms:    make(map[string]*Room),
+		clients:  make(map[string]*Client),
+	}
+
+	go session.writeMessage()
+	go session.readMessage(s)
+
+	return nil
+}
+
+// Sends messages of all subscribed rooms to the connection.
+func (sess *Session) writeMessage() {
+	mentions := make([]string, 0, sessionMentions)
+	writeMessages(sess.Conn, sess.framing, sess.Message, func(msg *Message) bool {
+		if msg.Type != MessageMention {
+			return false
+		}
+		for _, id := range mentions {
+			if id == msg.ID {
+				return true
+			}
+		}
+		if len(mentions) == sessionMentions {
+			mentions = mentions[1:]
+		}
+		mentions = append(mentions, msg.ID)
+		return false
+	})
+}
+
+// Handles subscriptions and passes other commands to the client of their room.
+func (sess *Session) readMessage(svc *service) {
+	defer func() {
+		sess.mu.Lock()
+		rooms, clients := sess.rooms, sess.clients
+		sess.rooms, sess.clients = nil, nil
+		sess.mu.Unlock()
+
+		for roomID, client := range clients {
+			svc.leave(rooms[roomID], client)
+		}
+
+		// Rooms are done with the channel once the clients are unregistered
+		sess.mu.Lock()
+		sess.closed = true
+		close(sess.Message)
+		sess.mu.Unlock()
+		sess.Conn.Close()
+	}()
+
+	for {
+		_, data, err := sess.Conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			break
+		}
+		svc.hub.Presence.Touch(sess.UserID)
+
+		cmd, err := sess.framing.codec.Decode(data)
+		if err != nil {
+			cmd = &Command{}
+		}
+
+		// Subscriptions to threads have the ID of their message
+		switch {
+		case err != nil:
+		case cmd.Type == MessageSubscribe && cmd.ID == "":
+			err = svc.subscribeRoom(sess, cmd)
+		case cmd.Type == MessageUnsubscribe && cmd.ID == "":
+			err = svc.unsubscribeRoom(sess, cmd.RoomID)
+		default:
+			room, client := sess.get(cmd.RoomID)
+			if client == nil {
+				err = errors.New("Not subscribed to the room")
+				break
+			}
+			svc.dispatch(client, room, cmd)
+			continue
+		}
+
+		reply := &Message{Type: MessageAck, ClientID: cmd.ClientID, RoomID: cmd.RoomID}
+		if err != nil {
+			reply.Type = MessageError
+			reply.Content = err.Error()
+		}
+		if err != nil || cmd.ClientID != "" {
+			sess.Message <- reply
+		}
+	}
+}
+
+func (sess *Session) get(roomID string) (*Room, *Client) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	return sess.rooms[roomID], sess.clients[roomID]
+}
+
+// Joins the room on the shared connection, resuming from LastMessageID if given.
+func (s *service) subscribeRoom(sess *Session, cmd *Command) error {
+	room, err := s.repository.GetRoom(context.Background(), cmd.RoomID)
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Conn:     sess.Conn,
+		Message:  sess.Message,
+		ConnID:   ulid.Make().String(),
+		UserID:   sess.UserID,
+		RoomID:   room.ID,
+		Username: sess.Username,
+
+		framing:    sess.framing,
+		session:    sess,
+		resumeFrom: cmd.LastMessageID,
+	}
+
+	// Known before registering, the room may drop the client right away
+	sess.mu.Lock()
+	if _, ok := sess.clients[room.ID]; ok {
+		sess.mu.Unlock()
+		return errors.New("Already subscribed to the room")
+	}
+	sess.rooms[room.ID] = room
+	sess.clients[room.ID] = client
+	sess.mu.Unlock()
+
+	err = s.register(context.Background(), room, client)
+	if err != nil {
+		sess.forget(client)
+		return err
+	}
+	room.replay(client)
+
+	return nil
+}
+
+func (s *service) unsubscribeRoom(sess *Session, roomID string) error {
+	room, client := sess.get(roomID)
+	if client == nil {
+		return errors.New("Not subscribed to the room")
+	}
+
+	sess.forget(client)
+	s.leave(room, client)
+	return nil
+}
+
+func (s *service) leave(room *Room, client *Client) {
+	room.leave(client)
+	s.hub.Presence.Disconnect(client.UserID, room.ID)
+}
+
+// Returns whether the client was still subscribed.
+func (sess *Session) forget(client *Client) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.clients[client.RoomID] != client {
+		return false
+	}
+	delete(sess.rooms, client.RoomID)
+	delete(sess.clients, client.RoomID)
+	return true
+}
+
+// Unsubscribes a client its room removed (e.g. kicked), telling the user why.
+// Called by the room's run, which unregisters the client itself.
+func (sess *Session) drop(client *Client, reason string) {
+	if !sess.forget(client) {
+		return
+	}
+
+	// Called by rooms, which don't wait for the connection to take it
+	sess.mu.Lock()
+	if !sess.closed {
+		select {
+		case sess.Message <- &Message{
+			Type:    MessageUnsubscribe,
+			Content: reason,
+			RoomID:  client.RoomID,
+		}:
+		default:
+			go client.close(websocket.CloseTryAgainLater, "Too slow to keep up")
+		}
+	}
+	sess.mu.Unlock()
+
+	// Presence changes are broadcast to rooms, including the one calling
+	go sess.presence.Disconnect(client.UserID, client.RoomID)
+}
@@ -0,0 +1,108 @@
+package room
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+const (
+	// Thumbnails fit into a square of this size
+	thumbnailSize = 320
+	// Larger images are not decoded, they would take too much memory
+	maxImagePixels = 50 * 1000 * 1000
+)
+
+// Returns the dimensions of the image and a downscaled copy, JPEG for photos
+// and PNG for everything else to keep transparency.
+func makeThumbnail(r io.ReadSeeker) (width int, height int, thumb []byte, err error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return 0, 0, nil, errors.New("Image is too large")
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, nil, err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	dst := downscale(src, thumbnailSize)
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return cfg.Width, cfg.Height, buf.Bytes(), nil
+}
+
+// Content type of the thumbnail made by makeThumbnail.
+func thumbnailType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// Shrinks the image to fit into size x size by averaging boxes of pixels,
+// smaller images are returned as they are.
+func downscale(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw == 0 {
+		dw = 1
+	}
+	if dh == 0 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+(x+1)*w/dw
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			if a == 0 {
+				continue
+			}
+			// RGBA() is premultiplied, NRGBA is not
+			dst.Pix[i+0] = uint8(r * 0xff / a)
+			dst.Pix[i+1] = uint8(g * 0xff / a)
+			dst.Pix[i+2] = uint8(b * 0xff / a)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
@@ -30,7 +30,7 @@ func TestHandlerCreateUser(t *testing.T) {
 	cfg := config.New()
 	val := validator.New()
 	userHdl := user.Init(cfg, val, tx)
-	rtr := router.InitRouter(cfg, userHdl, nil)
+	rtr := router.InitRouter(cfg, userHdl, nil, nil)
 
 	tests := []struct {
 		name  string
@@ -100,7 +100,7 @@ func TestHandlerLogin(t *testing.T) {
 	cfg := config.New()
 	val := validator.New()
 	userHdl := user.Init(cfg, val, tx)
-	rtr := router.InitRouter(cfg, userHdl, nil)
+	rtr := router.InitRouter(cfg, userHdl, nil, nil)
 
 	tests := []struct {
 		name       string
@@ -176,7 +176,7 @@ func TestHandlerLogout(t *testing.T) {
 	cfg := config.New()
 	val := validator.New()
 	userHdl := user.Init(cfg, val, tx)
-	rtr := router.InitRouter(cfg, userHdl, nil)
+	rtr := router.InitRouter(cfg, userHdl, nil, nil)
 
 	tests := []struct {
 		name string
@@ -0,0 +1,83 @@
+package user
+
+import (
+	"gochatv1/config"
+
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Keys under which the authenticated user is stored in the gin context
+const (
+	ContextUserID   = "userId"
+	ContextUsername = "username"
+)
+
+// Parses the JWT cookie issued on login and stores the caller in the context.
+// Requests without a valid token are rejected.
+func RequireAuth(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := parseAuthCookie(c, cfg)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(ContextUserID, claims.ID)
+		c.Set(ContextUsername, claims.Username)
+		c.Next()
+	}
+}
+
+// Same as RequireAuth, but lets anonymous requests through without a caller.
+func OptionalAuth(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if claims, err := parseAuthCookie(c, cfg); err == nil {
+			c.Set(ContextUserID, claims.ID)
+			c.Set(ContextUsername, claims.Username)
+		}
+		c.Next()
+	}
+}
+
+// Lets through only users listed in the config as admins, use after RequireAuth.
+func RequireAdmin(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !IsAdmin(cfg, c.GetString(ContextUserID)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func IsAdmin(cfg *config.Config, userID string) bool {
+	for _, adminID := range cfg.AdminIDs {
+		if userID != "" && userID == adminID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseAuthCookie(c *gin.Context, cfg *config.Config) (*JWTClaims, error) {
+	tokenString, err := c.Cookie("jwt")
+	if err != nil {
+		return nil, errors.New("authentication required")
+	}
+
+	claims := &JWTClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(_ *jwt.Token) (interface{}, error) {
+		return []byte(cfg.JWTKey), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
@@ -3,7 +3,6 @@ package user
 import (
 	"context"
 	"database/sql"
-	"net/http"
 )
 
 // Makes possible to inject DB connection (in prod) or Tx transaction (in tests)
@@ -29,8 +28,6 @@ func (r *repository) CreateUser(ctx context.Context, user *User) (*User, error)
 		return nil, err
 	}
 
-	http.Error(ctx.)
-
 	return user, nil
 }
 
@@ -2,6 +2,7 @@ package router
 
 import (
 	"gochatv1/config"
+	"gochatv1/internal/notification"
 	"gochatv1/internal/room"
 	"gochatv1/internal/user"
 
@@ -11,12 +12,12 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func InitRouter(cfg *config.Config, userHandler *user.Handler, roomHandler *room.Handler) *gin.Engine {
+func InitRouter(cfg *config.Config, userHandler *user.Handler, roomHandler *room.Handler, notificationHandler *notification.Handler) *gin.Engine {
 	r := gin.Default()
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{cfg.OriginHost},
-		AllowMethods:     []string{"GET", "POST"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
 		AllowHeaders:     []string{"Content-Type"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -29,12 +30,56 @@ func InitRouter(cfg *config.Config, userHandler *user.Handler, roomHandler *room
 	r.POST("/signup", userHandler.CreateUser)
 	r.POST("/login", userHandler.Login)
 	r.GET("/logout", userHandler.Logout)
+	r.GET("/push/vapid-public-key", notificationHandler.GetVAPIDPublicKey)
 
-	r.POST("/rooms", roomHandler.CreateRoom)
-	r.DELETE("/rooms", roomHandler.DeleteRoom)
-	r.GET("/rooms", roomHandler.GetRooms)
-	r.GET("/rooms/:roomId", roomHandler.JoinRoom)
-	r.GET("/rooms/:roomId/clients", roomHandler.GetClients)
+	r.POST("/rooms", user.RequireAuth(cfg), roomHandler.CreateRoom)
+	r.GET("/rooms", user.OptionalAuth(cfg), roomHandler.GetRooms)
+
+	// The jwt cookie is sent with the WebSocket upgrade as well
+	authorized := r.Group("/", user.RequireAuth(cfg))
+	authorized.DELETE("/rooms", roomHandler.DeleteRoom)
+	authorized.GET("/rooms/:roomId", roomHandler.JoinRoom)
+	authorized.GET("/ws", roomHandler.Connect)
+	authorized.GET("/rooms/:roomId/clients", roomHandler.GetClients)
+	authorized.POST("/dms", roomHandler.CreateDirect)
+	authorized.GET("/dms", roomHandler.GetDirects)
+	authorized.POST("/groups", roomHandler.CreateGroup)
+	authorized.PATCH("/groups/:roomId", roomHandler.RenameGroup)
+	authorized.POST("/groups/:roomId/members", roomHandler.AddGroupMember)
+	authorized.POST("/groups/:roomId/leave", roomHandler.LeaveGroup)
+
+	authorized.POST("/rooms/:roomId/kick", roomHandler.Kick)
+	authorized.POST("/rooms/:roomId/bans", roomHandler.Ban)
+	authorized.DELETE("/rooms/:roomId/bans/:userId", roomHandler.Unban)
+	authorized.POST("/rooms/:roomId/mutes", roomHandler.Mute)
+	authorized.DELETE("/rooms/:roomId/mutes/:userId", roomHandler.Unmute)
+	authorized.POST("/rooms/:roomId/moderators", roomHandler.AddModerator)
+	authorized.GET("/rooms/:roomId/audit", roomHandler.GetAuditLog)
+	authorized.GET("/rooms/:roomId/messages", roomHandler.GetMessages)
+	authorized.POST("/rooms/:roomId/messages", roomHandler.PostMessage)
+	authorized.GET("/rooms/:roomId/events", roomHandler.StreamEvents)
+	authorized.GET("/rooms/:roomId/poll", roomHandler.PollEvents)
+	authorized.GET("/rooms/:roomId/messages/:messageId/edits", roomHandler.GetMessageEdits)
+	authorized.GET("/rooms/:roomId/messages/:messageId/thread", roomHandler.GetThread)
+	authorized.GET("/rooms/:roomId/reads", roomHandler.GetReadPositions)
+
+	authorized.GET("/users/presence", roomHandler.GetPresence)
+	authorized.POST("/rooms/:roomId/attachments", roomHandler.UploadAttachments)
+	authorized.GET("/rooms/:roomId/attachments/:attachmentId", roomHandler.GetAttachment)
+	authorized.GET("/me/mentions", roomHandler.GetMentions)
+	authorized.GET("/rooms/:roomId/export", roomHandler.ExportRoom)
+	authorized.GET("/search", roomHandler.Search)
+
+	admin := authorized.Group("/admin", user.RequireAdmin(cfg))
+	admin.GET("/retention/policies", roomHandler.GetRetentionPolicies)
+	admin.PUT("/retention/policies/:roomId", roomHandler.SetRetentionPolicy)
+	admin.DELETE("/retention/policies/:roomId", roomHandler.DeleteRetentionPolicy)
+	admin.GET("/retention/runs", roomHandler.GetRetentionRuns)
+	admin.POST("/retention/runs", roomHandler.PruneExpired)
+	authorized.GET("/me/notification-settings", notificationHandler.GetSettings)
+	authorized.PUT("/me/notification-settings", notificationHandler.UpdateSettings)
+	authorized.POST("/me/push-subscriptions", notificationHandler.CreatePushSubscription)
+	authorized.DELETE("/me/push-subscriptions", notificationHandler.DeletePushSubscription)
 
 	return r
 }
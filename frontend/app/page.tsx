@@ -3,14 +3,12 @@
 import { useState, useEffect, useContext } from "react";
 import { useRouter } from "next/navigation";
 
-import { AuthContext } from "@/context_providers/AuthContext";
 import { WebSocketContext } from "@/context_providers/WebSocketContext";
 import { API_URL, WEBSOCKET_URL } from "@/constants/constants";
 
 export default function Home() {
   const [rooms, setRooms] = useState<{ id: string; name: string }[]>([]);
   const [roomName, setRoomName] = useState("");
-  const { user } = useContext(AuthContext);
   const { setConn } = useContext(WebSocketContext);
   const router = useRouter();
 
@@ -48,9 +46,8 @@ export default function Home() {
   }
 
   async function joinRoom(roomId: string) {
-    const ws = new WebSocket(
-      `${WEBSOCKET_URL}/rooms/${roomId}?userId=${user.id}&username=${user.username}`
-    );
+    // The user is taken from the jwt cookie sent with the upgrade
+    const ws = new WebSocket(`${WEBSOCKET_URL}/rooms/${roomId}`);
     if (ws.OPEN) {
       setConn(ws);
       router.push(`/rooms/${roomId}`);
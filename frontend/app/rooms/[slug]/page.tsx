@@ -35,16 +35,14 @@ export default function Room() {
       return;
     }
 
-    const roomId = conn.url.substring(
-      conn.url.lastIndexOf("/") + 1,
-      conn.url.indexOf("?")
-    );
+    const roomId = conn.url.substring(conn.url.lastIndexOf("/") + 1);
 
     async function getUsers() {
       try {
         const res = await fetch(`${API_URL}/rooms/${roomId}/clients`, {
           method: "GET",
           headers: { "Content-Type": "application/json" },
+          credentials: "include",
         });
         const data = await res.json();
         setUsers(data);